@@ -5,8 +5,12 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
+
+	"github.com/rancher/longhorn-manager/kvstore"
+	"github.com/rancher/longhorn-manager/manager"
 )
 
 type HandleFuncWithError func(http.ResponseWriter, *http.Request) error
@@ -18,11 +22,36 @@ func HandleError(s *client.Schemas, t HandleFuncWithError) http.Handler {
 		if err := t(rw, req); err != nil {
 			logrus.Warnf("HTTP handling error %v", err)
 			apiContext := api.GetApiContext(req)
+			if locked, ok := errors.Cause(err).(*kvstore.LockedError); ok {
+				writeConflictErr(apiContext, rw, err, locked.Holder)
+				return
+			}
+			if transition, ok := errors.Cause(err).(*manager.TransitionError); ok {
+				writeConflictErr(apiContext, rw, err, string(transition.State))
+				return
+			}
 			apiContext.WriteErr(err)
 		}
 	}))
 }
 
+// writeConflictErr tells the client another operation is in progress, with
+// who is doing it or the state of the volume as detail
+func writeConflictErr(apiContext *api.ApiContext, rw http.ResponseWriter, err error, detail string) {
+	rw.WriteHeader(http.StatusConflict)
+	if writeErr := apiContext.WriteResource(&client.ServerApiError{
+		Resource: client.Resource{
+			Type: "error",
+		},
+		Status:  http.StatusConflict,
+		Code:    "Conflict",
+		Message: err.Error(),
+		Detail:  detail,
+	}); writeErr != nil {
+		logrus.Errorf("Failed to write err: %v", err)
+	}
+}
+
 func Handler(s *Server) http.Handler {
 	r := mux.NewRouter().StrictSlash(true)
 	schemas := NewSchema()
@@ -47,18 +76,21 @@ func Handler(s *Server) http.Handler {
 	r.Methods("POST").Path("/v1/volumes").Handler(f(schemas, s.CreateVolume))
 
 	volumeActions := map[string]func(http.ResponseWriter, *http.Request) error{
-		"attach":          s.fwd.Handler(HostIDFromAttachReq, s.AttachVolume),
-		"detach":          s.fwd.Handler(HostIDFromVolume(s.man), s.DetachVolume),
-		"snapshotPurge":   s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Purge),
-		"snapshotCreate":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Create),
-		"snapshotList":    s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.List),
-		"snapshotGet":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Get),
-		"snapshotDelete":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Delete),
-		"snapshotRevert":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Revert),
-		"snapshotBackup":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Backup),
-		"recurringUpdate": s.fwd.Handler(HostIDFromVolume(s.man), s.UpdateRecurring),
-		"bgTaskQueue":     s.fwd.Handler(HostIDFromVolume(s.man), s.BgTaskQueue),
-		"replicaRemove":   s.fwd.Handler(HostIDFromVolume(s.man), s.ReplicaRemove),
+		"attach":             s.fwd.Handler(HostIDFromAttachReq, s.AttachVolume),
+		"detach":             s.fwd.Handler(HostIDFromVolume(s.man), s.DetachVolume),
+		"snapshotPurge":      s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Purge),
+		"snapshotCreate":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Create),
+		"snapshotList":       s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.List),
+		"snapshotGet":        s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Get),
+		"snapshotDelete":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Delete),
+		"snapshotRevert":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Revert),
+		"snapshotBackup":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Backup),
+		"recurringUpdate":    s.fwd.Handler(HostIDFromVolume(s.man), s.UpdateRecurring),
+		"bgTaskQueue":        s.fwd.Handler(HostIDFromVolume(s.man), s.BgTaskQueue),
+		"replicaRemove":      s.fwd.Handler(HostIDFromVolume(s.man), s.ReplicaRemove),
+		"expand":             s.fwd.Handler(HostIDFromVolume(s.man), s.ExpandVolume),
+		"updateReplicaCount": s.fwd.Handler(HostIDFromVolume(s.man), s.UpdateReplicaCount),
+		"salvage":            s.fwd.Handler(HostIDFromVolume(s.man), s.SalvageVolume),
 	}
 	for name, action := range volumeActions {
 		r.Methods("POST").Path("/v1/volumes/{name}").Queries("action", name).Handler(f(schemas, action))
@@ -77,6 +109,15 @@ func Handler(s *Server) http.Handler {
 
 	r.Methods("GET").Path("/v1/hosts").Handler(f(schemas, s.ListHost))
 	r.Methods("GET").Path("/v1/hosts/{id}").Handler(f(schemas, s.GetHost))
+	r.Methods("POST").Path("/v1/hosts/{id}").Queries("action", "diskUpdate").Handler(f(schemas, s.fwd.Handler(HostIDFromHost, s.UpdateDisk)))
+
+	r.Methods("GET").Path("/v1/events").Handler(f(schemas, s.ListEvent))
+
+	r.Methods("POST").Path("/v1/schedule/explain").Handler(f(schemas, s.ExplainSchedule))
+
+	// Admin API
+	r.Methods("GET").Path("/v1/admin/kv/export").Handler(f(schemas, s.ExportKV))
+	r.Methods("POST").Path("/v1/admin/kv/import").Handler(f(schemas, s.ImportKV))
 
 	// Internal API
 	r.Methods("POST").Path("/v1/schedule").Handler(f(schemas, s.Schedule))
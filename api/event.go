@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// ListEvent accepts optional query parameters: volume=<name> and
+// since=<RFC3339 time>
+func (s *Server) ListEvent(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	query := req.URL.Query()
+	since := time.Time{}
+	if query.Get("since") != "" {
+		var err error
+		since, err = util.ParseTime(query.Get("since"))
+		if err != nil {
+			return errors.Wrapf(err, "invalid since '%s'", query.Get("since"))
+		}
+	}
+
+	events, err := s.man.EventLog().ListEvents(query.Get("volume"), since)
+	if err != nil {
+		return errors.Wrap(err, "fail to list events")
+	}
+	apiContext.Write(toEventCollection(events))
+	return nil
+}
@@ -15,7 +15,11 @@ func (s *Server) ListHost(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return errors.Wrap(err, "fail to list host")
 	}
-	apiContext.Write(toHostCollection(hosts))
+	leader, err := s.man.GetLeader()
+	if err != nil {
+		return errors.Wrap(err, "fail to get leader")
+	}
+	apiContext.Write(toHostCollection(hosts, leader, apiContext))
 	return nil
 }
 
@@ -27,6 +31,37 @@ func (s *Server) GetHost(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return errors.Wrap(err, "fail to get host")
 	}
-	apiContext.Write(toHostResource(host))
+	leader, err := s.man.GetLeader()
+	if err != nil {
+		return errors.Wrap(err, "fail to get leader")
+	}
+	apiContext.Write(toHostResource(host, leader, apiContext))
+	return nil
+}
+
+func (s *Server) UpdateDisk(rw http.ResponseWriter, req *http.Request) error {
+	var input DiskUpdateInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read diskUpdateInput")
+	}
+	for _, tag := range input.Tags {
+		if tag == "" {
+			return errors.Errorf("invalid empty disk tag")
+		}
+	}
+
+	id := mux.Vars(req)["id"]
+
+	host, err := s.man.UpdateDisk(id, input.DiskID, input.Tags, input.Schedulable)
+	if err != nil {
+		return errors.Wrap(err, "unable to update disk")
+	}
+	leader, err := s.man.GetLeader()
+	if err != nil {
+		return errors.Wrap(err, "fail to get leader")
+	}
+	apiContext.Write(toHostResource(host, leader, apiContext))
 	return nil
 }
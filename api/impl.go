@@ -37,6 +37,10 @@ func HostIDFromVolume(man types.VolumeManager) func(req *http.Request) (string,
 	}
 }
 
+func HostIDFromHost(req *http.Request) (string, error) {
+	return mux.Vars(req)["id"], nil
+}
+
 type Fwd struct {
 	sl    types.ServiceLocator
 	proxy http.Handler
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func (s *Server) ExportKV(rw http.ResponseWriter, req *http.Request) error {
+	archive, err := s.man.KVArchiver().ExportKV()
+	if err != nil {
+		return errors.Wrap(err, "fail to export key value store")
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(archive)
+}
+
+func (s *Server) ImportKV(rw http.ResponseWriter, req *http.Request) error {
+	archive := &types.KVArchive{}
+	if err := json.NewDecoder(req.Body).Decode(archive); err != nil {
+		return errors.Wrap(err, "error parsing archive")
+	}
+	overwrite := req.URL.Query().Get("overwrite") == "true"
+
+	result, err := s.man.KVArchiver().ImportKV(archive, overwrite)
+	if err != nil && (result == nil || len(result.Conflicts) == 0 || overwrite) {
+		return errors.Wrap(err, "fail to import key value store")
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		// Nothing imported, report the conflicts
+		rw.WriteHeader(http.StatusConflict)
+	}
+	return json.NewEncoder(rw).Encode(result)
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/rancher/go-rancher/client"
 	"github.com/rancher/longhorn-manager/types"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -14,23 +16,73 @@ import (
 type Volume struct {
 	client.Resource
 
-	Name                string `json:"name,omitempty"`
-	Size                string `json:"size,omitempty"`
-	BaseImage           string `json:"baseImage,omitempty"`
-	FromBackup          string `json:"fromBackup,omitempty"`
-	NumberOfReplicas    int    `json:"numberOfReplicas,omitempty"`
-	StaleReplicaTimeout int    `json:"staleReplicaTimeout,omitempty"`
-	State               string `json:"state,omitempty"`
-	EngineImage         string `json:"engineImage,omitempty"`
-	Endpoint            string `json:"endpoint,omitemtpy"`
-	Created             string `json:"created,omitemtpy"`
+	Name                string          `json:"name,omitempty"`
+	Size                string          `json:"size,omitempty"`
+	BaseImage           string          `json:"baseImage,omitempty"`
+	FromBackup          string          `json:"fromBackup,omitempty"`
+	FromSnapshot        *SnapshotSource `json:"fromSnapshot,omitempty"`
+	NumberOfReplicas    int             `json:"numberOfReplicas,omitempty"`
+	StaleReplicaTimeout int             `json:"staleReplicaTimeout,omitempty"`
+	FailoverPolicy      string          `json:"failoverPolicy,omitempty"`
+	ReplicaBinding      string          `json:"replicaBinding,omitempty"`
+	HostSelector        []string        `json:"hostSelector,omitempty"`
+	DiskSelector        []string        `json:"diskSelector,omitempty"`
+	SpreadWarning       string          `json:"spreadWarning,omitempty"`
+	State               string          `json:"state,omitempty"`
+	DesiredState        string          `json:"desiredState,omitempty"`
+	CurrentState        string          `json:"currentState,omitempty"`
+	EngineImage         string          `json:"engineImage,omitempty"`
+	Endpoint            string          `json:"endpoint,omitemtpy"`
+	Created             string          `json:"created,omitemtpy"`
 
 	RecurringJobs []*types.RecurringJob `json:"recurringJobs,omitempty"`
+	RestoreStatus *RestoreStatus        `json:"restoreStatus,omitempty"`
 
 	Replicas   []Replica   `json:"replicas,omitempty"`
 	Controller *Controller `json:"controller,omitempty"`
 }
 
+type SnapshotSource struct {
+	Volume   string `json:"volume"`
+	Snapshot string `json:"snapshot"`
+}
+
+type RestoreStatus struct {
+	Backup   string `json:"backup"`
+	Phase    string `json:"phase"`
+	Progress *int   `json:"progress,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Started  string `json:"started"`
+	Finished string `json:"finished,omitempty"`
+}
+
+type SalvageResult struct {
+	client.Resource
+	types.SalvageResult
+}
+
+type ScheduleExplainInput struct {
+	Volume         string   `json:"volume,omitempty"`
+	Size           string   `json:"size,omitempty"`
+	ReplicaBinding string   `json:"replicaBinding,omitempty"`
+	HostSelector   []string `json:"hostSelector,omitempty"`
+	DiskSelector   []string `json:"diskSelector,omitempty"`
+}
+
+type ScheduleExplanation struct {
+	client.Resource
+	Volume     string              `json:"volume,omitempty"`
+	Candidates []ScheduleCandidate `json:"candidates"`
+}
+
+type ScheduleCandidate struct {
+	HostID   string `json:"hostId"`
+	DiskID   string `json:"diskId,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Score    int    `json:"score"`
+	Reason   string `json:"reason,omitempty"`
+}
+
 type Snapshot struct {
 	client.Resource
 	types.SnapshotInfo
@@ -39,9 +91,47 @@ type Snapshot struct {
 type Host struct {
 	client.Resource
 
-	UUID    string `json:"uuid,omitempty"`
-	Name    string `json:"name,omitempty"`
-	Address string `json:"address,omitempty"`
+	UUID          string   `json:"uuid,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Address       string   `json:"address,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Zone          string   `json:"zone,omitempty"`
+	Region        string   `json:"region,omitempty"`
+	State         string   `json:"state,omitempty"`
+	LastHeartbeat string   `json:"lastHeartbeat,omitempty"`
+	Leader        bool     `json:"leader"`
+
+	StorageCapacity  string `json:"storageCapacity,omitempty"`
+	StorageAvailable string `json:"storageAvailable,omitempty"`
+	Disks            []Disk `json:"disks,omitempty"`
+}
+
+type Disk struct {
+	ID          string   `json:"id"`
+	Path        string   `json:"path"`
+	Tags        []string `json:"tags,omitempty"`
+	Schedulable bool     `json:"schedulable"`
+
+	StorageCapacity    string `json:"storageCapacity"`
+	StorageAvailable   string `json:"storageAvailable"`
+	StorageProvisioned string `json:"storageProvisioned"`
+}
+
+type DiskUpdateInput struct {
+	DiskID      string   `json:"diskId"`
+	Tags        []string `json:"tags"`
+	Schedulable bool     `json:"schedulable"`
+}
+
+type Event struct {
+	client.Resource
+
+	Time      string `json:"time"`
+	EventType string `json:"eventType"`
+	Reason    string `json:"reason"`
+	Volume    string `json:"volume,omitempty"`
+	HostID    string `json:"hostId,omitempty"`
+	Message   string `json:"message"`
 }
 
 type BackupVolume struct {
@@ -75,7 +165,9 @@ type Replica struct {
 
 	Name         string `json:"name,omitempty"`
 	Mode         string `json:"mode,omitempty"`
+	DiskID       string `json:"diskId,omitempty"`
 	BadTimestamp string `json:"badTimestamp,omitempty"`
+	GCTimestamp  string `json:"gcTimestamp,omitempty"`
 }
 
 type AttachInput struct {
@@ -109,6 +201,14 @@ type ReplicaRemoveInput struct {
 	Name string `json:"name"`
 }
 
+type UpdateReplicaCountInput struct {
+	ReplicaCount int `json:"replicaCount"`
+}
+
+type ExpandInput struct {
+	Size string `json:"size"`
+}
+
 func NewSchema() *client.Schemas {
 	schemas := &client.Schemas{}
 
@@ -123,8 +223,20 @@ func NewSchema() *client.Schemas {
 	schemas.AddType("recurringJob", types.RecurringJob{})
 	schemas.AddType("bgTask", BgTask{})
 	schemas.AddType("replicaRemoveInput", ReplicaRemoveInput{})
+	schemas.AddType("expandInput", ExpandInput{})
+	schemas.AddType("updateReplicaCountInput", UpdateReplicaCountInput{})
+	schemas.AddType("snapshotSource", SnapshotSource{})
+	restoreStatusSchema(schemas.AddType("restoreStatus", RestoreStatus{}))
+	schemas.AddType("salvageCandidate", types.SalvageCandidate{})
+	schemas.AddType("disk", Disk{})
+	schemas.AddType("diskUpdateInput", DiskUpdateInput{})
+	schemas.AddType("scheduleExplainInput", ScheduleExplainInput{})
+	schemas.AddType("scheduleCandidate", ScheduleCandidate{})
+	scheduleExplanationSchema(schemas.AddType("scheduleExplanation", ScheduleExplanation{}))
+	salvageResultSchema(schemas.AddType("salvageResult", SalvageResult{}))
 
 	hostSchema(schemas.AddType("host", Host{}))
+	eventSchema(schemas.AddType("event", Event{}))
 	volumeSchema(schemas.AddType("volume", Volume{}))
 	backupVolumeSchema(schemas.AddType("backupVolume", BackupVolume{}))
 	settingSchema(schemas.AddType("setting", Setting{}))
@@ -157,6 +269,41 @@ func settingSchema(setting *client.Schema) {
 func hostSchema(host *client.Schema) {
 	host.CollectionMethods = []string{"GET"}
 	host.ResourceMethods = []string{"GET"}
+	host.ResourceActions = map[string]client.Action{
+		"diskUpdate": {
+			Input:  "diskUpdateInput",
+			Output: "host",
+		},
+	}
+
+	disks := host.ResourceFields["disks"]
+	disks.Type = "array[disk]"
+	host.ResourceFields["disks"] = disks
+}
+
+func salvageResultSchema(result *client.Schema) {
+	candidates := result.ResourceFields["candidates"]
+	candidates.Type = "array[salvageCandidate]"
+	result.ResourceFields["candidates"] = candidates
+}
+
+func restoreStatusSchema(status *client.Schema) {
+	// Pointers are skipped by AddType
+	status.ResourceFields["progress"] = client.Field{
+		Type:     "int",
+		Nullable: true,
+	}
+}
+
+func scheduleExplanationSchema(explanation *client.Schema) {
+	candidates := explanation.ResourceFields["candidates"]
+	candidates.Type = "array[scheduleCandidate]"
+	explanation.ResourceFields["candidates"] = candidates
+}
+
+func eventSchema(event *client.Schema) {
+	event.CollectionMethods = []string{"GET"}
+	event.ResourceMethods = []string{}
 }
 
 func volumeSchema(volume *client.Schema) {
@@ -200,6 +347,17 @@ func volumeSchema(volume *client.Schema) {
 			Input:  "replicaRemoveInput",
 			Output: "volume",
 		},
+		"expand": {
+			Input:  "expandInput",
+			Output: "volume",
+		},
+		"updateReplicaCount": {
+			Input:  "updateReplicaCountInput",
+			Output: "volume",
+		},
+		"salvage": {
+			Output: "salvageResult",
+		},
 	}
 	volume.ResourceFields["controller"] = client.Field{
 		Type:     "struct",
@@ -221,6 +379,17 @@ func volumeSchema(volume *client.Schema) {
 	volumeFromBackup.Create = true
 	volume.ResourceFields["fromBackup"] = volumeFromBackup
 
+	volumeFromSnapshot := volume.ResourceFields["fromSnapshot"]
+	volumeFromSnapshot.Type = "snapshotSource"
+	volumeFromSnapshot.Create = true
+	volumeFromSnapshot.Nullable = true
+	volume.ResourceFields["fromSnapshot"] = volumeFromSnapshot
+
+	volumeRestoreStatus := volume.ResourceFields["restoreStatus"]
+	volumeRestoreStatus.Type = "restoreStatus"
+	volumeRestoreStatus.Nullable = true
+	volume.ResourceFields["restoreStatus"] = volumeRestoreStatus
+
 	volumeNumberOfReplicas := volume.ResourceFields["numberOfReplicas"]
 	volumeNumberOfReplicas.Create = true
 	volumeNumberOfReplicas.Required = true
@@ -229,8 +398,23 @@ func volumeSchema(volume *client.Schema) {
 
 	volumeStaleReplicaTimeout := volume.ResourceFields["staleReplicaTimeout"]
 	volumeStaleReplicaTimeout.Create = true
-	volumeStaleReplicaTimeout.Default = 20
 	volume.ResourceFields["staleReplicaTimeout"] = volumeStaleReplicaTimeout
+
+	volumeFailoverPolicy := volume.ResourceFields["failoverPolicy"]
+	volumeFailoverPolicy.Create = true
+	volume.ResourceFields["failoverPolicy"] = volumeFailoverPolicy
+
+	volumeReplicaBinding := volume.ResourceFields["replicaBinding"]
+	volumeReplicaBinding.Create = true
+	volume.ResourceFields["replicaBinding"] = volumeReplicaBinding
+
+	volumeHostSelector := volume.ResourceFields["hostSelector"]
+	volumeHostSelector.Create = true
+	volume.ResourceFields["hostSelector"] = volumeHostSelector
+
+	volumeDiskSelector := volume.ResourceFields["diskSelector"]
+	volumeDiskSelector.Create = true
+	volume.ResourceFields["diskSelector"] = volumeDiskSelector
 }
 
 func backupVolumeSchema(backupVolume *client.Schema) {
@@ -264,6 +448,9 @@ func toSettingCollection(settings *types.SettingsInfo) *client.GenericCollection
 	data := []interface{}{
 		toSettingResource("backupTarget", settings.BackupTarget),
 		toSettingResource("engineImage", settings.EngineImage),
+		toSettingResource("staleReplicaTimeout", strconv.Itoa(settings.StaleReplicaTimeout)),
+		toSettingResource("autoSalvage", strconv.FormatBool(settings.AutoSalvage)),
+		toSettingResource("orphanPolicy", string(settings.OrphanPolicy)),
 	}
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "setting"}}
 }
@@ -283,7 +470,9 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 			},
 			Name:         r.Name,
 			Mode:         mode,
+			DiskID:       r.DiskID,
 			BadTimestamp: r.BadTimestamp,
+			GCTimestamp:  r.GCTimestamp,
 		})
 	}
 
@@ -309,11 +498,20 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 		Size:                strconv.FormatInt(v.Size, 10),
 		BaseImage:           v.BaseImage,
 		FromBackup:          v.FromBackup,
+		FromSnapshot:        toSnapshotSource(v.FromSnapshot),
 		NumberOfReplicas:    v.NumberOfReplicas,
 		State:               string(v.State),
+		DesiredState:        string(v.DesiredState),
+		CurrentState:        string(v.CurrentState),
 		EngineImage:         v.EngineImage,
 		RecurringJobs:       v.RecurringJobs,
+		RestoreStatus:       toRestoreStatus(v.RestoreStatus),
 		StaleReplicaTimeout: int(v.StaleReplicaTimeout / time.Minute),
+		FailoverPolicy:      string(v.FailoverPolicy),
+		ReplicaBinding:      string(v.ReplicaBinding),
+		HostSelector:        v.HostSelector,
+		DiskSelector:        v.DiskSelector,
+		SpreadWarning:       v.SpreadWarning,
 		Endpoint:            v.Endpoint,
 		Created:             v.Created,
 
@@ -328,6 +526,8 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 		actions["attach"] = struct{}{}
 		actions["recurringUpdate"] = struct{}{}
 		actions["replicaRemove"] = struct{}{}
+		actions["expand"] = struct{}{}
+		actions["updateReplicaCount"] = struct{}{}
 	case types.VolumeStateHealthy:
 		actions["detach"] = struct{}{}
 		actions["snapshotPurge"] = struct{}{}
@@ -340,6 +540,8 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 		actions["recurringUpdate"] = struct{}{}
 		actions["bgTaskQueue"] = struct{}{}
 		actions["replicaRemove"] = struct{}{}
+		actions["expand"] = struct{}{}
+		actions["updateReplicaCount"] = struct{}{}
 	case types.VolumeStateDegraded:
 		actions["detach"] = struct{}{}
 		actions["snapshotPurge"] = struct{}{}
@@ -352,18 +554,76 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 		actions["recurringUpdate"] = struct{}{}
 		actions["bgTaskQueue"] = struct{}{}
 		actions["replicaRemove"] = struct{}{}
+		actions["updateReplicaCount"] = struct{}{}
 	case types.VolumeStateCreated:
 		actions["recurringUpdate"] = struct{}{}
 	case types.VolumeStateFaulted:
+		actions["salvage"] = struct{}{}
 	}
 
 	for action := range actions {
 		r.Actions[action] = apiContext.UrlBuilder.ActionLink(r.Resource, action)
 	}
+	r.Links["events"] = apiContext.UrlBuilder.Collection("event") + "?volume=" + url.QueryEscape(v.Name)
 
 	return r
 }
 
+func toSalvageResultResource(r *types.SalvageResult) *SalvageResult {
+	return &SalvageResult{
+		Resource: client.Resource{
+			Id:   r.Volume,
+			Type: "salvageResult",
+		},
+		SalvageResult: *r,
+	}
+}
+
+func toScheduleExplanationResource(volume string, candidates []*types.ScheduleCandidate) *ScheduleExplanation {
+	r := &ScheduleExplanation{
+		Resource: client.Resource{
+			Id:   volume,
+			Type: "scheduleExplanation",
+		},
+		Volume:     volume,
+		Candidates: []ScheduleCandidate{},
+	}
+	for _, c := range candidates {
+		r.Candidates = append(r.Candidates, ScheduleCandidate{
+			HostID:   c.HostID,
+			DiskID:   c.DiskID,
+			Accepted: c.Reason == "",
+			Score:    c.Score,
+			Reason:   c.Reason,
+		})
+	}
+	return r
+}
+
+func toRestoreStatus(s *types.RestoreStatus) *RestoreStatus {
+	if s == nil {
+		return nil
+	}
+	return &RestoreStatus{
+		Backup:   s.Backup,
+		Phase:    string(s.Phase),
+		Progress: s.Progress,
+		Error:    s.Error,
+		Started:  s.Started,
+		Finished: s.Finished,
+	}
+}
+
+func toSnapshotSource(s *types.SnapshotSource) *SnapshotSource {
+	if s == nil {
+		return nil
+	}
+	return &SnapshotSource{
+		Volume:   s.Volume,
+		Snapshot: s.Snapshot,
+	}
+}
+
 func toSnapshotResource(s *types.SnapshotInfo) *Snapshot {
 	if s == nil {
 		logrus.Warn("weird: nil snapshot")
@@ -404,25 +664,77 @@ func toSnapshotCollection(ss []*types.SnapshotInfo) *client.GenericCollection {
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "snapshot"}}
 }
 
-func toHostCollection(hosts map[string]*types.HostInfo) *client.GenericCollection {
+func toHostCollection(hosts map[string]*types.HostInfo, leader string, apiContext *api.ApiContext) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range hosts {
-		data = append(data, toHostResource(v))
+		data = append(data, toHostResource(v, leader, apiContext))
 	}
 	return &client.GenericCollection{Data: data}
 }
 
-func toHostResource(h *types.HostInfo) *Host {
-	return &Host{
+func toHostResource(h *types.HostInfo, leader string, apiContext *api.ApiContext) *Host {
+	disks := []Disk{}
+	for _, d := range h.Disks {
+		disks = append(disks, Disk{
+			ID:                 d.ID,
+			Path:               d.Path,
+			Tags:               d.Tags,
+			Schedulable:        d.Schedulable,
+			StorageCapacity:    strconv.FormatInt(d.StorageCapacity, 10),
+			StorageAvailable:   strconv.FormatInt(d.StorageAvailable, 10),
+			StorageProvisioned: strconv.FormatInt(d.StorageProvisioned, 10),
+		})
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].Path < disks[j].Path
+	})
+
+	r := &Host{
 		Resource: client.Resource{
 			Id:      h.UUID,
 			Type:    "host",
 			Actions: map[string]string{},
 		},
-		UUID:    h.UUID,
-		Name:    h.Name,
-		Address: h.Address,
+		UUID:          h.UUID,
+		Name:          h.Name,
+		Address:       h.Address,
+		Tags:          h.Tags,
+		Zone:          h.Zone,
+		Region:        h.Region,
+		State:         string(h.State),
+		LastHeartbeat: h.LastHeartbeat,
+		Leader:        h.UUID == leader,
+
+		StorageCapacity:  strconv.FormatInt(h.StorageCapacity, 10),
+		StorageAvailable: strconv.FormatInt(h.StorageAvailable, 10),
+		Disks:            disks,
+	}
+	r.Actions["diskUpdate"] = apiContext.UrlBuilder.ActionLink(r.Resource, "diskUpdate")
+	return r
+}
+
+func toEventResource(e *types.EventInfo) *Event {
+	return &Event{
+		Resource: client.Resource{
+			Id:    e.ID,
+			Type:  "event",
+			Links: map[string]string{},
+		},
+		Time:      e.Time,
+		EventType: string(e.Type),
+		Reason:    e.Reason,
+		Volume:    e.Volume,
+		HostID:    e.HostID,
+		Message:   e.Message,
+	}
+}
+
+func toEventCollection(events []*types.EventInfo) *client.GenericCollection {
+	data := []interface{}{}
+	for _, e := range events {
+		data = append(data, toEventResource(e))
 	}
+	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "event"}}
 }
 
 func toBackupVolumeResource(bv *types.BackupVolumeInfo, apiContext *api.ApiContext) *BackupVolume {
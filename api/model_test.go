@@ -0,0 +1,17 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreStatusSchema(t *testing.T) {
+	assert := require.New(t)
+
+	schema := NewSchema().Schema("restoreStatus")
+	progress, ok := schema.ResourceFields["progress"]
+	assert.True(ok)
+	assert.Equal("int", progress.Type)
+	assert.True(progress.Nullable)
+}
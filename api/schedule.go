@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// ExplainSchedule shows how the hosts are evaluated for a new replica of the
+// volume, or of the spec if no volume is given. Nothing is scheduled.
+func (s *Server) ExplainSchedule(rw http.ResponseWriter, req *http.Request) error {
+	var input ScheduleExplainInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read scheduleExplainInput")
+	}
+
+	spec, err := filterScheduleExplainInput(&input)
+	if err != nil {
+		return errors.Wrap(err, "unable to filter schedule explain input")
+	}
+
+	candidates, err := s.man.ExplainSchedule(input.Volume, spec)
+	if err != nil {
+		return errors.Wrap(err, "unable to explain schedule")
+	}
+	apiContext.Write(toScheduleExplanationResource(input.Volume, candidates))
+	return nil
+}
+
+// filterScheduleExplainInput returns the spec to explain, or nil to explain
+// the volume given
+func filterScheduleExplainInput(input *ScheduleExplainInput) (*types.VolumeInfo, error) {
+	if input.Volume != "" {
+		if input.Size != "" || input.ReplicaBinding != "" || len(input.HostSelector) != 0 || len(input.DiskSelector) != 0 {
+			return nil, errors.Errorf("the spec can't be given along with volume %v", input.Volume)
+		}
+		return nil, nil
+	}
+	if input.Size == "" {
+		return nil, errors.Errorf("either volume or size is required")
+	}
+	spec, err := filterCreateVolumeInput(&Volume{
+		Size:           input.Size,
+		ReplicaBinding: input.ReplicaBinding,
+		HostSelector:   input.HostSelector,
+		DiskSelector:   input.DiskSelector,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid spec")
+	}
+	return spec, nil
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func TestFilterScheduleExplainInput(t *testing.T) {
+	assert := require.New(t)
+
+	// The volume is explained as it's stored
+	spec, err := filterScheduleExplainInput(&ScheduleExplainInput{Volume: "vol"})
+	assert.Nil(err)
+	assert.Nil(spec)
+
+	spec, err = filterScheduleExplainInput(&ScheduleExplainInput{
+		Size:           "1g",
+		ReplicaBinding: string(types.SchedulePolicyBindingHardAntiAffinity),
+		HostSelector:   []string{"rack=a"},
+		DiskSelector:   []string{"ssd"},
+	})
+	assert.Nil(err)
+	assert.Equal(int64(1024*1024*1024), spec.Size)
+	assert.Equal(types.SchedulePolicyBinding(types.SchedulePolicyBindingHardAntiAffinity), spec.ReplicaBinding)
+	assert.Equal([]string{"rack=a"}, spec.HostSelector)
+	assert.Equal([]string{"ssd"}, spec.DiskSelector)
+
+	for _, input := range []*ScheduleExplainInput{
+		{},
+		{Volume: "vol", Size: "1g"},
+		{Volume: "vol", ReplicaBinding: string(types.SchedulePolicyBindingSoftAntiAffinity)},
+		{Volume: "vol", HostSelector: []string{"rack=a"}},
+		{Volume: "vol", DiskSelector: []string{"ssd"}},
+		{Size: "one"},
+		{Size: "1g", ReplicaBinding: "anywhere"},
+		{Size: "1g", HostSelector: []string{""}},
+		{Size: "1g", DiskSelector: []string{""}},
+	} {
+		_, err := filterScheduleExplainInput(input)
+		assert.NotNil(err, "input %+v", input)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -39,6 +40,12 @@ func (s *SettingsHandlers) Get(w http.ResponseWriter, req *http.Request) error {
 		value = si.BackupTarget
 	case "engineImage":
 		value = si.EngineImage
+	case "staleReplicaTimeout":
+		value = strconv.Itoa(si.StaleReplicaTimeout)
+	case "autoSalvage":
+		value = strconv.FormatBool(si.AutoSalvage)
+	case "orphanPolicy":
+		value = string(si.OrphanPolicy)
 	default:
 		return errors.Errorf("invalid setting name %v", name)
 	}
@@ -66,6 +73,25 @@ func (s *SettingsHandlers) Set(w http.ResponseWriter, req *http.Request) error {
 		si.BackupTarget = setting.Value
 	case "engineImage":
 		si.EngineImage = setting.Value
+	case "staleReplicaTimeout":
+		timeout, err := strconv.Atoi(setting.Value)
+		if err != nil || timeout < 0 {
+			return errors.Errorf("invalid staleReplicaTimeout %v, must be minutes", setting.Value)
+		}
+		si.StaleReplicaTimeout = timeout
+	case "autoSalvage":
+		autoSalvage, err := strconv.ParseBool(setting.Value)
+		if err != nil {
+			return errors.Errorf("invalid autoSalvage %v, must be true or false", setting.Value)
+		}
+		si.AutoSalvage = autoSalvage
+	case "orphanPolicy":
+		policy := types.OrphanPolicy(setting.Value)
+		if policy != types.OrphanPolicyReport && policy != types.OrphanPolicyRemove {
+			return errors.Errorf("invalid orphanPolicy %v, must be %v or %v",
+				setting.Value, types.OrphanPolicyReport, types.OrphanPolicyRemove)
+		}
+		si.OrphanPolicy = policy
 	default:
 		return errors.Wrapf(err, "invalid setting name %v", name)
 	}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// fillSpreadWarnings sets the SpreadWarning of the volumes for the responses.
+// The error of listing the hosts is only logged, the volumes are returned
+// without warning.
+func (s *Server) fillSpreadWarnings(volumes ...*types.VolumeInfo) {
+	hosts, err := s.man.ListHosts()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "failed to list hosts for the spread warning"))
+		return
+	}
+	for _, v := range volumes {
+		v.SpreadWarning = spreadWarning(v, hosts)
+	}
+}
+
+// spreadWarning tells if the good replicas of the volume could be spread
+// over more zones, or more hosts, among the hosts which are up. The hosts
+// without zone are ignored for the zones.
+func spreadWarning(volume *types.VolumeInfo, hosts map[string]*types.HostInfo) string {
+	upHosts := 0
+	upZones := map[string]struct{}{}
+	for _, host := range hosts {
+		if host.State == types.HostStateDown {
+			continue
+		}
+		upHosts++
+		if host.Zone != "" {
+			upZones[host.Zone] = struct{}{}
+		}
+	}
+
+	replicas := 0
+	replicaHosts := map[string]struct{}{}
+	replicaZones := map[string]struct{}{}
+	for _, replica := range volume.Replicas {
+		if replica.BadTimestamp != "" {
+			continue
+		}
+		replicas++
+		replicaHosts[replica.HostID] = struct{}{}
+		if host := hosts[replica.HostID]; host != nil && host.Zone != "" {
+			replicaZones[host.Zone] = struct{}{}
+		}
+	}
+
+	if len(replicaZones) < min(replicas, len(upZones)) {
+		return fmt.Sprintf("%v replicas are in %v of %v zones", replicas, len(replicaZones), len(upZones))
+	}
+	if len(replicaHosts) < min(replicas, upHosts) {
+		return fmt.Sprintf("%v replicas are on %v of %v hosts", replicas, len(replicaHosts), upHosts)
+	}
+	return ""
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func TestSpreadWarning(t *testing.T) {
+	assert := require.New(t)
+
+	hosts := map[string]*types.HostInfo{
+		"host-1": {UUID: "host-1", State: types.HostStateUp, Zone: "a"},
+		"host-2": {UUID: "host-2", State: types.HostStateUp, Zone: "a"},
+		"host-3": {UUID: "host-3", State: types.HostStateUp, Zone: "b"},
+		"host-4": {UUID: "host-4", State: types.HostStateDown, Zone: "c"},
+	}
+	volume := &types.VolumeInfo{
+		Name: "vol",
+		Replicas: map[string]*types.ReplicaInfo{
+			"r1": {InstanceInfo: types.InstanceInfo{Name: "r1", HostID: "host-1"}},
+			"r2": {InstanceInfo: types.InstanceInfo{Name: "r2", HostID: "host-2"}},
+		},
+	}
+	assert.Equal("2 replicas are in 1 of 2 zones", spreadWarning(volume, hosts))
+
+	volume.Replicas["r2"].HostID = "host-3"
+	assert.Equal("", spreadWarning(volume, hosts))
+
+	volume.Replicas["r2"].HostID = "host-1"
+	hosts["host-3"].State = types.HostStateDown
+	assert.Equal("2 replicas are on 1 of 2 hosts", spreadWarning(volume, hosts))
+
+	// The bad replicas don't count
+	volume.Replicas["r2"].BadTimestamp = "2017-06-01T10:00:00Z"
+	assert.Equal("", spreadWarning(volume, hosts))
+}
@@ -23,6 +23,7 @@ func (s *Server) ListVolume(rw http.ResponseWriter, req *http.Request) error {
 		return errors.Wrapf(err, "unable to list")
 	}
 
+	s.fillSpreadWarnings(volumes...)
 	for _, v := range volumes {
 		resp.Data = append(resp.Data, toVolumeResource(v, apiContext))
 	}
@@ -50,6 +51,7 @@ func (s *Server) GetVolume(rw http.ResponseWriter, req *http.Request) error {
 		return nil
 	}
 
+	s.fillSpreadWarnings(v)
 	apiContext.Write(toVolumeResource(v, apiContext))
 	return nil
 }
@@ -115,22 +117,105 @@ func (s *Server) CreateVolume(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return errors.Wrap(err, "unable to create volume")
 	}
+	s.fillSpreadWarnings(volumeResp)
 	apiContext.Write(toVolumeResource(volumeResp, apiContext))
 	return nil
 }
 
+func (s *Server) ExpandVolume(rw http.ResponseWriter, req *http.Request) error {
+	var input ExpandInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read expandInput")
+	}
+	size, err := util.ConvertSize(input.Size)
+	if err != nil {
+		return errors.Wrapf(err, "error converting size '%s'", input.Size)
+	}
+
+	id := mux.Vars(req)["name"]
+
+	if err := s.man.Expand(id, util.RoundUpSize(size)); err != nil {
+		return errors.Wrap(err, "unable to expand volume")
+	}
+
+	return s.GetVolume(rw, req)
+}
+
+func (s *Server) UpdateReplicaCount(rw http.ResponseWriter, req *http.Request) error {
+	var input UpdateReplicaCountInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read updateReplicaCountInput")
+	}
+
+	id := mux.Vars(req)["name"]
+
+	if err := s.man.UpdateReplicaCount(id, input.ReplicaCount); err != nil {
+		return errors.Wrap(err, "unable to update replica count")
+	}
+
+	return s.GetVolume(rw, req)
+}
+
+func (s *Server) SalvageVolume(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["name"]
+
+	result, err := s.man.Salvage(id)
+	if err != nil {
+		return errors.Wrap(err, "unable to salvage volume")
+	}
+	apiContext.Write(toSalvageResultResource(result))
+	return nil
+}
+
 func filterCreateVolumeInput(v *Volume) (*types.VolumeInfo, error) {
 	size, err := util.ConvertSize(v.Size)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error converting size '%s'", v.Size)
 	}
+	failoverPolicy := types.FailoverPolicy(v.FailoverPolicy)
+	if failoverPolicy != "" && failoverPolicy != types.FailoverPolicyNone && failoverPolicy != types.FailoverPolicyReattach {
+		return nil, errors.Errorf("invalid failoverPolicy %v, must be %v or %v",
+			v.FailoverPolicy, types.FailoverPolicyNone, types.FailoverPolicyReattach)
+	}
+	binding := types.SchedulePolicyBinding(v.ReplicaBinding)
+	if binding != "" && binding != types.SchedulePolicyBindingSoftAntiAffinity && binding != types.SchedulePolicyBindingHardAntiAffinity {
+		return nil, errors.Errorf("invalid replicaBinding %v, must be %v or %v",
+			v.ReplicaBinding, types.SchedulePolicyBindingSoftAntiAffinity, types.SchedulePolicyBindingHardAntiAffinity)
+	}
+	for _, selector := range v.HostSelector {
+		if selector == "" {
+			return nil, errors.Errorf("invalid empty tag in hostSelector")
+		}
+	}
+	for _, selector := range v.DiskSelector {
+		if selector == "" {
+			return nil, errors.Errorf("invalid empty tag in diskSelector")
+		}
+	}
+	var fromSnapshot *types.SnapshotSource
+	if v.FromSnapshot != nil {
+		fromSnapshot = &types.SnapshotSource{
+			Volume:   v.FromSnapshot.Volume,
+			Snapshot: v.FromSnapshot.Snapshot,
+		}
+	}
 	return &types.VolumeInfo{
 		Name:                v.Name,
 		Size:                util.RoundUpSize(size),
 		BaseImage:           v.BaseImage,
 		FromBackup:          v.FromBackup,
+		FromSnapshot:        fromSnapshot,
 		NumberOfReplicas:    v.NumberOfReplicas,
 		StaleReplicaTimeout: time.Duration(v.StaleReplicaTimeout) * time.Minute,
+		FailoverPolicy:      failoverPolicy,
+		ReplicaBinding:      binding,
+		HostSelector:        v.HostSelector,
+		DiskSelector:        v.DiskSelector,
 	}, nil
 }
 
@@ -7,9 +7,48 @@ import (
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 	"os/exec"
+	"sync"
 	"time"
 )
 
+var (
+	bgTasksLock     sync.Mutex
+	bgTasksDraining bool
+	runningBgTasks  sync.WaitGroup
+)
+
+// startBgTask returns false once DrainBgTasks is called
+func startBgTask() bool {
+	bgTasksLock.Lock()
+	defer bgTasksLock.Unlock()
+	if bgTasksDraining {
+		return false
+	}
+	runningBgTasks.Add(1)
+	return true
+}
+
+// DrainBgTasks stops the controllers from starting their queued bg tasks, and
+// waits for the running ones to finish. It returns false if they haven't
+// finished in timeout.
+func DrainBgTasks(timeout time.Duration) bool {
+	bgTasksLock.Lock()
+	bgTasksDraining = true
+	bgTasksLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		runningBgTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (c *controller) LatestBgTasks() []*types.BgTask {
 	c.bgTaskLock.Lock()
 	defer c.bgTaskLock.Unlock()
@@ -36,7 +75,22 @@ func (c *controller) runBgTasks() {
 		if t == nil {
 			break
 		}
+		if !startBgTask() {
+			c.dropTask(t)
+			continue
+		}
 		c.runTask(t)
+		runningBgTasks.Done()
+	}
+}
+
+// dropTask reports the task as failed, so e.g. the recurring backup is
+// recorded as failed rather than lost silently
+func (c *controller) dropTask(t *types.BgTask) {
+	err := errors.Errorf("bg task %v of volume '%s' dropped, the manager is shutting down", t.Num, c.name)
+	logrus.Warnf("%v", err)
+	if task, ok := t.Task.(*types.BackupBgTask); ok && task.DoneHook != nil {
+		task.DoneHook(err)
 	}
 }
 
@@ -90,5 +144,9 @@ func (c *controller) runBackup(t *types.BackupBgTask) error {
 	if err == nil {
 		logrus.Infof("completed backup: volume '%s', snapshot '%s', backupTarget '%s'", c.name, t.Snapshot, t.BackupTarget)
 	}
-	return errors.Wrapf(err, "error creating backup for snapshot '%s', backupTarget '%s': %s", t.Snapshot, t.BackupTarget, &stderr)
+	err = errors.Wrapf(err, "error creating backup for snapshot '%s', backupTarget '%s': %s", t.Snapshot, t.BackupTarget, &stderr)
+	if t.DoneHook != nil {
+		t.DoneHook(err)
+	}
+	return err
 }
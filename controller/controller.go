@@ -3,6 +3,7 @@ package controller
 import (
 	"encoding/json"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -80,6 +81,7 @@ type controller struct {
 
 type volumeInfo struct {
 	Name         string `json:"name"`
+	Size         int64  `json:"size"`
 	ReplicaCount int    `json:"replicaCount"`
 	Endpoint     string `json:"endpoint"`
 }
@@ -176,6 +178,30 @@ func (c *controller) RemoveReplica(replica *types.ReplicaInfo) error {
 	return nil
 }
 
+// Size fails if the engine doesn't report the size of the volume. Such an
+// engine doesn't support expand either.
+func (c *controller) Size() (int64, error) {
+	info, err := c.info()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size == 0 {
+		return 0, errors.Errorf("engine of controller '%s' doesn't report the volume size, it's too old to expand the volume", c.name)
+	}
+	return info.Size, nil
+}
+
+func (c *controller) Expand(size int64) error {
+	sizeStr := strconv.FormatInt(size, 10)
+	if _, err := util.Execute("longhorn", "--url", c.url, "expand", "--size", sizeStr); err != nil {
+		return errors.Wrapf(err, "failed to expand replicas of controller '%s' to %s", c.name, sizeStr)
+	}
+	if _, err := util.Execute("longhorn", "--url", c.url, "frontend", "refresh"); err != nil {
+		return errors.Wrapf(err, "failed to refresh frontend of controller '%s'", c.name)
+	}
+	return nil
+}
+
 func (c *controller) Endpoint() string {
 	info, err := c.info()
 	if err != nil {
@@ -1,8 +1,11 @@
 package controller
 
 import (
+	"github.com/pkg/errors"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -21,3 +24,18 @@ func TestParseReplica(t *testing.T) {
 	assert.Equal("replica-79VrD86STQ.volume-qq", replica.Address)
 	assert.Equal(types.ReplicaModeRW, replica.Mode)
 }
+
+func TestConfirmStopped(t *testing.T) {
+	assert := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	err := confirmStopped(server.URL + "/v1")
+	assert.Equal(ErrStillRunning, errors.Cause(err))
+	server.Close()
+	assert.Nil(confirmStopped(server.URL + "/v1"))
+
+	// Unknown rather than running
+	err = ConfirmStopped(&types.ControllerInfo{})
+	assert.NotNil(err)
+	assert.NotEqual(ErrStillRunning, errors.Cause(err))
+}
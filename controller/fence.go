@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var controllerProbeClient = &http.Client{Timeout: 5 * time.Second}
+
+// ErrStillRunning is the cause of the error of ConfirmStopped if the engine
+// of the controller still answers
+var ErrStillRunning = errors.New("controller is still running")
+
+// ConfirmStopped asks the engine of the controller directly, rather than its
+// manager, whether it has stopped. Only a refused connection confirms it: the
+// host is up, but nothing listens on the engine port any more. If the host
+// cannot be reached, the controller may still be running behind a network
+// partition, and the error tells why it cannot be reached. If the engine
+// answers, the cause of the error is ErrStillRunning.
+func ConfirmStopped(ctrl *types.ControllerInfo) error {
+	if ctrl.Address == "" {
+		return errors.Errorf("cannot confirm controller '%s' has stopped, its address is unknown", ctrl.Name)
+	}
+	if err := confirmStopped(getControllerURL(ctrl.Address) + "/v1"); err != nil {
+		return errors.Wrapf(err, "cannot confirm controller '%s' has stopped", ctrl.Name)
+	}
+	return nil
+}
+
+func confirmStopped(url string) error {
+	resp, err := controllerProbeClient.Get(url)
+	if err == nil {
+		resp.Body.Close()
+		return errors.Wrapf(ErrStillRunning, "it's still answering at %v", url)
+	}
+	if isConnectionRefused(err) {
+		return nil
+	}
+	return err
+}
+
+func isConnectionRefused(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	ReplicaAPITimeout = 30 //seconds
+)
+
+var replicaClient = &http.Client{Timeout: 30 * time.Second}
+
+func getReplicaAPIURL(address string) string {
+	return "http://" + address + ":9502/v1"
+}
+
+// GetReplicaStatus reads the metadata from a running replica, without a
+// controller
+func GetReplicaStatus(replica *types.ReplicaInfo) (*types.ReplicaStatus, error) {
+	url := getReplicaAPIURL(replica.Address)
+	if err := util.WaitForAPI(url, ReplicaAPITimeout); err != nil {
+		return nil, errors.Wrapf(err, "replica '%s' is not responding", replica.Name)
+	}
+	resp, err := replicaClient.Get(url + "/replicas/1")
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting status of replica '%s'", replica.Name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("error getting status of replica '%s': %v", replica.Name, resp.Status)
+	}
+	status := &types.ReplicaStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, errors.Wrapf(err, "error parsing status of replica '%s'", replica.Name)
+	}
+	return status, nil
+}
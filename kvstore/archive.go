@@ -0,0 +1,210 @@
+package kvstore
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	ArchiveVersion = 1
+)
+
+// Export dumps hosts, settings and volumes into an archive
+func (s *KVStore) Export() (*types.KVArchive, error) {
+	schemaVersion, err := s.GetSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	archive := &types.KVArchive{
+		ArchiveVersion: ArchiveVersion,
+		SchemaVersion:  schemaVersion,
+		Created:        util.Now(),
+		Hosts:          []*types.HostInfo{},
+		Volumes:        []*types.VolumeInfo{},
+	}
+
+	hosts, err := s.ListHosts()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to export hosts")
+	}
+	for _, host := range hosts {
+		archive.Hosts = append(archive.Hosts, host)
+	}
+	sort.Slice(archive.Hosts, func(i, j int) bool {
+		return archive.Hosts[i].UUID < archive.Hosts[j].UUID
+	})
+
+	archive.Settings, err = s.GetSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to export settings")
+	}
+
+	volumes, err := s.ListVolumes()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to export volumes")
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+	archive.Volumes = volumes
+	return archive, nil
+}
+
+func sameHost(h1, h2 *types.HostInfo) bool {
+	c1 := *h1
+	c2 := *h2
+	c1.State = ""
+	c2.State = ""
+	c1.LastHeartbeat = ""
+	c2.LastHeartbeat = ""
+	return reflect.DeepEqual(c1, c2)
+}
+
+func sameVolume(v1, v2 *types.VolumeInfo) bool {
+	c1 := *v1
+	c2 := *v2
+	c1.ResourceVersion = 0
+	c2.ResourceVersion = 0
+	c1.Replicas = nil
+	c2.Replicas = nil
+	if !reflect.DeepEqual(c1, c2) || len(v1.Replicas) != len(v2.Replicas) {
+		return false
+	}
+	for name, r1 := range v1.Replicas {
+		r2 := v2.Replicas[name]
+		if r2 == nil {
+			return false
+		}
+		rc1 := *r1
+		rc2 := *r2
+		rc1.ResourceVersion = 0
+		rc2.ResourceVersion = 0
+		if !reflect.DeepEqual(rc1, rc2) {
+			return false
+		}
+	}
+	return true
+}
+
+// Import restores the archive. An entry already in the key value store is
+// a conflict, unless it's the same as in the archive. If there is any
+// conflict, nothing will be imported unless overwrite is set.
+func (s *KVStore) Import(archive *types.KVArchive, overwrite bool) (*types.KVImportResult, error) {
+	if archive.ArchiveVersion != ArchiveVersion {
+		return nil, errors.Errorf("unsupported archive version %v, expect %v",
+			archive.ArchiveVersion, ArchiveVersion)
+	}
+	schemaVersion, err := s.GetSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if archive.SchemaVersion != schemaVersion {
+		return nil, errors.Errorf("archive schema version %v doesn't match key value store schema version %v",
+			archive.SchemaVersion, schemaVersion)
+	}
+
+	result := &types.KVImportResult{
+		Imported:  []string{},
+		Unchanged: []string{},
+		Conflicts: []string{},
+	}
+	// Check everything first, so a conflict won't leave a partial import
+	hosts := []*types.HostInfo{}
+	for _, host := range archive.Hosts {
+		id := "host/" + host.UUID
+		existing, err := s.GetHost(host.UUID)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			if sameHost(existing, host) {
+				result.Unchanged = append(result.Unchanged, id)
+				continue
+			}
+			result.Conflicts = append(result.Conflicts, id)
+		}
+		hosts = append(hosts, host)
+	}
+
+	var settings *types.SettingsInfo
+	if archive.Settings != nil {
+		existing, err := s.GetSettings()
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil && reflect.DeepEqual(existing, archive.Settings) {
+			result.Unchanged = append(result.Unchanged, "settings")
+		} else {
+			if existing != nil {
+				result.Conflicts = append(result.Conflicts, "settings")
+			}
+			settings = archive.Settings
+		}
+	}
+
+	volumes := []*types.VolumeInfo{}
+	for _, v := range archive.Volumes {
+		id := "volume/" + v.Name
+		existing, err := s.GetVolume(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		// Don't modify the archive
+		volume := &types.VolumeInfo{}
+		*volume = *v
+		volume.ResourceVersion = 0
+		volume.Replicas = nil
+		if v.Replicas != nil {
+			volume.Replicas = map[string]*types.ReplicaInfo{}
+			for name, r := range v.Replicas {
+				replica := &types.ReplicaInfo{}
+				*replica = *r
+				replica.ResourceVersion = 0
+				volume.Replicas[name] = replica
+			}
+		}
+		if existing != nil {
+			if sameVolume(existing, volume) {
+				result.Unchanged = append(result.Unchanged, id)
+				continue
+			}
+			result.Conflicts = append(result.Conflicts, id)
+			volume.ResourceVersion = existing.ResourceVersion
+		}
+		volumes = append(volumes, volume)
+	}
+
+	if len(result.Conflicts) != 0 && !overwrite {
+		return result, errors.Errorf("%v entries in the archive conflict with the key value store, nothing imported: %v",
+			len(result.Conflicts), result.Conflicts)
+	}
+
+	for _, host := range hosts {
+		if err := s.SetHost(host); err != nil {
+			return result, errors.Wrapf(err, "unable to import host %v", host.UUID)
+		}
+		result.Imported = append(result.Imported, "host/"+host.UUID)
+	}
+	if settings != nil {
+		if err := s.SetSettings(settings); err != nil {
+			return result, errors.Wrap(err, "unable to import settings")
+		}
+		result.Imported = append(result.Imported, "settings")
+	}
+	for _, volume := range volumes {
+		// Fails with ConflictError if the volume is changed after the check
+		if err := s.SetVolume(volume); err != nil {
+			return result, errors.Wrapf(err, "unable to import volume %v", volume.Name)
+		}
+		result.Imported = append(result.Imported, "volume/"+volume.Name)
+	}
+	logrus.Infof("Imported %v entries, %v unchanged, %v overwritten",
+		len(result.Imported), len(result.Unchanged), len(result.Conflicts))
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	leaderLockName = "leader"
+)
+
+var (
+	LeaderLeaseTTL      = 15 * time.Second
+	LeaderRenewInterval = 5 * time.Second
+)
+
+// Elector campaigns for the leadership of the cluster on behalf of id. The
+// leadership is a lease renewed by the leader, so a crashed leader will be
+// replaced once the lease expires.
+type Elector struct {
+	s  *KVStore
+	id string
+
+	leader bool
+}
+
+func (s *KVStore) NewElector(id string) *Elector {
+	return &Elector{
+		s:  s,
+		id: id,
+	}
+}
+
+// GetLeader returns "" if there is no leader at the moment
+func (s *KVStore) GetLeader() (string, error) {
+	lock, err := s.getLock(leaderLockName)
+	if err != nil {
+		return "", err
+	}
+	if lock.expired(time.Now().UTC()) {
+		return "", nil
+	}
+	return lock.Holder, nil
+}
+
+// Run campaigns until stopCh is closed, then resigns. onChange is called
+// with true when becoming the leader, and false when losing the
+// leadership, including resigning.
+func (e *Elector) Run(stopCh <-chan struct{}, onChange func(leader bool)) {
+	ticker := time.NewTicker(LeaderRenewInterval)
+	defer ticker.Stop()
+	for {
+		e.campaign(onChange)
+		select {
+		case <-stopCh:
+			e.resign(onChange)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) campaign(onChange func(leader bool)) {
+	_, err := e.s.TryLock(leaderLockName, e.id, LeaderLeaseTTL)
+	if err == nil {
+		if !e.leader {
+			logrus.Infof("%v is elected as the leader", e.id)
+			e.leader = true
+			onChange(true)
+		}
+		return
+	}
+	if !IsLockedError(err) {
+		logrus.Errorf("Fail to campaign for the leader: %v", err)
+	}
+	// Step down if unable to renew, the lease may have been taken over
+	if e.leader {
+		logrus.Warnf("%v is no longer the leader: %v", e.id, err)
+		e.leader = false
+		onChange(false)
+	}
+}
+
+func (e *Elector) resign(onChange func(leader bool)) {
+	if !e.leader {
+		return
+	}
+	e.leader = false
+	onChange(false)
+	if err := e.s.Unlock(leaderLockName, e.id); err != nil {
+		logrus.Errorf("Fail to resign from the leader: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package kvstore
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	ConflictMaxRetries = 5
+)
+
+// ConflictError is returned when a revision-checked write finds the key
+// has been modified since it was read. The caller should re-read and retry.
+type ConflictError struct {
+	Key      string
+	Revision int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict on %v: revision %v is no longer current", e.Key, e.Revision)
+}
+
+func NewConflictError(key string, revision int64) error {
+	return &ConflictError{
+		Key:      key,
+		Revision: revision,
+	}
+}
+
+func IsConflictError(err error) bool {
+	_, ok := errors.Cause(err).(*ConflictError)
+	return ok
+}
+
+// RetryOnConflict reruns f, which should re-read what it updates, as long as
+// it fails because of a concurrent update
+func RetryOnConflict(f func() error) error {
+	var err error
+	for i := 0; i < ConflictMaxRetries; i++ {
+		if err = f(); !IsConflictError(err) {
+			return err
+		}
+		logrus.Debugf("%v, retrying", err)
+	}
+	return err
+}
+
+// LockedError is returned when a lock is held by someone else
+type LockedError struct {
+	Name   string
+	Holder string
+	Expire string
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("lock %v is held by %v until %v", e.Name, e.Holder, e.Expire)
+}
+
+func NewLockedError(lock *LockInfo) error {
+	return &LockedError{
+		Name:   lock.Name,
+		Holder: lock.Holder,
+		Expire: lock.Expire,
+	}
+}
+
+func IsLockedError(err error) bool {
+	_, ok := errors.Cause(err).(*LockedError)
+	return ok
+}
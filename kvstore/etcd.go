@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
@@ -46,24 +47,54 @@ func (s *ETCDBackend) Set(key string, obj interface{}) error {
 	return nil
 }
 
+func (s *ETCDBackend) CompareAndSet(key string, obj interface{}, revision int64) (int64, error) {
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+	opts := &eCli.SetOptions{}
+	if revision == 0 {
+		opts.PrevExist = eCli.PrevNoExist
+	} else {
+		opts.PrevIndex = uint64(revision)
+	}
+	resp, err := s.kapi.Set(context.Background(), key, string(value), opts)
+	if err != nil {
+		if cErr, ok := err.(eCli.Error); ok &&
+			(cErr.Code == eCli.ErrorCodeTestFailed || cErr.Code == eCli.ErrorCodeNodeExist) {
+			return 0, NewConflictError(key, revision)
+		}
+		if revision != 0 && eCli.IsKeyNotFound(err) {
+			return 0, NewConflictError(key, revision)
+		}
+		return 0, err
+	}
+	return int64(resp.Node.ModifiedIndex), nil
+}
+
 func (s *ETCDBackend) IsNotFoundError(err error) bool {
 	return eCli.IsKeyNotFound(err)
 }
 
 func (s *ETCDBackend) Get(key string, obj interface{}) error {
+	_, err := s.GetWithRevision(key, obj)
+	return err
+}
+
+func (s *ETCDBackend) GetWithRevision(key string, obj interface{}) (int64, error) {
 	resp, err := s.kapi.Get(context.Background(), key, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	node := resp.Node
 	if node.Dir {
-		return errors.Errorf("invalid node %v is a directory",
+		return 0, errors.Errorf("invalid node %v is a directory",
 			node.Key)
 	}
 	if err := json.Unmarshal([]byte(node.Value), obj); err != nil {
-		return errors.Wrap(err, "fail to unmarshal json")
+		return 0, errors.Wrap(err, "fail to unmarshal json")
 	}
-	return nil
+	return int64(node.ModifiedIndex), nil
 }
 
 func (s *ETCDBackend) Keys(prefix string) ([]string, error) {
@@ -86,6 +117,29 @@ func (s *ETCDBackend) Keys(prefix string) ([]string, error) {
 	return ret, nil
 }
 
+func (s *ETCDBackend) List(prefix string) (map[string][]byte, error) {
+	resp, err := s.kapi.Get(context.Background(), prefix, nil)
+	if err != nil {
+		if eCli.IsKeyNotFound(err) {
+			return map[string][]byte{}, nil
+		}
+		return nil, err
+	}
+	if !resp.Node.Dir {
+		return nil, errors.Errorf("invalid node %v is not a directory",
+			resp.Node.Key)
+	}
+
+	ret := map[string][]byte{}
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		ret[node.Key] = []byte(node.Value)
+	}
+	return ret, nil
+}
+
 func (s *ETCDBackend) Delete(key string) error {
 	_, err := s.kapi.Delete(context.Background(), key, &eCli.DeleteOptions{
 		Recursive: true,
@@ -98,3 +152,59 @@ func (s *ETCDBackend) Delete(key string) error {
 	}
 	return nil
 }
+
+func (s *ETCDBackend) Watch(prefix string, stopCh <-chan struct{}) (<-chan *WatchEvent, error) {
+	// Start from the current index, otherwise the changes made before the
+	// first request of the watcher will be missed
+	index := uint64(0)
+	resp, err := s.kapi.Get(context.Background(), prefix, nil)
+	if err == nil {
+		index = resp.Index
+	} else if eErr, ok := err.(eCli.Error); ok && eErr.Code == eCli.ErrorCodeKeyNotFound {
+		index = eErr.Index
+	} else {
+		return nil, errors.Wrapf(err, "unable to watch %v", prefix)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := s.kapi.Watcher(prefix, &eCli.WatcherOptions{
+		AfterIndex: index,
+		Recursive:  true,
+	})
+
+	ch := make(chan *WatchEvent)
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer close(ch)
+		defer cancel()
+		for {
+			resp, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.Errorf("Fail to watch %v: %v", prefix, err)
+				}
+				return
+			}
+			e := &WatchEvent{
+				Type: WatchEventTypeSet,
+				Key:  resp.Node.Key,
+			}
+			switch resp.Action {
+			case "delete", "expire", "compareAndDelete":
+				e.Type = WatchEventTypeDelete
+			}
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
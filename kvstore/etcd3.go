@@ -0,0 +1,222 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	eCliV3 "github.com/coreos/etcd/clientv3"
+)
+
+var (
+	ETCD3KeyNotFoundError = errors.Errorf("key not found")
+)
+
+// ETCD3Backend stores the same hierarchical layout as ETCDBackend on top of
+// the flat etcd v3 keyspace. A "directory" is every key sharing the
+// `<dir>/` prefix.
+type ETCD3Backend struct {
+	Servers []string
+
+	cli *eCliV3.Client
+}
+
+func NewETCD3Backend(servers []string) (*ETCD3Backend, error) {
+	eCfg := eCliV3.Config{
+		Endpoints:   servers,
+		DialTimeout: 5 * time.Second,
+	}
+
+	etcdc, err := eCliV3.New(eCfg)
+	if err != nil {
+		return nil, err
+	}
+	backend := &ETCD3Backend{
+		Servers: servers,
+
+		cli: etcdc,
+	}
+	return backend, nil
+}
+
+func (s *ETCD3Backend) Close() error {
+	return s.cli.Close()
+}
+
+func dirPrefix(key string) string {
+	return strings.TrimSuffix(key, Separator) + Separator
+}
+
+func (s *ETCD3Backend) Set(key string, obj interface{}) error {
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if _, err := s.cli.Put(context.Background(), key, string(value)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *ETCD3Backend) CompareAndSet(key string, obj interface{}, revision int64) (int64, error) {
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.cli.Txn(context.Background()).If(
+		eCliV3.Compare(eCliV3.ModRevision(key), "=", revision),
+	).Then(
+		eCliV3.OpPut(key, string(value)),
+	).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, NewConflictError(key, revision)
+	}
+	return resp.Header.Revision, nil
+}
+
+func (s *ETCD3Backend) IsNotFoundError(err error) bool {
+	return err == ETCD3KeyNotFoundError
+}
+
+func (s *ETCD3Backend) Get(key string, obj interface{}) error {
+	_, err := s.GetWithRevision(key, obj)
+	return err
+}
+
+func (s *ETCD3Backend) GetWithRevision(key string, obj interface{}) (int64, error) {
+	resp, err := s.cli.Get(context.Background(), key)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		children, err := s.cli.Get(context.Background(), dirPrefix(key),
+			eCliV3.WithPrefix(), eCliV3.WithCountOnly())
+		if err != nil {
+			return 0, err
+		}
+		if children.Count != 0 {
+			return 0, errors.Errorf("invalid node %v is a directory", key)
+		}
+		return 0, ETCD3KeyNotFoundError
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, obj); err != nil {
+		return 0, errors.Wrap(err, "fail to unmarshal json")
+	}
+	return resp.Kvs[0].ModRevision, nil
+}
+
+func (s *ETCD3Backend) Keys(prefix string) ([]string, error) {
+	dir := dirPrefix(prefix)
+	resp, err := s.cli.Get(context.Background(), dir,
+		eCliV3.WithPrefix(), eCliV3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		leaf, err := s.cli.Get(context.Background(), prefix, eCliV3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		if leaf.Count != 0 {
+			return nil, errors.Errorf("invalid node %v is not a directory", prefix)
+		}
+		return nil, nil
+	}
+
+	// Keys come back sorted, so children of the same entry are adjacent
+	ret := []string{}
+	for _, kv := range resp.Kvs {
+		child := strings.SplitN(strings.TrimPrefix(string(kv.Key), dir), Separator, 2)[0]
+		key := dir + child
+		if len(ret) != 0 && ret[len(ret)-1] == key {
+			continue
+		}
+		ret = append(ret, key)
+	}
+	return ret, nil
+}
+
+func (s *ETCD3Backend) List(prefix string) (map[string][]byte, error) {
+	dir := dirPrefix(prefix)
+	resp, err := s.cli.Get(context.Background(), dir, eCliV3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string][]byte{}
+	for _, kv := range resp.Kvs {
+		if strings.Contains(strings.TrimPrefix(string(kv.Key), dir), Separator) {
+			continue
+		}
+		ret[string(kv.Key)] = kv.Value
+	}
+	return ret, nil
+}
+
+func (s *ETCD3Backend) Delete(key string) error {
+	_, err := s.cli.Txn(context.Background()).Then(
+		eCliV3.OpDelete(key),
+		eCliV3.OpDelete(dirPrefix(key), eCliV3.WithPrefix()),
+	).Commit()
+	return err
+}
+
+func (s *ETCD3Backend) Watch(prefix string, stopCh <-chan struct{}) (<-chan *WatchEvent, error) {
+	// Start from the current revision, otherwise the changes made before
+	// the watch is created will be missed
+	resp, err := s.cli.Get(context.Background(), prefix, eCliV3.WithCountOnly())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to watch %v", prefix)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchCh := s.cli.Watch(ctx, prefix, eCliV3.WithPrefix(),
+		eCliV3.WithRev(resp.Header.Revision+1))
+
+	ch := make(chan *WatchEvent)
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer close(ch)
+		defer cancel()
+		dir := dirPrefix(prefix)
+		for wresp := range watchCh {
+			if err := wresp.Err(); err != nil {
+				logrus.Errorf("Fail to watch %v: %v", prefix, err)
+				return
+			}
+			for _, ev := range wresp.Events {
+				key := string(ev.Kv.Key)
+				// WithPrefix() also matches e.g. <prefix>-foo
+				if key != prefix && !strings.HasPrefix(key, dir) {
+					continue
+				}
+				e := &WatchEvent{
+					Type: WatchEventTypeSet,
+					Key:  key,
+				}
+				if ev.Type == eCliV3.EventTypeDelete {
+					e.Type = WatchEventTypeDelete
+				}
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
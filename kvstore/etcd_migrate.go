@@ -0,0 +1,112 @@
+package kvstore
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	eCli "github.com/coreos/etcd/client"
+	eCliV3 "github.com/coreos/etcd/clientv3"
+)
+
+const (
+	keyETCDv3Migration = "etcd-v3-migration"
+)
+
+// ETCDv3Migration marks the progress of MigrateETCDv2ToV3 in etcd v3
+type ETCDv3Migration struct {
+	Completed bool `json:"completed"`
+}
+
+// MigrateETCDv2ToV3 copies every value under prefix from the etcd v2
+// keyspace into the etcd v3 keyspace, keeping the same key names.
+//
+// etcd cannot copy a whole tree in one transaction, so the progress is
+// recorded in <prefix>/etcd-v3-migration. An interrupted migration can be
+// run again: the keys already copied with the same value are skipped. It
+// refuses to run if the migration has completed, or if v3 already has keys
+// under prefix which were not written by the migration.
+func MigrateETCDv2ToV3(src *ETCDBackend, dst *ETCD3Backend, prefix string) (int, error) {
+	markerKey := dirPrefix(prefix) + keyETCDv3Migration
+	marker := &ETCDv3Migration{}
+	if err := dst.Get(markerKey, marker); err != nil {
+		if !dst.IsNotFoundError(err) {
+			return 0, errors.Wrap(err, "unable to check etcd v3 destination")
+		}
+		existing, err := dst.cli.Get(context.Background(), dirPrefix(prefix),
+			eCliV3.WithPrefix(), eCliV3.WithCountOnly())
+		if err != nil {
+			return 0, errors.Wrap(err, "unable to check etcd v3 destination")
+		}
+		if existing.Count != 0 {
+			return 0, errors.Errorf("etcd v3 already contains %v keys under %v, refuse to migrate",
+				existing.Count, prefix)
+		}
+		if _, err := dst.CompareAndSet(markerKey, marker, 0); err != nil {
+			return 0, errors.Wrap(err, "unable to start migration")
+		}
+	} else if marker.Completed {
+		return 0, errors.Errorf("etcd v3 has already been migrated under %v, refuse to migrate again", prefix)
+	} else {
+		logrus.Infof("Resume the interrupted migration under %v", prefix)
+	}
+
+	resp, err := src.kapi.Get(context.Background(), prefix, &eCli.GetOptions{
+		Recursive: true,
+		Sort:      true,
+	})
+	if err != nil && !eCli.IsKeyNotFound(err) {
+		return 0, errors.Wrapf(err, "unable to read etcd v2 tree %v", prefix)
+	}
+
+	count := 0
+	nodes := eCli.Nodes{}
+	if resp != nil && resp.Node != nil {
+		nodes = append(nodes, resp.Node)
+	}
+	for len(nodes) != 0 {
+		node := nodes[0]
+		nodes = nodes[1:]
+		if node.Dir {
+			nodes = append(nodes, node.Nodes...)
+			continue
+		}
+		copied, err := migrateETCDv3Key(dst, node.Key, node.Value)
+		if err != nil {
+			return count, err
+		}
+		if copied {
+			logrus.Debugf("Migrated %v", node.Key)
+		}
+		count++
+	}
+
+	marker.Completed = true
+	if err := dst.Set(markerKey, marker); err != nil {
+		return count, errors.Wrap(err, "unable to complete migration")
+	}
+	return count, nil
+}
+
+// migrateETCDv3Key writes the key if it doesn't exist in v3 yet. It's fine
+// if the key has the same value, which was copied by an interrupted run.
+func migrateETCDv3Key(dst *ETCD3Backend, key, value string) (bool, error) {
+	resp, err := dst.cli.Txn(context.Background()).If(
+		eCliV3.Compare(eCliV3.CreateRevision(key), "=", 0),
+	).Then(
+		eCliV3.OpPut(key, value),
+	).Else(
+		eCliV3.OpGet(key),
+	).Commit()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to write %v to etcd v3", key)
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) != 0 && string(kvs[0].Value) == value {
+		return false, nil
+	}
+	return false, errors.Errorf("%v already exists in etcd v3 with a different value, refuse to migrate", key)
+}
@@ -0,0 +1,113 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	keyEvents = "events"
+)
+
+func (s *KVStore) eventKey(id string) string {
+	return filepath.Join(s.key(keyEvents), id)
+}
+
+// newEventID returns an ID sorted by the time of the event
+func newEventID(t time.Time) string {
+	return fmt.Sprintf("%019d-%s", t.UnixNano(), util.RandomID())
+}
+
+func eventIDTime(id string) (time.Time, error) {
+	nsec, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid event id %v", id)
+	}
+	return time.Unix(0, nsec).UTC(), nil
+}
+
+// AddEvent fills in ID and Time of the event
+func (s *KVStore) AddEvent(event *types.EventInfo) error {
+	now := time.Now().UTC()
+	event.ID = newEventID(now)
+	event.Time = now.Format(time.RFC3339)
+	if err := s.b.Set(s.eventKey(event.ID), event); err != nil {
+		return errors.Wrapf(err, "unable to add event %v", event.Reason)
+	}
+	return nil
+}
+
+// eventIDs returns the IDs of the events, oldest first
+func (s *KVStore) eventIDs() ([]string, error) {
+	keys, err := s.b.Keys(s.key(keyEvents))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list events")
+	}
+	ids := []string{}
+	for _, key := range keys {
+		ids = append(ids, filepath.Base(key))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ListEvents returns the events since the time, oldest first. It reads all
+// the events at once rather than one by one.
+func (s *KVStore) ListEvents(volumeName string, since time.Time) ([]*types.EventInfo, error) {
+	values, err := s.b.List(s.key(keyEvents))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list events")
+	}
+	ids := []string{}
+	for key := range values {
+		ids = append(ids, filepath.Base(key))
+	}
+	sort.Strings(ids)
+
+	events := []*types.EventInfo{}
+	for _, id := range ids {
+		t, err := eventIDTime(id)
+		if err != nil || t.Before(since) {
+			continue
+		}
+		event := &types.EventInfo{}
+		if err := json.Unmarshal(values[s.eventKey(id)], event); err != nil {
+			return nil, errors.Wrapf(err, "unable to decode event %v", id)
+		}
+		if volumeName != "" && event.Volume != volumeName {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (s *KVStore) PruneEvents(before time.Time, max int) (int, error) {
+	ids, err := s.eventIDs()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i, id := range ids {
+		t, err := eventIDTime(id)
+		if err == nil && !t.Before(before) && len(ids)-i <= max {
+			// The rest are newer
+			break
+		}
+		if err := s.b.Delete(s.eventKey(id)); err != nil {
+			return count, errors.Wrapf(err, "unable to delete event %v", id)
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,357 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	// FileCompactRatio is how many times the log can grow from its size
+	// after the last compaction, i.e. the size of the live data, before
+	// it's compacted again
+	FileCompactRatio int64 = 2
+	// FileCompactMinSize is the size below which the log isn't compacted
+	FileCompactMinSize int64 = 1 << 20
+)
+
+const (
+	fileOpSet      = "set"
+	fileOpDelete   = "delete"
+	fileOpRevision = "revision"
+)
+
+// fileRecord is one line of the FileBackend log. Delete is recursive, the
+// same as Backend.Delete(). Revision only records the latest revision, so
+// revisions won't be reused after compaction.
+type fileRecord struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Revision int64  `json:"revision,omitempty"`
+}
+
+// FileBackend is a single node Backend without etcd. It keeps everything in
+// a MemoryBackend, and appends every change to a JSON log at Path before
+// applying it, which is replayed on the next start. The log is compacted on
+// start, and whenever it grows FileCompactRatio times its compacted size.
+type FileBackend struct {
+	*MemoryBackend
+
+	Path string
+
+	f    *os.File
+	size int64
+	lock *os.File
+	// compactedSize is the size of the log after the last compaction
+	compactedSize int64
+}
+
+func NewFileBackend(path string) (*FileBackend, error) {
+	memory, err := NewMemoryBackend()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrapf(err, "unable to create directory for %v", path)
+	}
+
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open lock file of %v", path)
+	}
+	// The lock is held until Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, errors.Wrapf(err, "%v is in use by another process", path)
+	}
+
+	backend := &FileBackend{
+		MemoryBackend: memory,
+		Path:          path,
+		lock:          lock,
+	}
+	if err := backend.open(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+func (s *FileBackend) open() error {
+	if err := s.replay(); err != nil {
+		return err
+	}
+	if err := s.compact(); err != nil {
+		return err
+	}
+	return s.reopen()
+}
+
+// reopen the log for appending, since compact replaces it
+func (s *FileBackend) reopen() error {
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %v", s.Path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "unable to stat %v", s.Path)
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	s.size = info.Size()
+	s.compactedSize = s.size
+	return nil
+}
+
+// compactIfNeeded is called with lock held after a change is appended, which
+// is kept even if the compaction fails
+func (s *FileBackend) compactIfNeeded() {
+	if s.size < FileCompactMinSize || s.size < s.compactedSize*FileCompactRatio {
+		return
+	}
+	if err := s.compact(); err != nil {
+		logrus.Errorf("Fail to compact %v: %v", s.Path, err)
+	}
+	if err := s.reopen(); err != nil {
+		// The log may have been replaced, don't write to the old one
+		logrus.Errorf("Fail to reopen %v after compaction: %v", s.Path, err)
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+func (s *FileBackend) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	defer s.lock.Close()
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (s *FileBackend) Set(key string, obj interface{}) error {
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.append(&fileRecord{
+		Op:       fileOpSet,
+		Key:      key,
+		Value:    string(value),
+		Revision: s.revision + 1,
+	}); err != nil {
+		return err
+	}
+	s.set(key, string(value))
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *FileBackend) CompareAndSet(key string, obj interface{}, revision int64) (int64, error) {
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkRevision(key, revision); err != nil {
+		return 0, err
+	}
+	if err := s.append(&fileRecord{
+		Op:       fileOpSet,
+		Key:      key,
+		Value:    string(value),
+		Revision: s.revision + 1,
+	}); err != nil {
+		return 0, err
+	}
+	revision = s.set(key, string(value))
+	s.compactIfNeeded()
+	return revision, nil
+}
+
+func (s *FileBackend) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.matchKeys(key)) == 0 {
+		return nil
+	}
+	if err := s.append(&fileRecord{
+		Op:       fileOpDelete,
+		Key:      key,
+		Revision: s.revision + 1,
+	}); err != nil {
+		return err
+	}
+	s.delete(key)
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *FileBackend) replay() error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "unable to open %v", s.Path)
+	}
+	defer f.Close()
+
+	count := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				// The process was killed in the middle of a write,
+				// the change has never been acknowledged
+				logrus.Warnf("Discard incomplete record at the end of %v", s.Path)
+			}
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to read %v", s.Path)
+		}
+		record := &fileRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return errors.Wrapf(err, "invalid record %v in %v", count+1, s.Path)
+		}
+		if err := s.apply(record); err != nil {
+			return errors.Wrapf(err, "invalid record %v in %v", count+1, s.Path)
+		}
+		count++
+	}
+	logrus.Infof("Loaded %v records from %v", count, s.Path)
+	return nil
+}
+
+func (s *FileBackend) apply(record *fileRecord) error {
+	if record.Revision > s.revision {
+		s.revision = record.Revision
+	}
+	switch record.Op {
+	case fileOpRevision:
+	case fileOpSet:
+		s.c.SetDefault(record.Key, &memoryEntry{
+			value:    record.Value,
+			revision: record.Revision,
+		})
+	case fileOpDelete:
+		dir := dirPrefix(record.Key)
+		for k := range s.c.Items() {
+			if k == record.Key || strings.HasPrefix(k, dir) {
+				s.c.Delete(k)
+			}
+		}
+	default:
+		return errors.Errorf("unknown operation %v", record.Op)
+	}
+	return nil
+}
+
+// compact rewrites the log with only the current values, so the log won't
+// grow forever
+func (s *FileBackend) compact() error {
+	items := s.c.Items()
+	keys := []string{}
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmp := s.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %v", tmp)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if _, err := writeRecord(w, &fileRecord{
+		Op:       fileOpRevision,
+		Revision: s.revision,
+	}); err != nil {
+		return errors.Wrapf(err, "unable to write %v", tmp)
+	}
+	for _, key := range keys {
+		entry := items[key].Object.(*memoryEntry)
+		if _, err := writeRecord(w, &fileRecord{
+			Op:       fileOpSet,
+			Key:      key,
+			Value:    entry.value,
+			Revision: entry.revision,
+		}); err != nil {
+			return errors.Wrapf(err, "unable to write %v", tmp)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrapf(err, "unable to write %v", tmp)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "unable to sync %v", tmp)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return errors.Wrapf(err, "unable to replace %v", s.Path)
+	}
+	return syncDir(filepath.Dir(s.Path))
+}
+
+// append is called with lock held, the change is abandoned if it fails
+func (s *FileBackend) append(record *fileRecord) error {
+	if s.f == nil {
+		return errors.Errorf("%v has been closed", s.Path)
+	}
+	n, err := writeRecord(s.f, record)
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial record in the middle of the log
+		if err := s.f.Truncate(s.size); err != nil {
+			logrus.Errorf("Fail to truncate %v after failed write: %v", s.Path, err)
+		}
+		return errors.Wrapf(err, "unable to write %v", s.Path)
+	}
+	s.size += int64(n)
+	return nil
+}
+
+func writeRecord(w io.Writer, record *fileRecord) (int, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(append(line, '\n'))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %v", dir)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrapf(err, "unable to sync %v", dir)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
 )
 
 type Backend interface {
@@ -15,6 +16,21 @@ type Backend interface {
 	Delete(key string) error
 	Keys(prefix string) ([]string, error)
 	IsNotFoundError(err error) bool
+	// List returns the JSON values of the keys right under prefix, by key.
+	// Directories under prefix are skipped.
+	List(prefix string) (map[string][]byte, error)
+
+	// GetWithRevision works as Get, and also returns the revision of the
+	// key, which can be passed to CompareAndSet later
+	GetWithRevision(key string, obj interface{}) (int64, error)
+	// CompareAndSet only writes obj if key is still at revision, otherwise
+	// it returns ConflictError. Revision 0 means the key must not exist.
+	// It returns the new revision of the key.
+	CompareAndSet(key string, obj interface{}, revision int64) (int64, error)
+
+	// Watch reports changes of prefix and everything under it, until
+	// stopCh is closed. The channel will be closed if the watch fails.
+	Watch(prefix string, stopCh <-chan struct{}) (<-chan *WatchEvent, error)
 }
 
 type KVStore struct {
@@ -55,6 +71,15 @@ func (s *KVStore) SetHost(host *types.HostInfo) error {
 	return nil
 }
 
+// UpdateHostHeartbeat refreshes LastHeartbeat of the host
+func (s *KVStore) UpdateHostHeartbeat(host *types.HostInfo) error {
+	host.LastHeartbeat = util.Now()
+	if err := s.b.Set(s.hostKey(host.UUID), host); err != nil {
+		return errors.Wrapf(err, "unable to update heartbeat of host %v", host.UUID)
+	}
+	return nil
+}
+
 func (s *KVStore) GetHost(id string) (*types.HostInfo, error) {
 	host, err := s.getHostByKey(s.hostKey(id))
 	if err != nil {
@@ -1,7 +1,9 @@
 package kvstore
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -32,7 +34,9 @@ func Test(t *testing.T) { TestingT(t) }
 
 type TestSuite struct {
 	etcd        *KVStore
+	etcd3       *KVStore
 	memory      *KVStore
+	file        *KVStore
 	engineImage string
 }
 
@@ -50,6 +54,13 @@ func (s *TestSuite) SetUpTest(c *C) {
 	c.Assert(err, IsNil)
 	s.memory = memory
 
+	fileBackend, err := NewFileBackend(filepath.Join(c.MkDir(), "kvstore.json"))
+	c.Assert(err, IsNil)
+
+	file, err := NewKVStore("/longhorn", fileBackend)
+	c.Assert(err, IsNil)
+	s.file = file
+
 	// Skip other backends if quick is set
 	if compTest != "true" {
 		return
@@ -71,6 +82,16 @@ func (s *TestSuite) SetUpTest(c *C) {
 
 	err = s.etcd.kvNuclear("nuke key value store")
 	c.Assert(err, IsNil)
+
+	etcd3Backend, err := NewETCD3Backend([]string{"http://" + etcdIP + ":2379"})
+	c.Assert(err, IsNil)
+
+	etcd3, err := NewKVStore("/longhorn", etcd3Backend)
+	c.Assert(err, IsNil)
+	s.etcd3 = etcd3
+
+	err = s.etcd3.kvNuclear("nuke key value store")
+	c.Assert(err, IsNil)
 }
 
 func (s *TestSuite) TeardownTest(c *C) {
@@ -81,14 +102,22 @@ func (s *TestSuite) TeardownTest(c *C) {
 		err := s.etcd.kvNuclear("nuke key value store")
 		c.Assert(err, IsNil)
 	}
+	if s.etcd3 != nil {
+		err := s.etcd3.kvNuclear("nuke key value store")
+		c.Assert(err, IsNil)
+	}
 }
 
 func (s *TestSuite) TestHost(c *C) {
 	s.testHost(c, s.memory)
+	s.testHost(c, s.file)
 
 	if s.etcd != nil {
 		s.testHost(c, s.etcd)
 	}
+	if s.etcd3 != nil {
+		s.testHost(c, s.etcd3)
+	}
 }
 
 func (s *TestSuite) testHost(c *C, st *KVStore) {
@@ -155,10 +184,14 @@ func (s *TestSuite) testHost(c *C, st *KVStore) {
 
 func (s *TestSuite) TestSettings(c *C) {
 	s.testSettings(c, s.memory)
+	s.testSettings(c, s.file)
 
 	if s.etcd != nil {
 		s.testSettings(c, s.etcd)
 	}
+	if s.etcd3 != nil {
+		s.testSettings(c, s.etcd3)
+	}
 }
 
 func (s *TestSuite) testSettings(c *C, st *KVStore) {
@@ -191,7 +224,7 @@ func generateTestVolume(name string) *types.VolumeInfo {
 
 func generateTestController(volName string) *types.ControllerInfo {
 	return &types.ControllerInfo{
-		types.InstanceInfo{
+		InstanceInfo: types.InstanceInfo{
 			ID:         "controller-id-" + volName,
 			Type:       types.InstanceTypeController,
 			Name:       "controller-name-" + volName,
@@ -231,16 +264,26 @@ func (s *TestSuite) verifyVolume(c *C, st *KVStore, volume *types.VolumeInfo) {
 	c.Assert(comp.Controller, DeepEquals, volume.Controller)
 	c.Assert(len(comp.Replicas), Equals, len(volume.Replicas))
 	for key := range comp.Replicas {
-		c.Assert(comp.Replicas[key], DeepEquals, volume.Replicas[key])
+		c.Assert(volume.Replicas[key], NotNil)
+		expected := *volume.Replicas[key]
+		// The revision is unknown after SetVolumeReplica
+		if expected.ResourceVersion == 0 {
+			expected.ResourceVersion = comp.Replicas[key].ResourceVersion
+		}
+		c.Assert(*comp.Replicas[key], DeepEquals, expected)
 	}
 }
 
 func (s *TestSuite) TestVolume(c *C) {
 	s.testVolume(c, s.memory)
+	s.testVolume(c, s.file)
 
 	if s.etcd != nil {
 		s.testVolume(c, s.etcd)
 	}
+	if s.etcd3 != nil {
+		s.testVolume(c, s.etcd3)
+	}
 }
 
 func (s *TestSuite) testVolume(c *C, st *KVStore) {
@@ -355,7 +398,8 @@ func (s *TestSuite) testVolume(c *C, st *KVStore) {
 	volumes, err = st.ListVolumes()
 	c.Assert(err, IsNil)
 	c.Assert(len(volumes), Equals, 1)
-	c.Assert(volumes[0], DeepEquals, volume2)
+	c.Assert(volumes[0].Name, Equals, volume2.Name)
+	s.verifyVolume(c, st, volume2)
 
 	err = st.DeleteVolume(volume2.Name)
 	c.Assert(err, IsNil)
@@ -364,3 +408,806 @@ func (s *TestSuite) testVolume(c *C, st *KVStore) {
 	c.Assert(err, IsNil)
 	c.Assert(len(volumes), Equals, 0)
 }
+
+func (s *TestSuite) TestMigrateETCDv2ToV3(c *C) {
+	if s.etcd == nil || s.etcd3 == nil {
+		c.Skip("etcd is not available")
+	}
+
+	volume := generateTestVolume("volume1")
+	controller := generateTestController(volume.Name)
+	replica := generateTestReplica(volume.Name, "replica1")
+	volume.Controller = controller
+	volume.Replicas = map[string]*types.ReplicaInfo{
+		replica.Name: replica,
+	}
+	host := &types.HostInfo{
+		UUID:    util.UUID(),
+		Name:    "host-1",
+		Address: "127.0.1.1",
+	}
+
+	err := s.etcd.SetVolume(volume)
+	c.Assert(err, IsNil)
+	err = s.etcd.SetHost(host)
+	c.Assert(err, IsNil)
+
+	count, err := MigrateETCDv2ToV3(s.etcd.b.(*ETCDBackend), s.etcd3.b.(*ETCD3Backend), s.etcd.Prefix)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 4)
+
+	// revisions are not carried over
+	migrated, err := s.etcd3.GetVolume(volume.Name)
+	c.Assert(err, IsNil)
+	volume.ResourceVersion = migrated.ResourceVersion
+	replica.ResourceVersion = migrated.Replicas[replica.Name].ResourceVersion
+	s.verifyVolume(c, s.etcd3, volume)
+	h, err := s.etcd3.GetHost(host.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(h, DeepEquals, host)
+
+	_, err = MigrateETCDv2ToV3(s.etcd.b.(*ETCDBackend), s.etcd3.b.(*ETCD3Backend), s.etcd.Prefix)
+	c.Assert(err, ErrorMatches, ".*already been migrated.*")
+
+	// An interrupted migration is resumed, skipping the keys copied
+	err = s.etcd3.b.Delete(s.etcd3.hostKey(host.UUID))
+	c.Assert(err, IsNil)
+	err = s.etcd3.b.Set(s.etcd3.key(keyETCDv3Migration), &ETCDv3Migration{})
+	c.Assert(err, IsNil)
+	count, err = MigrateETCDv2ToV3(s.etcd.b.(*ETCDBackend), s.etcd3.b.(*ETCD3Backend), s.etcd.Prefix)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 4)
+	h, err = s.etcd3.GetHost(host.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(h, DeepEquals, host)
+
+	// Keys written by others are not overwritten
+	err = s.etcd3.b.Set(s.etcd3.key(keyETCDv3Migration), &ETCDv3Migration{})
+	c.Assert(err, IsNil)
+	host.Address = "127.0.1.2"
+	err = s.etcd3.SetHost(host)
+	c.Assert(err, IsNil)
+	_, err = MigrateETCDv2ToV3(s.etcd.b.(*ETCDBackend), s.etcd3.b.(*ETCD3Backend), s.etcd.Prefix)
+	c.Assert(err, ErrorMatches, ".*different value.*")
+
+	// Without the marker, existing keys mean v3 is in use
+	err = s.etcd3.b.Delete(s.etcd3.key(keyETCDv3Migration))
+	c.Assert(err, IsNil)
+	_, err = MigrateETCDv2ToV3(s.etcd.b.(*ETCDBackend), s.etcd3.b.(*ETCD3Backend), s.etcd.Prefix)
+	c.Assert(err, ErrorMatches, ".*refuse to migrate.*")
+
+	// A sibling prefix doesn't count
+	err = s.etcd3.kvNuclear("nuke key value store")
+	c.Assert(err, IsNil)
+	err = s.etcd3.b.Set(s.etcd3.Prefix+"-other/key", "value")
+	c.Assert(err, IsNil)
+	defer s.etcd3.b.Delete(s.etcd3.Prefix + "-other")
+	count, err = MigrateETCDv2ToV3(s.etcd.b.(*ETCDBackend), s.etcd3.b.(*ETCD3Backend), s.etcd.Prefix)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 4)
+}
+
+func (s *TestSuite) TestVolumeConflict(c *C) {
+	s.testVolumeConflict(c, s.memory)
+	s.testVolumeConflict(c, s.file)
+
+	if s.etcd != nil {
+		s.testVolumeConflict(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testVolumeConflict(c, s.etcd3)
+	}
+}
+
+func (s *TestSuite) testVolumeConflict(c *C, st *KVStore) {
+	volume := generateTestVolume("volume1")
+	replica := generateTestReplica(volume.Name, "replica1")
+	volume.Replicas = map[string]*types.ReplicaInfo{
+		replica.Name: replica,
+	}
+
+	err := st.SetVolume(volume)
+	c.Assert(err, IsNil)
+	c.Assert(volume.ResourceVersion, Not(Equals), int64(0))
+
+	// create only if the volume doesn't exist
+	dup := generateTestVolume("volume1")
+	err = st.SetVolumeBase(dup)
+	c.Assert(IsConflictError(err), Equals, true)
+
+	copy1, err := st.GetVolume(volume.Name)
+	c.Assert(err, IsNil)
+	copy2, err := st.GetVolume(volume.Name)
+	c.Assert(err, IsNil)
+	c.Assert(copy1.ResourceVersion, Equals, volume.ResourceVersion)
+
+	copy1.NumberOfReplicas = 3
+	err = st.SetVolumeBase(copy1)
+	c.Assert(err, IsNil)
+
+	copy2.NumberOfReplicas = 1
+	err = st.SetVolumeBase(copy2)
+	c.Assert(IsConflictError(err), Equals, true)
+
+	updated, err := st.GetVolumeBase(volume.Name)
+	c.Assert(err, IsNil)
+	c.Assert(updated.NumberOfReplicas, Equals, 3)
+
+	r1, err := st.GetVolumeReplica(volume.Name, replica.Name)
+	c.Assert(err, IsNil)
+	r2, err := st.GetVolumeReplica(volume.Name, replica.Name)
+	c.Assert(err, IsNil)
+
+	r1.BadTimestamp = util.Now()
+	err = st.UpdateVolumeReplica(r1)
+	c.Assert(err, IsNil)
+
+	r2.Mode = types.ReplicaModeWO
+	err = st.UpdateVolumeReplica(r2)
+	c.Assert(IsConflictError(err), Equals, true)
+
+	r, err := st.GetVolumeReplica(volume.Name, replica.Name)
+	c.Assert(err, IsNil)
+	c.Assert(r, DeepEquals, r1)
+
+	err = st.DeleteVolume(volume.Name)
+	c.Assert(err, IsNil)
+
+	err = st.UpdateVolumeReplica(r1)
+	c.Assert(IsConflictError(err), Equals, true)
+}
+
+func (s *TestSuite) TestWatch(c *C) {
+	s.testWatch(c, s.memory)
+	s.testWatch(c, s.file)
+
+	if s.etcd != nil {
+		s.testWatch(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testWatch(c, s.etcd3)
+	}
+}
+
+func receiveName(c *C, ch <-chan string) string {
+	select {
+	case name, ok := <-ch:
+		c.Assert(ok, Equals, true)
+		return name
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for watch event")
+	}
+	return ""
+}
+
+func (s *TestSuite) testWatch(c *C, st *KVStore) {
+	stopCh := make(chan struct{})
+	volumeCh, err := st.WatchVolumes(stopCh)
+	c.Assert(err, IsNil)
+	hostCh, err := st.WatchHosts(stopCh)
+	c.Assert(err, IsNil)
+	settingsCh, err := st.WatchSettings(stopCh)
+	c.Assert(err, IsNil)
+
+	volume := generateTestVolume("volume1")
+	err = st.SetVolumeBase(volume)
+	c.Assert(err, IsNil)
+	c.Assert(receiveName(c, volumeCh), Equals, volume.Name)
+
+	replica := generateTestReplica(volume.Name, "replica1")
+	err = st.SetVolumeReplica(replica)
+	c.Assert(err, IsNil)
+	c.Assert(receiveName(c, volumeCh), Equals, volume.Name)
+
+	host := &types.HostInfo{
+		UUID:    util.UUID(),
+		Name:    "host-1",
+		Address: "127.0.0.1",
+	}
+	err = st.SetHost(host)
+	c.Assert(err, IsNil)
+	c.Assert(receiveName(c, hostCh), Equals, host.UUID)
+	err = st.UpdateHostHeartbeat(host)
+	c.Assert(err, IsNil)
+	c.Assert(receiveName(c, hostCh), Equals, host.UUID)
+
+	err = st.SetSettings(&types.SettingsInfo{
+		BackupTarget: "nfs://1.2.3.4:/test",
+	})
+	c.Assert(err, IsNil)
+	select {
+	case _, ok := <-settingsCh:
+		c.Assert(ok, Equals, true)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for settings watch event")
+	}
+
+	err = st.DeleteVolume(volume.Name)
+	c.Assert(err, IsNil)
+	// Deleted recursively, may be reported per key
+	c.Assert(receiveName(c, volumeCh), Equals, volume.Name)
+
+	close(stopCh)
+	for _, ch := range []<-chan string{volumeCh, hostCh} {
+		select {
+		case <-ch:
+			// drain the remaining events until the channel is closed
+			for range ch {
+			}
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for watch to stop")
+		}
+	}
+}
+
+func (s *TestSuite) TestMemoryWatchOverflow(c *C) {
+	defer func(size int) {
+		MemoryWatchBufferSize = size
+	}(MemoryWatchBufferSize)
+	MemoryWatchBufferSize = 1
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	volumeCh, err := s.memory.WatchVolumes(stopCh)
+	c.Assert(err, IsNil)
+
+	// Nobody is receiving, so the watch falls behind and is closed rather
+	// than dropping events
+	for i := 0; i < 5; i++ {
+		err = s.memory.SetVolumeBase(generateTestVolume(fmt.Sprintf("volume%v", i)))
+		c.Assert(err, IsNil)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-volumeCh:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.Fatal("timeout waiting for watch to be closed")
+		}
+	}
+}
+
+func (s *TestSuite) TestFileBackendCompact(c *C) {
+	defer func(size int64) {
+		FileCompactMinSize = size
+	}(FileCompactMinSize)
+	FileCompactMinSize = 4096
+
+	path := filepath.Join(c.MkDir(), "kvstore.json")
+	backend, err := NewFileBackend(path)
+	c.Assert(err, IsNil)
+
+	// The log is compacted without restart, keeping the latest value
+	for i := 0; i < 1000; i++ {
+		err = backend.Set("/longhorn/key", fmt.Sprintf("value-%v", i))
+		c.Assert(err, IsNil)
+		info, err := os.Stat(path)
+		c.Assert(err, IsNil)
+		c.Assert(info.Size() <= FileCompactMinSize, Equals, true)
+	}
+	var value string
+	err = backend.Get("/longhorn/key", &value)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "value-999")
+	err = backend.Close()
+	c.Assert(err, IsNil)
+
+	backend, err = NewFileBackend(path)
+	c.Assert(err, IsNil)
+	defer backend.Close()
+	err = backend.Get("/longhorn/key", &value)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "value-999")
+}
+
+func (s *TestSuite) TestFileBackendRestart(c *C) {
+	path := filepath.Join(c.MkDir(), "kvstore.json")
+
+	backend, err := NewFileBackend(path)
+	c.Assert(err, IsNil)
+	st, err := NewKVStore("/longhorn", backend)
+	c.Assert(err, IsNil)
+
+	_, err = NewFileBackend(path)
+	c.Assert(err, ErrorMatches, ".*in use by another process.*")
+
+	volume := generateTestVolume(VolumeName)
+	volume.Controller = generateTestController(VolumeName)
+	replica1 := generateTestReplica(VolumeName, Replica1Name)
+	replica2 := generateTestReplica(VolumeName, Replica2Name)
+	volume.Replicas = map[string]*types.ReplicaInfo{
+		replica1.Name: replica1,
+		replica2.Name: replica2,
+	}
+	err = st.SetVolume(volume)
+	c.Assert(err, IsNil)
+	err = st.DeleteVolumeReplica(VolumeName, Replica2Name)
+	c.Assert(err, IsNil)
+	delete(volume.Replicas, Replica2Name)
+
+	deleted := generateTestVolume(VolumeName + "-deleted")
+	err = st.SetVolume(deleted)
+	c.Assert(err, IsNil)
+	deletedRevision := deleted.ResourceVersion
+	err = st.DeleteVolume(deleted.Name)
+	c.Assert(err, IsNil)
+
+	settings := &types.SettingsInfo{
+		BackupTarget: "nfs://1.2.3.4:/test",
+	}
+	err = st.SetSettings(settings)
+	c.Assert(err, IsNil)
+
+	// Nothing to delete, nothing to log
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	err = st.DeleteVolume(deleted.Name)
+	c.Assert(err, IsNil)
+	after, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(after.Size(), Equals, info.Size())
+
+	err = backend.Close()
+	c.Assert(err, IsNil)
+	err = st.SetSettings(settings)
+	c.Assert(err, NotNil)
+
+	// Simulate a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.WriteString(`{"op":"delete","key":"/longhorn/volu`)
+	c.Assert(err, IsNil)
+	f.Close()
+
+	for i := 0; i < 2; i++ {
+		backend, err = NewFileBackend(path)
+		c.Assert(err, IsNil)
+		st, err = NewKVStore("/longhorn", backend)
+		c.Assert(err, IsNil)
+
+		s.verifyVolume(c, st, volume)
+		v, err := st.GetVolume(deleted.Name)
+		c.Assert(err, IsNil)
+		c.Assert(v, IsNil)
+		ss, err := st.GetSettings()
+		c.Assert(err, IsNil)
+		c.Assert(ss, DeepEquals, settings)
+
+		err = backend.Close()
+		c.Assert(err, IsNil)
+	}
+
+	backend, err = NewFileBackend(path)
+	c.Assert(err, IsNil)
+	st, err = NewKVStore("/longhorn", backend)
+	c.Assert(err, IsNil)
+	defer backend.Close()
+
+	// Revisions are not reused after restart
+	deleted.ResourceVersion = 0
+	err = st.SetVolumeBase(deleted)
+	c.Assert(err, IsNil)
+	c.Assert(deleted.ResourceVersion > deletedRevision, Equals, true)
+}
+
+func (s *TestSuite) TestLock(c *C) {
+	s.testLock(c, s.memory)
+	s.testLock(c, s.file)
+
+	if s.etcd != nil {
+		s.testLock(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testLock(c, s.etcd3)
+	}
+}
+
+func (s *TestSuite) testLock(c *C, st *KVStore) {
+	lock, err := st.TryLock("lock1", "host1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Holder, Equals, "host1")
+
+	// Extend by the same holder
+	_, err = st.TryLock("lock1", "host1", time.Minute)
+	c.Assert(err, IsNil)
+
+	_, err = st.TryLock("lock1", "host2", time.Minute)
+	c.Assert(IsLockedError(err), Equals, true)
+	c.Assert(err.(*LockedError).Holder, Equals, "host1")
+
+	err = st.Unlock("lock1", "host2")
+	c.Assert(err, NotNil)
+	err = st.Unlock("lock1", "host1")
+	c.Assert(err, IsNil)
+
+	_, err = st.TryLock("lock1", "host2", 0)
+	c.Assert(err, IsNil)
+
+	// Expired lock can be taken over
+	lock, err = st.TryLock("lock1", "host1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Holder, Equals, "host1")
+}
+
+func (s *TestSuite) TestLease(c *C) {
+	st := s.memory
+	ttl := 300 * time.Millisecond
+	renew := func() error {
+		_, err := st.TryLock("lock1", "host1", ttl)
+		return err
+	}
+	waitForLost := func(lease *Lease) {
+		select {
+		case <-lease.Lost():
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for lease to be lost")
+		}
+		c.Assert(lease.Err(), ErrorMatches, "lost lock lock1.*")
+		lease.Stop()
+	}
+
+	_, err := st.TryLock("lock1", "host1", ttl)
+	c.Assert(err, IsNil)
+	lease := NewLease("lock1", ttl, renew)
+	time.Sleep(2 * ttl)
+	c.Assert(lease.Err(), IsNil)
+	lease.Stop()
+
+	// Taken by someone else
+	lease = NewLease("lock1", ttl, renew)
+	err = st.Unlock("lock1", "host1")
+	c.Assert(err, IsNil)
+	_, err = st.TryLock("lock1", "host2", time.Minute)
+	c.Assert(err, IsNil)
+	waitForLost(lease)
+
+	// Cannot be renewed before it expires
+	lease = NewLease("lock1", ttl, func() error {
+		return fmt.Errorf("key value store is unavailable")
+	})
+	waitForLost(lease)
+}
+
+func (s *TestSuite) TestMigrate(c *C) {
+	s.testMigrate(c, s.memory)
+	s.testMigrate(c, s.file)
+
+	if s.etcd != nil {
+		s.testMigrate(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testMigrate(c, s.etcd3)
+	}
+}
+
+func (s *TestSuite) testMigrate(c *C, st *KVStore) {
+	type oldSettings struct {
+		Target string `json:"target"`
+	}
+
+	defer func(saved []*Migration) {
+		migrations = saved
+	}(migrations)
+	migrations = []*Migration{
+		{
+			Version: 1,
+			Migrate: func(tx *MigrationTx) error {
+				return tx.Set(tx.Key("old-settings"), &oldSettings{
+					Target: "nfs://1.2.3.4:/test",
+				})
+			},
+		},
+		{
+			Version: 2,
+			Migrate: func(tx *MigrationTx) error {
+				old := &oldSettings{}
+				exists, err := tx.Get(tx.Key("old-settings"), old)
+				if err != nil || !exists {
+					return err
+				}
+				if err := tx.Set(tx.Key(keySettings), &types.SettingsInfo{
+					BackupTarget: old.Target,
+				}); err != nil {
+					return err
+				}
+				return tx.Delete(tx.Key("old-settings"))
+			},
+		},
+	}
+
+	version, err := st.GetSchemaVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, 0)
+
+	changes, err := st.Migrate("host1", true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 5)
+	version, err = st.GetSchemaVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, 0)
+	settings, err := st.GetSettings()
+	c.Assert(err, IsNil)
+	c.Assert(settings, IsNil)
+
+	changes, err = st.Migrate("host1", false)
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 5)
+	version, err = st.GetSchemaVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, 2)
+	settings, err = st.GetSettings()
+	c.Assert(err, IsNil)
+	c.Assert(settings.BackupTarget, Equals, "nfs://1.2.3.4:/test")
+	keys, err := st.b.Keys(st.key(""))
+	c.Assert(err, IsNil)
+	for _, key := range keys {
+		c.Assert(key, Not(Equals), st.key("old-settings"))
+	}
+
+	changes, err = st.Migrate("host1", false)
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 0)
+
+	// Migration lock is held by another manager
+	_, err = st.TryLock(migrationLockName, "host2", time.Minute)
+	c.Assert(err, IsNil)
+	defer func(timeout time.Duration) {
+		MigrationLockTimeout = timeout
+	}(MigrationLockTimeout)
+	MigrationLockTimeout = 0
+	_, err = st.Migrate("host1", false)
+	c.Assert(IsLockedError(err), Equals, true)
+	err = st.Unlock(migrationLockName, "host2")
+	c.Assert(err, IsNil)
+
+	// Written by a newer manager
+	migrations = migrations[:1]
+	_, err = st.Migrate("host1", false)
+	c.Assert(err, ErrorMatches, ".*newer than.*")
+}
+
+func (s *TestSuite) TestExportImport(c *C) {
+	s.testExportImport(c, s.memory)
+	s.testExportImport(c, s.file)
+
+	if s.etcd != nil {
+		s.testExportImport(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testExportImport(c, s.etcd3)
+	}
+}
+
+func (s *TestSuite) testExportImport(c *C, st *KVStore) {
+	_, err := st.Migrate("host1", false)
+	c.Assert(err, IsNil)
+
+	host := &types.HostInfo{
+		UUID:    util.UUID(),
+		Name:    "host-1",
+		Address: "127.0.0.1",
+	}
+	err = st.SetHost(host)
+	c.Assert(err, IsNil)
+	err = st.SetSettings(&types.SettingsInfo{
+		BackupTarget: "nfs://1.2.3.4:/test",
+		EngineImage:  "longhorn-engine",
+	})
+	c.Assert(err, IsNil)
+	volume := generateTestVolume(VolumeName)
+	volume.Controller = generateTestController(VolumeName)
+	replica := generateTestReplica(VolumeName, Replica1Name)
+	volume.Replicas = map[string]*types.ReplicaInfo{
+		replica.Name: replica,
+	}
+	err = st.SetVolume(volume)
+	c.Assert(err, IsNil)
+
+	archive, err := st.Export()
+	c.Assert(err, IsNil)
+	c.Assert(archive.ArchiveVersion, Equals, ArchiveVersion)
+	c.Assert(archive.SchemaVersion, Equals, LatestSchemaVersion())
+	c.Assert(archive.Hosts, HasLen, 1)
+	c.Assert(archive.Volumes, HasLen, 1)
+
+	// Everything is the same
+	result, err := st.Import(archive, false)
+	c.Assert(err, IsNil)
+	c.Assert(result.Imported, HasLen, 0)
+	c.Assert(result.Unchanged, HasLen, 3)
+
+	// Lost everything
+	err = st.kvNuclear("nuke key value store")
+	c.Assert(err, IsNil)
+	_, err = st.Migrate("host1", false)
+	c.Assert(err, IsNil)
+	result, err = st.Import(archive, false)
+	c.Assert(err, IsNil)
+	c.Assert(result.Imported, HasLen, 3)
+	v, err := st.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	volume.ResourceVersion = v.ResourceVersion
+	replica.ResourceVersion = v.Replicas[replica.Name].ResourceVersion
+	s.verifyVolume(c, st, volume)
+	h, err := st.GetHost(host.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(h, DeepEquals, host)
+
+	// Changed after export
+	archive, err = st.Export()
+	c.Assert(err, IsNil)
+	volume, err = st.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	volume.NumberOfReplicas = 5
+	err = st.SetVolumeBase(volume)
+	c.Assert(err, IsNil)
+
+	result, err = st.Import(archive, false)
+	c.Assert(err, NotNil)
+	c.Assert(result.Conflicts, DeepEquals, []string{"volume/" + VolumeName})
+	v, err = st.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(v.NumberOfReplicas, Equals, 5)
+
+	result, err = st.Import(archive, true)
+	c.Assert(err, IsNil)
+	c.Assert(result.Imported, DeepEquals, []string{"volume/" + VolumeName})
+	v, err = st.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(v.NumberOfReplicas, Equals, 2)
+
+	archive.SchemaVersion++
+	_, err = st.Import(archive, true)
+	c.Assert(err, ErrorMatches, ".*schema version.*")
+}
+
+func (s *TestSuite) TestElection(c *C) {
+	s.testElection(c, s.memory)
+	s.testElection(c, s.file)
+
+	if s.etcd != nil {
+		s.testElection(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testElection(c, s.etcd3)
+	}
+}
+
+func receiveLeadership(c *C, ch <-chan bool) bool {
+	select {
+	case leader := <-ch:
+		return leader
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for leadership change")
+	}
+	return false
+}
+
+func (s *TestSuite) testElection(c *C, st *KVStore) {
+	defer func(interval time.Duration) {
+		LeaderRenewInterval = interval
+	}(LeaderRenewInterval)
+	LeaderRenewInterval = 10 * time.Millisecond
+
+	leader, err := st.GetLeader()
+	c.Assert(err, IsNil)
+	c.Assert(leader, Equals, "")
+
+	stopCh1 := make(chan struct{})
+	ch1 := make(chan bool, 10)
+	go st.NewElector("host1").Run(stopCh1, func(leader bool) {
+		ch1 <- leader
+	})
+	c.Assert(receiveLeadership(c, ch1), Equals, true)
+	leader, err = st.GetLeader()
+	c.Assert(err, IsNil)
+	c.Assert(leader, Equals, "host1")
+
+	stopCh2 := make(chan struct{})
+	ch2 := make(chan bool, 10)
+	doneCh2 := make(chan struct{})
+	go func() {
+		st.NewElector("host2").Run(stopCh2, func(leader bool) {
+			ch2 <- leader
+		})
+		close(doneCh2)
+	}()
+	time.Sleep(5 * LeaderRenewInterval)
+	c.Assert(ch2, HasLen, 0)
+
+	close(stopCh1)
+	c.Assert(receiveLeadership(c, ch1), Equals, false)
+	c.Assert(receiveLeadership(c, ch2), Equals, true)
+	leader, err = st.GetLeader()
+	c.Assert(err, IsNil)
+	c.Assert(leader, Equals, "host2")
+
+	close(stopCh2)
+	c.Assert(receiveLeadership(c, ch2), Equals, false)
+	<-doneCh2
+	leader, err = st.GetLeader()
+	c.Assert(err, IsNil)
+	c.Assert(leader, Equals, "")
+}
+
+func (s *TestSuite) TestEvents(c *C) {
+	s.testEvents(c, s.memory)
+	s.testEvents(c, s.file)
+
+	if s.etcd != nil {
+		s.testEvents(c, s.etcd)
+	}
+	if s.etcd3 != nil {
+		s.testEvents(c, s.etcd3)
+	}
+}
+
+func (s *TestSuite) testEvents(c *C, st *KVStore) {
+	events, err := st.ListEvents("", time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 0)
+
+	start := time.Now()
+	reasons := []string{}
+	for i := 0; i < 5; i++ {
+		volume := "vol1"
+		if i%2 == 1 {
+			volume = "vol2"
+		}
+		event := &types.EventInfo{
+			Type:    types.EventTypeNormal,
+			Reason:  fmt.Sprintf("reason%d", i),
+			Volume:  volume,
+			Message: "message",
+		}
+		c.Assert(st.AddEvent(event), IsNil)
+		c.Assert(event.ID, Not(Equals), "")
+		c.Assert(event.Time, Not(Equals), "")
+		reasons = append(reasons, event.Reason)
+	}
+	middle := time.Now()
+	c.Assert(st.AddEvent(&types.EventInfo{Reason: "reason5", Volume: "vol1"}), IsNil)
+	reasons = append(reasons, "reason5")
+
+	events, err = st.ListEvents("", time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 6)
+	for i, event := range events {
+		c.Assert(event.Reason, Equals, reasons[i])
+	}
+
+	events, err = st.ListEvents("vol2", time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Reason, Equals, "reason1")
+	c.Assert(events[1].Reason, Equals, "reason3")
+
+	events, err = st.ListEvents("vol1", middle)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Reason, Equals, "reason5")
+
+	events, err = st.ListEvents("", time.Now().Add(time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 0)
+
+	// Nothing is old enough, keep the latest 4
+	count, err := st.PruneEvents(start, 4)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+	events, err = st.ListEvents("", time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 4)
+	c.Assert(events[0].Reason, Equals, "reason2")
+
+	count, err = st.PruneEvents(middle, 100)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 3)
+	events, err = st.ListEvents("", time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Reason, Equals, "reason5")
+}
@@ -0,0 +1,112 @@
+package kvstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Lease renews a lock in the background after it has been taken, until
+// Stop. If the lock is found taken by someone else, or cannot be renewed
+// before it expires, the lock is lost: Lost() will be closed and Err() tells
+// why. The holder must stop writing what the lock protects then.
+type Lease struct {
+	name  string
+	ttl   time.Duration
+	renew func() error
+
+	mutex  sync.Mutex
+	expire time.Time
+	err    error
+
+	lostCh chan struct{}
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewLease should be called right after the lock is taken for ttl. renew
+// takes the lock again for ttl.
+func NewLease(name string, ttl time.Duration, renew func() error) *Lease {
+	l := &Lease{
+		name:   name,
+		ttl:    ttl,
+		renew:  renew,
+		expire: time.Now().Add(ttl),
+		lostCh: make(chan struct{}),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go l.keepRenewing()
+	return l
+}
+
+func (l *Lease) keepRenewing() {
+	defer close(l.doneCh)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+			start := time.Now()
+			err := l.renew()
+			if err == nil {
+				l.mutex.Lock()
+				l.expire = start.Add(l.ttl)
+				l.mutex.Unlock()
+				continue
+			}
+			if !IsLockedError(err) && time.Now().Before(l.getExpire()) {
+				logrus.Warnf("Fail to renew lock %v, retry before it expires: %v", l.name, err)
+				continue
+			}
+			l.lose(errors.Wrapf(err, "lost lock %v", l.name))
+			return
+		}
+	}
+}
+
+func (l *Lease) getExpire() time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.expire
+}
+
+func (l *Lease) lose(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.err != nil {
+		return
+	}
+	logrus.Errorf("%v", err)
+	l.err = err
+	close(l.lostCh)
+}
+
+// Lost is closed once the lock is lost
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lostCh
+}
+
+// Err returns nil as long as the lock is still held
+func (l *Lease) Err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if !time.Now().Before(l.expire) {
+		return errors.Errorf("lost lock %v, it has expired", l.name)
+	}
+	return nil
+}
+
+// Stop renewing the lock. The lock should be released after Stop, so it
+// won't be renewed after released.
+func (l *Lease) Stop() {
+	close(l.stopCh)
+	<-l.doneCh
+}
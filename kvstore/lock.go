@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	keyLocks = "locks"
+)
+
+// LockInfo is a lease on name. It's free if Holder is empty or it has
+// expired, so a crashed holder won't hold it forever.
+type LockInfo struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder"`
+	Expire string `json:"expire"`
+
+	ResourceVersion int64 `json:"-"`
+}
+
+func (l *LockInfo) expired(now time.Time) bool {
+	if l.Holder == "" {
+		return true
+	}
+	expire, err := util.ParseTime(l.Expire)
+	if err != nil {
+		// Don't let a corrupted lock block everyone
+		return true
+	}
+	return !now.Before(expire)
+}
+
+func (s *KVStore) lockKey(name string) string {
+	return filepath.Join(s.key(keyLocks), name)
+}
+
+func (s *KVStore) getLock(name string) (*LockInfo, error) {
+	lock := &LockInfo{}
+	revision, err := s.b.GetWithRevision(s.lockKey(name), lock)
+	if err != nil {
+		if s.b.IsNotFoundError(err) {
+			return &LockInfo{Name: name}, nil
+		}
+		return nil, errors.Wrapf(err, "unable to get lock %v", name)
+	}
+	lock.ResourceVersion = revision
+	return lock, nil
+}
+
+// TryLock takes the lock for holder for ttl, or extends it if holder has
+// it already. It fails with LockedError if someone else holds the lock.
+func (s *KVStore) TryLock(name, holder string, ttl time.Duration) (*LockInfo, error) {
+	lock, err := s.getLock(name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if lock.Holder != holder && !lock.expired(now) {
+		return nil, NewLockedError(lock)
+	}
+	lock.Holder = holder
+	lock.Expire = now.Add(ttl).Format(time.RFC3339)
+	revision, err := s.b.CompareAndSet(s.lockKey(name), lock, lock.ResourceVersion)
+	if err != nil {
+		if IsConflictError(err) {
+			// Someone else just took it
+			if current, err := s.getLock(name); err == nil && current.Holder != holder {
+				return nil, NewLockedError(current)
+			}
+		}
+		return nil, errors.Wrapf(err, "unable to take lock %v", name)
+	}
+	lock.ResourceVersion = revision
+	return lock, nil
+}
+
+// Unlock releases the lock if it's still held by holder
+func (s *KVStore) Unlock(name, holder string) error {
+	lock, err := s.getLock(name)
+	if err != nil {
+		return err
+	}
+	if lock.Holder != holder {
+		return errors.Errorf("unable to unlock %v, it's held by %v rather than %v",
+			name, lock.Holder, holder)
+	}
+	// Release by marking the lock free rather than deleting it, so it
+	// won't race with someone taking over an expired lock
+	lock.Holder = ""
+	lock.Expire = ""
+	if _, err := s.b.CompareAndSet(s.lockKey(name), lock, lock.ResourceVersion); err != nil {
+		return errors.Wrapf(err, "unable to unlock %v", name)
+	}
+	return nil
+}
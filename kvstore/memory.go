@@ -2,9 +2,10 @@ package kvstore
 
 import (
 	"encoding/json"
-	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
 	"github.com/patrickmn/go-cache"
@@ -14,16 +15,33 @@ var (
 	MemoryKeyNotFoundError = errors.Errorf("key not found")
 
 	Separator = "/"
+
+	MemoryWatchBufferSize = 1024
 )
 
 type MemoryBackend struct {
-	c *cache.Cache
+	sync.Mutex
+
+	c        *cache.Cache
+	revision int64
+	watchers map[*memoryWatcher]struct{}
+}
+
+type memoryWatcher struct {
+	prefix string
+	in     chan *WatchEvent
+}
+
+type memoryEntry struct {
+	value    string
+	revision int64
 }
 
 func NewMemoryBackend() (*MemoryBackend, error) {
 	c := cache.New(cache.NoExpiration, cache.NoExpiration)
 	return &MemoryBackend{
-		c: c,
+		c:        c,
+		watchers: map[*memoryWatcher]struct{}{},
 	}, nil
 }
 
@@ -32,70 +50,122 @@ func (m *MemoryBackend) Set(key string, obj interface{}) error {
 	if err != nil {
 		return err
 	}
-	m.c.SetDefault(key, string(value))
+
+	m.Lock()
+	defer m.Unlock()
+	m.set(key, string(value))
 	return nil
 }
 
-func (m *MemoryBackend) Get(key string, obj interface{}) error {
-	value, exists := m.c.Get(key)
-	if !exists {
-		return MemoryKeyNotFoundError
+// set must be called with lock held, it returns the new revision of key
+func (m *MemoryBackend) set(key, value string) int64 {
+	m.revision++
+	m.c.SetDefault(key, &memoryEntry{
+		value:    value,
+		revision: m.revision,
+	})
+	m.notify(WatchEventTypeSet, key)
+	return m.revision
+}
+
+// checkRevision must be called with lock held
+func (m *MemoryBackend) checkRevision(key string, revision int64) error {
+	current := int64(0)
+	if entry, exists := m.c.Get(key); exists {
+		current = entry.(*memoryEntry).revision
 	}
-	if err := json.Unmarshal([]byte(value.(string)), obj); err != nil {
-		return errors.Wrap(err, "fail to unmarshal json")
+	if current != revision {
+		return NewConflictError(key, revision)
 	}
 	return nil
 }
 
-func (m *MemoryBackend) Delete(key string) error {
-	keys, err := m.Keys(key)
+func (m *MemoryBackend) CompareAndSet(key string, obj interface{}, revision int64) (int64, error) {
+	value, err := json.Marshal(obj)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if keys == nil {
-		return nil
+
+	m.Lock()
+	defer m.Unlock()
+	if err := m.checkRevision(key, revision); err != nil {
+		return 0, err
 	}
+	return m.set(key, string(value)), nil
+}
+
+func (m *MemoryBackend) Get(key string, obj interface{}) error {
+	_, err := m.GetWithRevision(key, obj)
+	return err
+}
 
-	for _, key := range keys {
-		m.c.Delete(key)
+func (m *MemoryBackend) GetWithRevision(key string, obj interface{}) (int64, error) {
+	value, exists := m.c.Get(key)
+	if !exists {
+		return 0, MemoryKeyNotFoundError
 	}
+	entry := value.(*memoryEntry)
+	if err := json.Unmarshal([]byte(entry.value), obj); err != nil {
+		return 0, errors.Wrap(err, "fail to unmarshal json")
+	}
+	return entry.revision, nil
+}
+
+func (m *MemoryBackend) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.delete(key)
 	return nil
 }
 
+// matchKeys must be called with lock held, it returns key and everything
+// under it
+func (m *MemoryBackend) matchKeys(key string) []string {
+	keys := []string{}
+	dir := dirPrefix(key)
+	for k := range m.c.Items() {
+		if k == key || strings.HasPrefix(k, dir) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// delete must be called with lock held. Deletion takes a revision as well,
+// so the revision of a recreated key won't match the one before deletion.
+func (m *MemoryBackend) delete(key string) {
+	keys := m.matchKeys(key)
+	if len(keys) == 0 {
+		return
+	}
+	m.revision++
+	for _, k := range keys {
+		m.c.Delete(k)
+		m.notify(WatchEventTypeDelete, k)
+	}
+}
+
 func (m *MemoryBackend) Keys(prefix string) ([]string, error) {
 	keys := []string{}
+	seen := map[string]struct{}{}
 
+	dir := dirPrefix(prefix)
 	items := m.c.Items()
 	for key := range items {
-		exists := false
-		for _, k := range keys {
-			if strings.HasPrefix(key, k) {
-				exists = true
-				break
-
-			}
-		}
-		if exists {
+		if key == prefix {
+			keys = append(keys, key)
 			continue
 		}
-
-		if !strings.HasPrefix(key, prefix) {
+		if !strings.HasPrefix(key, dir) {
 			continue
 		}
 
-		if key == prefix {
-			keys = append(keys, key)
+		child := strings.SplitN(strings.TrimPrefix(key, dir), Separator, 2)[0]
+		k := dir + child
+		if _, exists := seen[k]; exists {
 			continue
 		}
-
-		k := ""
-		key = strings.TrimLeft(key, "/")
-		prefixLevel := strings.Count(prefix, Separator)
-		entries := strings.Split(key, Separator)
-		for i := 0; i < prefixLevel+1; i++ {
-			k = filepath.Join(k, entries[i])
-		}
-		k = "/" + k
+		seen[k] = struct{}{}
 		keys = append(keys, k)
 	}
 	if len(keys) == 0 {
@@ -104,6 +174,74 @@ func (m *MemoryBackend) Keys(prefix string) ([]string, error) {
 	return keys, nil
 }
 
+func (m *MemoryBackend) List(prefix string) (map[string][]byte, error) {
+	ret := map[string][]byte{}
+	dir := dirPrefix(prefix)
+	for key, item := range m.c.Items() {
+		if !strings.HasPrefix(key, dir) || strings.Contains(strings.TrimPrefix(key, dir), Separator) {
+			continue
+		}
+		ret[key] = []byte(item.Object.(*memoryEntry).value)
+	}
+	return ret, nil
+}
+
 func (m *MemoryBackend) IsNotFoundError(err error) bool {
 	return err == MemoryKeyNotFoundError
 }
+
+func (m *MemoryBackend) Watch(prefix string, stopCh <-chan struct{}) (<-chan *WatchEvent, error) {
+	w := &memoryWatcher{
+		prefix: prefix,
+		in:     make(chan *WatchEvent, MemoryWatchBufferSize),
+	}
+	m.Lock()
+	m.watchers[w] = struct{}{}
+	m.Unlock()
+
+	ch := make(chan *WatchEvent)
+	go func() {
+		defer close(ch)
+		defer func() {
+			m.Lock()
+			delete(m.watchers, w)
+			m.Unlock()
+		}()
+		for {
+			select {
+			case e, ok := <-w.in:
+				if !ok {
+					// Fell behind, the caller needs to watch again
+					return
+				}
+				select {
+				case ch <- e:
+				case <-stopCh:
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// notify must be called with lock held, so events are queued in the order
+// of the changes. A watcher which is too slow to keep up is closed rather
+// than missing events.
+func (m *MemoryBackend) notify(eventType WatchEventType, key string) {
+	for w := range m.watchers {
+		if key != w.prefix && !strings.HasPrefix(key, dirPrefix(w.prefix)) {
+			continue
+		}
+		select {
+		case w.in <- &WatchEvent{Type: eventType, Key: key}:
+		default:
+			logrus.Errorf("Memory watcher of %v is full, close the watch at %v event of %v",
+				w.prefix, eventType, key)
+			delete(m.watchers, w)
+			close(w.in)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	keySchemaVersion = "schema-version"
+
+	migrationLockName = "schema-migration"
+)
+
+var (
+	MigrationLockTTL           = 10 * time.Minute
+	MigrationLockTimeout       = 15 * time.Minute
+	MigrationLockRetryInterval = 2 * time.Second
+)
+
+type SchemaVersion struct {
+	Version int `json:"version"`
+}
+
+// Migration upgrades the key value store from Version-1 to Version. It may
+// be interrupted and run again, so it must be idempotent.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(tx *MigrationTx) error
+}
+
+// migrations must be ordered by Version, starting from 1 without gaps. The
+// schema version of the key value store is the Version of the last
+// migration applied, or 0 for the layout before versioning.
+var migrations = []*Migration{
+	{
+		Version: 1,
+		Description: "start versioning the existing layout: " +
+			"volumes/<name>/base, volumes/<name>/instances/controller, " +
+			"volumes/<name>/instances/replicas/<name>, hosts/<uuid>, settings, " +
+			"locks/<name>",
+		Migrate: func(tx *MigrationTx) error {
+			return nil
+		},
+	},
+}
+
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func validateMigrations() error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return errors.Errorf("invalid migration registry: expect version %v at %v, got %v",
+				i+1, i, m.Version)
+		}
+	}
+	return nil
+}
+
+func (s *KVStore) schemaVersionKey() string {
+	return s.key(keySchemaVersion)
+}
+
+// GetSchemaVersion returns 0 if the schema version has never been set
+func (s *KVStore) GetSchemaVersion() (int, error) {
+	version := &SchemaVersion{}
+	if err := s.b.Get(s.schemaVersionKey(), version); err != nil {
+		if s.b.IsNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "unable to get schema version")
+	}
+	return version.Version, nil
+}
+
+// Migrate brings the key value store to the latest schema version, while
+// holding the cluster wide migration lock for holder. With dryRun, nothing
+// will be written. It returns the changes made, or planned for dryRun.
+func (s *KVStore) Migrate(holder string, dryRun bool) ([]string, error) {
+	if err := validateMigrations(); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return s.migrate(nil)
+	}
+
+	if err := s.waitForLock(migrationLockName, holder, MigrationLockTTL, MigrationLockTimeout); err != nil {
+		return nil, errors.Wrap(err, "unable to migrate key value store")
+	}
+	// A slow migration may take longer than the TTL
+	lease := NewLease(migrationLockName, MigrationLockTTL, func() error {
+		_, err := s.TryLock(migrationLockName, holder, MigrationLockTTL)
+		return err
+	})
+	defer func() {
+		lease.Stop()
+		if lease.Err() != nil {
+			return
+		}
+		if err := s.Unlock(migrationLockName, holder); err != nil {
+			logrus.Errorf("Fail to release migration lock: %v", err)
+		}
+	}()
+	return s.migrate(lease)
+}
+
+func (s *KVStore) waitForLock(name, holder string, ttl, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := s.TryLock(name, holder, ttl)
+		if err == nil {
+			return nil
+		}
+		if !IsLockedError(err) && !IsConflictError(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "timeout waiting for lock %v", name)
+		}
+		logrus.Infof("Waiting for lock: %v", err)
+		time.Sleep(MigrationLockRetryInterval)
+	}
+}
+
+// migrate is a dry run without lease. Otherwise it stops writing once the
+// migration lock is lost.
+func (s *KVStore) migrate(lease *Lease) ([]string, error) {
+	current, err := s.GetSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	latest := LatestSchemaVersion()
+	if current > latest {
+		return nil, errors.Errorf("schema version %v of key value store is newer than %v supported, refuse to continue",
+			current, latest)
+	}
+
+	tx := newMigrationTx(s, lease)
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		logrus.Infof("Migrating key value store to schema version %v: %v", m.Version, m.Description)
+		if err := m.Migrate(tx); err != nil {
+			return tx.Changes, errors.Wrapf(err, "fail to migrate key value store to schema version %v", m.Version)
+		}
+		if err := tx.Set(s.schemaVersionKey(), &SchemaVersion{Version: m.Version}); err != nil {
+			return tx.Changes, errors.Wrapf(err, "fail to update schema version to %v", m.Version)
+		}
+	}
+	return tx.Changes, nil
+}
+
+// MigrationTx is what migrations use to access the key value store. In dry
+// run mode, changes are kept in memory, so later migrations would see the
+// changes planned by the earlier ones.
+type MigrationTx struct {
+	Changes []string
+
+	s       *KVStore
+	dryRun  bool
+	lease   *Lease
+	pending map[string]string
+	deleted []string
+}
+
+func newMigrationTx(s *KVStore, lease *Lease) *MigrationTx {
+	return &MigrationTx{
+		Changes: []string{},
+
+		s:       s,
+		dryRun:  lease == nil,
+		lease:   lease,
+		pending: map[string]string{},
+		deleted: []string{},
+	}
+}
+
+// Key returns the full key of parts under the prefix of the key value store
+func (tx *MigrationTx) Key(parts ...string) string {
+	return tx.s.key(strings.Join(parts, Separator))
+}
+
+func (tx *MigrationTx) isDeleted(key string) bool {
+	for _, d := range tx.deleted {
+		if key == d || strings.HasPrefix(key, dirPrefix(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns false if the key doesn't exist
+func (tx *MigrationTx) Get(key string, obj interface{}) (bool, error) {
+	if value, ok := tx.pending[key]; ok {
+		if err := json.Unmarshal([]byte(value), obj); err != nil {
+			return false, errors.Wrap(err, "fail to unmarshal json")
+		}
+		return true, nil
+	}
+	if tx.isDeleted(key) {
+		return false, nil
+	}
+	if err := tx.s.b.Get(key, obj); err != nil {
+		if tx.s.b.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (tx *MigrationTx) Keys(prefix string) ([]string, error) {
+	keys, err := tx.s.b.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]struct{}{}
+	ret := []string{}
+	for _, key := range keys {
+		if tx.isDeleted(key) {
+			continue
+		}
+		seen[key] = struct{}{}
+		ret = append(ret, key)
+	}
+	dir := dirPrefix(prefix)
+	for key := range tx.pending {
+		if !strings.HasPrefix(key, dir) {
+			continue
+		}
+		k := dir + strings.SplitN(strings.TrimPrefix(key, dir), Separator, 2)[0]
+		if _, exists := seen[k]; exists {
+			continue
+		}
+		seen[k] = struct{}{}
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (tx *MigrationTx) Set(key string, obj interface{}) error {
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if !tx.dryRun {
+		if err := tx.lease.Err(); err != nil {
+			return err
+		}
+	}
+	tx.Changes = append(tx.Changes, fmt.Sprintf("set %v: %v", key, string(value)))
+	if tx.dryRun {
+		tx.pending[key] = string(value)
+		return nil
+	}
+	return tx.s.b.Set(key, obj)
+}
+
+// Delete is recursive, the same as Backend.Delete()
+func (tx *MigrationTx) Delete(key string) error {
+	if !tx.dryRun {
+		if err := tx.lease.Err(); err != nil {
+			return err
+		}
+	}
+	tx.Changes = append(tx.Changes, fmt.Sprintf("delete %v", key))
+	if tx.dryRun {
+		for k := range tx.pending {
+			if k == key || strings.HasPrefix(k, dirPrefix(key)) {
+				delete(tx.pending, k)
+			}
+		}
+		tx.deleted = append(tx.deleted, key)
+		return nil
+	}
+	return tx.s.b.Delete(key)
+}
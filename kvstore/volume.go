@@ -62,12 +62,20 @@ func (k *VolumeKey) Replica(replicaName string) string {
 	return filepath.Join(k.Replicas(), replicaName)
 }
 
+// SetVolumeBase writes the volume base only if it's still at
+// volume.ResourceVersion, or doesn't exist yet if ResourceVersion is 0.
+// volume.ResourceVersion will be updated after the write.
 func (s *KVStore) SetVolumeBase(volume *types.VolumeInfo) error {
 	// copy the content of volume
 	volumeBase := *volume
 	volumeBase.Controller = nil
 	volumeBase.Replicas = nil
-	return s.b.Set(s.NewVolumeKeyFromName(volume.Name).Base(), &volumeBase)
+	revision, err := s.b.CompareAndSet(s.NewVolumeKeyFromName(volume.Name).Base(), &volumeBase, volume.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	volume.ResourceVersion = revision
+	return nil
 }
 
 func (s *KVStore) SetVolumeController(controller *types.ControllerInfo) error {
@@ -86,11 +94,33 @@ func (s *KVStore) SetVolumeReplicas(replicas map[string]*types.ReplicaInfo) erro
 	return nil
 }
 
+// SetVolumeReplica overwrites the replica regardless of its current
+// revision. The new revision is unknown, so replica.ResourceVersion will be
+// reset, and the replica needs to be read again before UpdateVolumeReplica.
 func (s *KVStore) SetVolumeReplica(replica *types.ReplicaInfo) error {
 	if replica.VolumeName == "" {
 		return errors.Errorf("replica doesn't have valid volume name: %+v", replica)
 	}
-	return s.b.Set(s.NewVolumeKeyFromName(replica.VolumeName).Replica(replica.Name), replica)
+	if err := s.b.Set(s.NewVolumeKeyFromName(replica.VolumeName).Replica(replica.Name), replica); err != nil {
+		return err
+	}
+	replica.ResourceVersion = 0
+	return nil
+}
+
+// UpdateVolumeReplica writes the replica only if it's still at
+// replica.ResourceVersion, or doesn't exist yet if ResourceVersion is 0.
+// replica.ResourceVersion will be updated after the write.
+func (s *KVStore) UpdateVolumeReplica(replica *types.ReplicaInfo) error {
+	if replica.VolumeName == "" {
+		return errors.Errorf("replica doesn't have valid volume name: %+v", replica)
+	}
+	revision, err := s.b.CompareAndSet(s.NewVolumeKeyFromName(replica.VolumeName).Replica(replica.Name), replica, replica.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	replica.ResourceVersion = revision
+	return nil
 }
 
 func (s *KVStore) GetVolumeBase(id string) (*types.VolumeInfo, error) {
@@ -103,7 +133,8 @@ func (s *KVStore) GetVolumeBase(id string) (*types.VolumeInfo, error) {
 
 func (s *KVStore) getVolumeBaseByKey(key string) (*types.VolumeInfo, error) {
 	volume := types.VolumeInfo{}
-	if err := s.b.Get(key, &volume); err != nil {
+	revision, err := s.b.GetWithRevision(key, &volume)
+	if err != nil {
 		if s.b.IsNotFoundError(err) {
 			return nil, nil
 		}
@@ -112,6 +143,7 @@ func (s *KVStore) getVolumeBaseByKey(key string) (*types.VolumeInfo, error) {
 	if volume.Controller != nil || volume.Replicas != nil {
 		return nil, errors.Errorf("BUG: volume base shouldn't have instances info: %+v", volume)
 	}
+	volume.ResourceVersion = revision
 	return &volume, nil
 }
 
@@ -144,12 +176,14 @@ func (s *KVStore) GetVolumeReplica(volumeName, replicaName string) (*types.Repli
 
 func (s *KVStore) getVolumeReplicaByKey(key string) (*types.ReplicaInfo, error) {
 	replica := types.ReplicaInfo{}
-	if err := s.b.Get(key, &replica); err != nil {
+	revision, err := s.b.GetWithRevision(key, &replica)
+	if err != nil {
 		if s.b.IsNotFoundError(err) {
 			return nil, nil
 		}
 		return nil, err
 	}
+	replica.ResourceVersion = revision
 	return &replica, nil
 }
 
@@ -201,6 +235,10 @@ func (s *KVStore) DeleteVolumeReplica(volumeName, replicaName string) error {
 	return nil
 }
 
+// SetVolume writes the volume base with revision check (see SetVolumeBase),
+// then brings the instances in line with the volume. Instances are
+// overwritten in place rather than removed and recreated, so readers never
+// see a volume without its replicas.
 func (s *KVStore) SetVolume(volume *types.VolumeInfo) (err error) {
 	defer func() {
 		if err != nil {
@@ -212,18 +250,27 @@ func (s *KVStore) SetVolume(volume *types.VolumeInfo) (err error) {
 		return err
 	}
 
-	if err := s.DeleteVolumeController(volume.Name); err != nil {
-		return err
-	}
 	if volume.Controller != nil {
 		if err := s.SetVolumeController(volume.Controller); err != nil {
 			return err
 		}
+	} else {
+		if err := s.DeleteVolumeController(volume.Name); err != nil {
+			return err
+		}
 	}
 
-	if err := s.DeleteVolumeReplicas(volume.Name); err != nil {
+	existing, err := s.GetVolumeReplicas(volume.Name)
+	if err != nil {
 		return err
 	}
+	for name := range existing {
+		if _, ok := volume.Replicas[name]; !ok {
+			if err := s.DeleteVolumeReplica(volume.Name, name); err != nil {
+				return err
+			}
+		}
+	}
 	if volume.Replicas != nil {
 		if err := s.SetVolumeReplicas(volume.Replicas); err != nil {
 			return err
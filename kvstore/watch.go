@@ -0,0 +1,88 @@
+package kvstore
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type WatchEventType string
+
+const (
+	WatchEventTypeSet    = WatchEventType("set")
+	WatchEventTypeDelete = WatchEventType("delete")
+)
+
+// WatchEvent reports a change of Key. A recursive delete may be reported
+// once for the top level key only.
+type WatchEvent struct {
+	Type WatchEventType
+	Key  string
+}
+
+// watchChild returns the first level entry under dir that key belongs to,
+// e.g. volume name for keys under volumes
+func watchChild(dir, key string) string {
+	if !strings.HasPrefix(key, dirPrefix(dir)) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(key, dirPrefix(dir)), Separator, 2)[0]
+}
+
+func (s *KVStore) watchChildren(dir string, stopCh <-chan struct{}) (<-chan string, error) {
+	events, err := s.b.Watch(dir, stopCh)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for e := range events {
+			child := watchChild(dir, e.Key)
+			if child == "" {
+				logrus.Debugf("Ignore watch event %v on %v", e.Type, e.Key)
+				continue
+			}
+			select {
+			case ch <- child:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// WatchVolumes reports the names of volumes being changed, until stopCh is
+// closed. The channel will be closed if the watch fails.
+func (s *KVStore) WatchVolumes(stopCh <-chan struct{}) (<-chan string, error) {
+	return s.watchChildren(s.key(keyVolumes), stopCh)
+}
+
+// WatchHosts reports the UUIDs of hosts being changed, e.g. on every
+// heartbeat, until stopCh is closed. The channel will be closed if the watch
+// fails.
+func (s *KVStore) WatchHosts(stopCh <-chan struct{}) (<-chan string, error) {
+	return s.watchChildren(s.key(keyHosts), stopCh)
+}
+
+// WatchSettings reports every change of settings, until stopCh is closed.
+// The channel will be closed if the watch fails.
+func (s *KVStore) WatchSettings(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	events, err := s.b.Watch(s.settingsKey(), stopCh)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for range events {
+			select {
+			case ch <- struct{}{}:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
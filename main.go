@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -10,6 +13,7 @@ import (
 	"github.com/rancher/longhorn-manager/api"
 	"github.com/rancher/longhorn-manager/backups"
 	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/kvstore"
 	"github.com/rancher/longhorn-manager/manager"
 	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/orch/docker"
@@ -32,7 +36,7 @@ func main() {
 	app.Usage = "Rancher Longhorn storage driver/orchestration"
 	app.Action = RunManager
 
-	app.Flags = []cli.Flag{
+	app.Flags = append([]cli.Flag{
 		cli.BoolFlag{
 			Name:   "debug, d",
 			Usage:  "enable debug logging level",
@@ -51,18 +55,82 @@ func main() {
 		},
 
 		// Docker
+		cli.BoolFlag{
+			Name:  "kv-migrate-dry-run",
+			Usage: "print the changes needed to migrate the key value store to the current schema, then exit",
+		},
+		cli.StringFlag{
+			Name:  "docker-network",
+			Usage: "use specified docker network, can be omitted for auto detection",
+		},
 		cli.StringSliceFlag{
-			Name:  "etcd-servers",
-			Usage: "etcd server ip and port, in format `http://etcd1:2379,http://etcd2:2379`",
+			Name:  "host-tags",
+			Usage: "tags of the current host to be matched by the host selectors of the volumes, e.g. `ssd,rack=a`",
 		},
 		cli.StringFlag{
-			Name:  "etcd-prefix",
-			Usage: "the prefix using with etcd server",
-			Value: "/longhorn",
+			Name:  "host-zone",
+			Usage: "zone of the current host, overrides the zone in /var/lib/rancher/longhorn/.host_labels",
 		},
 		cli.StringFlag{
-			Name:  "docker-network",
-			Usage: "use specified docker network, can be omitted for auto detection",
+			Name:  "host-region",
+			Usage: "region of the current host, overrides the region in /var/lib/rancher/longhorn/.host_labels",
+		},
+		cli.StringSliceFlag{
+			Name:  "disk",
+			Usage: "directory to store the replicas, repeated for each disk. It must be mounted at the same path in the manager container. Default /var/lib/rancher/longhorn/replicas",
+		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Usage: "how long to wait for the requests and operations in progress on shutdown",
+			Value: time.Minute,
+		},
+	}, kvFlags()...)
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "migrate-etcd-v3",
+			Usage: "copy the existing etcd v2 tree into etcd v3 before switching to --etcd-version v3, run it again to resume if interrupted",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "etcd-servers",
+					Usage: "etcd server ip and port, in format `http://etcd1:2379,http://etcd2:2379`",
+				},
+				cli.StringFlag{
+					Name:  "etcd-prefix",
+					Usage: "the prefix using with etcd server",
+					Value: "/longhorn",
+				},
+			},
+			Action: MigrateETCDv3,
+		},
+		{
+			Name:  "kv",
+			Usage: "back up or restore the metadata in the key value store",
+			Subcommands: []cli.Command{
+				{
+					Name:  "export",
+					Usage: "dump hosts, settings and volumes into a JSON archive",
+					Flags: append(kvFlags(),
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "write the archive to the file instead of stdout",
+						},
+					),
+					Action: ExportKV,
+				},
+				{
+					Name:      "import",
+					Usage:     "restore a JSON archive made by export",
+					ArgsUsage: "<archive file, or - for stdin>",
+					Flags: append(kvFlags(),
+						cli.BoolFlag{
+							Name:  "overwrite",
+							Usage: "overwrite the conflicting entries rather than abort",
+						},
+					),
+					Action: ImportKV,
+				},
+			},
 		},
 	}
 
@@ -72,6 +140,36 @@ func main() {
 
 }
 
+// kvFlags specify the key value store for the docker orchestrator
+func kvFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "kv-backend",
+			Usage: "key value store backend: etcd, or file for a single node without etcd",
+			Value: "etcd",
+		},
+		cli.StringFlag{
+			Name:  "kv-path",
+			Usage: "path of the data file for file kv backend",
+			Value: "/var/lib/rancher/longhorn/kvstore.json",
+		},
+		cli.StringSliceFlag{
+			Name:  "etcd-servers",
+			Usage: "etcd server ip and port, in format `http://etcd1:2379,http://etcd2:2379`",
+		},
+		cli.StringFlag{
+			Name:  "etcd-version",
+			Usage: "etcd API version to use: v2 or v3",
+			Value: "v2",
+		},
+		cli.StringFlag{
+			Name:  "etcd-prefix",
+			Usage: "the prefix using with etcd server",
+			Value: "/longhorn",
+		},
+	}
+}
+
 func RunManager(c *cli.Context) error {
 	var (
 		orc types.Orchestrator
@@ -86,9 +184,24 @@ func RunManager(c *cli.Context) error {
 		return fmt.Errorf("Must specify %v", orch.EngineImageParam)
 	}
 
+	if c.Bool("kv-migrate-dry-run") {
+		// Before the orchestrator registers the host, so nothing is written
+		kv, err := docker.NewKVStore(c)
+		if err != nil {
+			return err
+		}
+		changes, err := kv.Migrate("", true)
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		return err
+	}
+
 	orcName := c.String("orchestrator")
 	if orcName == "docker" {
 		orc, err = docker.New(c)
+		manager.HostDownTimeout = docker.HostDownTimeout
+		manager.FenceWindow = docker.HostDownTimeout + docker.SelfFenceTimeout + docker.FenceMargin
 	} else {
 		err = fmt.Errorf("Invalid orchestrator %v", orcName)
 	}
@@ -96,7 +209,7 @@ func RunManager(c *cli.Context) error {
 		return err
 	}
 
-	man := manager.New(orc, manager.Monitor(controller.Get), controller.Get, backups.New)
+	man := manager.New(orc, manager.Monitor(controller.Get), controller.Get, backups.New, controller.GetReplicaStatus, controller.ConfirmStopped)
 	if err := man.Start(); err != nil {
 		return err
 	}
@@ -105,8 +218,115 @@ func RunManager(c *cli.Context) error {
 
 	s := api.NewServer(man, orc, proxy)
 
-	go server.NewUnixServer(sockFile).Serve(api.Handler(s))
-	go server.NewTCPServer(fmt.Sprintf(":%v", api.DefaultPort)).Serve(api.Handler(s))
+	unixServer := server.NewUnixServer(sockFile)
+	tcpServer := server.NewTCPServer(fmt.Sprintf(":%v", api.DefaultPort))
+	go unixServer.Serve(api.Handler(s))
+	go tcpServer.Serve(api.Handler(s))
 
-	return daemon.WaitForExit()
+	if err := daemon.WaitForExit(); err != nil {
+		return err
+	}
+
+	// The servers and the manager share the timeout
+	deadline := time.Now().Add(c.Duration("shutdown-timeout"))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := unixServer.Shutdown(ctx); err != nil {
+		logrus.Warnf("failed to shut down unix socket server: %v", err)
+	}
+	if err := tcpServer.Shutdown(ctx); err != nil {
+		logrus.Warnf("failed to shut down TCP server: %v", err)
+	}
+	return man.Shutdown(time.Until(deadline))
+}
+
+func MigrateETCDv3(c *cli.Context) error {
+	servers := c.StringSlice("etcd-servers")
+	if len(servers) == 0 {
+		return fmt.Errorf("Unspecified etcd servers")
+	}
+	prefix := c.String("etcd-prefix")
+
+	src, err := kvstore.NewETCDBackend(servers)
+	if err != nil {
+		return err
+	}
+	dst, err := kvstore.NewETCD3Backend(servers)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	count, err := kvstore.MigrateETCDv2ToV3(src, dst, prefix)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Migrated %v keys under %v from etcd v2 to v3", count, prefix)
+	return nil
+}
+
+func ExportKV(c *cli.Context) error {
+	kv, err := docker.NewKVStore(c)
+	if err != nil {
+		return err
+	}
+	archive, err := kv.Export()
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if output := c.String("output"); output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(archive); err != nil {
+		return err
+	}
+	logrus.Infof("Exported %v hosts and %v volumes", len(archive.Hosts), len(archive.Volumes))
+	return nil
+}
+
+func ImportKV(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("Must specify the archive file")
+	}
+	in := os.Stdin
+	if file := c.Args().First(); file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	archive := &types.KVArchive{}
+	if err := json.NewDecoder(in).Decode(archive); err != nil {
+		return fmt.Errorf("Invalid archive: %v", err)
+	}
+
+	kv, err := docker.NewKVStore(c)
+	if err != nil {
+		return err
+	}
+	// A new key value store needs to be at the current schema first
+	if _, err := kv.Migrate("kv-import", false); err != nil {
+		return err
+	}
+	result, err := kv.Import(archive, c.Bool("overwrite"))
+	if result != nil {
+		for _, id := range result.Conflicts {
+			fmt.Println("conflict:", id)
+		}
+		for _, id := range result.Imported {
+			fmt.Println("imported:", id)
+		}
+	}
+	return err
 }
@@ -0,0 +1,221 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// fakeController is the Controller of the manager tests. It keeps the
+// snapshots and the queued background tasks in memory, and records the
+// calls made to the engine.
+type fakeController struct {
+	mutex sync.Mutex
+
+	name      string
+	replicas  []*types.ReplicaInfo
+	snapshots map[string]*types.SnapshotInfo
+	tasks     *fakeTaskQueue
+
+	size      int64
+	expandErr error
+	addErr    error
+
+	added    []string
+	expanded []int64
+	reverted []string
+	restored []string
+	deleted  []string
+}
+
+func newFakeController(name string) *fakeController {
+	return &fakeController{
+		name:      name,
+		snapshots: map[string]*types.SnapshotInfo{},
+		tasks:     &fakeTaskQueue{},
+	}
+}
+
+func (c *fakeController) Name() string {
+	return c.name
+}
+
+func (c *fakeController) Endpoint() string {
+	return "/dev/longhorn/" + c.name
+}
+
+func (c *fakeController) GetReplicaStates() ([]*types.ReplicaInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.replicas, nil
+}
+
+func (c *fakeController) AddReplica(replica *types.ReplicaInfo) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.addErr != nil {
+		return c.addErr
+	}
+	c.added = append(c.added, replica.Address)
+	c.replicas = append(c.replicas, replica)
+	return nil
+}
+
+func (c *fakeController) RemoveReplica(replica *types.ReplicaInfo) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, r := range c.replicas {
+		if r.Address == replica.Address {
+			c.replicas = append(c.replicas[:i], c.replicas[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot find replica %v", replica.Address)
+}
+
+// Size fails until size is set, the same as an engine not reporting it
+func (c *fakeController) Size() (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.size == 0 {
+		return 0, fmt.Errorf("engine of controller %v doesn't report the volume size", c.name)
+	}
+	return c.size, nil
+}
+
+func (c *fakeController) Expand(size int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.expandErr != nil {
+		return c.expandErr
+	}
+	c.expanded = append(c.expanded, size)
+	c.size = size
+	return nil
+}
+
+func (c *fakeController) BgTaskQueue() types.TaskQueue {
+	return c.tasks
+}
+
+func (c *fakeController) LatestBgTasks() []*types.BgTask {
+	return c.tasks.List()
+}
+
+func (c *fakeController) SnapshotOps() types.SnapshotOps {
+	return c
+}
+
+func (c *fakeController) BackupOps() types.VolumeBackupOps {
+	return c
+}
+
+// SnapshotOps
+
+func (c *fakeController) Create(name string, labels map[string]string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.snapshots[name] = &types.SnapshotInfo{Name: name, UserCreated: true, Labels: labels}
+	return name, nil
+}
+
+func (c *fakeController) List() ([]*types.SnapshotInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	snapshots := []*types.SnapshotInfo{}
+	for _, s := range c.snapshots {
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
+
+func (c *fakeController) Get(name string) (*types.SnapshotInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshots[name], nil
+}
+
+func (c *fakeController) Delete(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s := c.snapshots[name]; s != nil {
+		s.Removed = true
+	}
+	return nil
+}
+
+func (c *fakeController) Revert(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reverted = append(c.reverted, name)
+	return nil
+}
+
+func (c *fakeController) Purge() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name, s := range c.snapshots {
+		if s.Removed {
+			delete(c.snapshots, name)
+		}
+	}
+	return nil
+}
+
+// VolumeBackupOps, the backups are queued without recording anything, the
+// same as the engine controller
+
+func (c *fakeController) StartBackup(snapName, backupTarget string) error {
+	c.tasks.Put(&types.BgTask{Task: &types.BackupBgTask{Snapshot: snapName, BackupTarget: backupTarget}})
+	return nil
+}
+
+func (c *fakeController) Restore(backup string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.restored = append(c.restored, backup)
+	return nil
+}
+
+func (c *fakeController) DeleteBackup(backup string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deleted = append(c.deleted, backup)
+	return nil
+}
+
+var _ types.Controller = &fakeController{}
+
+// fakeTaskQueue only queues the tasks, they are never run
+type fakeTaskQueue struct {
+	mutex sync.Mutex
+	tasks []*types.BgTask
+}
+
+func (q *fakeTaskQueue) Close() error {
+	return nil
+}
+
+func (q *fakeTaskQueue) List() []*types.BgTask {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]*types.BgTask{}, q.tasks...)
+}
+
+func (q *fakeTaskQueue) Put(t *types.BgTask) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.tasks = append(q.tasks, t)
+}
+
+func (q *fakeTaskQueue) Take() *types.BgTask {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.tasks) == 0 {
+		return nil
+	}
+	t := q.tasks[0]
+	q.tasks = q.tasks[1:]
+	return t
+}
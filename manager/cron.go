@@ -31,10 +31,11 @@ type jobRunner struct {
 	volume   *types.VolumeInfo
 	ctrl     types.Controller
 	settings types.Settings
+	events   types.EventLog
 }
 
-func newJobRunner(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings) *jobRunner {
-	return &jobRunner{volume: volume, ctrl: ctrl, settings: settings}
+func newJobRunner(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings, events types.EventLog) *jobRunner {
+	return &jobRunner{volume: volume, ctrl: ctrl, settings: settings, events: events}
 }
 
 type cronUpdate []*types.RecurringJob
@@ -43,8 +44,8 @@ func CronUpdate(jobs []*types.RecurringJob) types.Event {
 	return cronUpdate(jobs)
 }
 
-func RunJobs(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings, ch chan types.Event) {
-	runner := newJobRunner(volume, ctrl, settings)
+func RunJobs(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings, events types.EventLog, ch chan types.Event) {
+	runner := newJobRunner(volume, ctrl, settings, events)
 
 	c := runner.setJobs(volume.RecurringJobs)
 	if c == nil {
@@ -111,8 +112,12 @@ func (runner *jobRunner) newTask(job *types.RecurringJob, task Task) func() {
 	return func() {
 		if err := task.Run(); err != nil {
 			logrus.Errorf("error running job: %+v", errors.Wrapf(err, "unable to run a task for job '%s'", job.Name))
+			recordEvent(runner.events, types.EventTypeWarning, types.EventReasonJobFailed, runner.volume.Name,
+				"recurring job '%s' failed: %v", job.Name, err)
 			return
 		}
+		recordEvent(runner.events, types.EventTypeNormal, types.EventReasonJobSucceeded, runner.volume.Name,
+			"recurring job '%s' (%s) ran", job.Name, job.Task)
 	}
 }
 
@@ -221,10 +226,11 @@ func (bt *backupTask) Run() error {
 	if _, err := bt.runner.ctrl.SnapshotOps().Create(name, map[string]string{JobName: bt.job.Name, BackupJob: bt.job.Name}); err != nil {
 		return errors.Wrapf(err, "error creating snapshot for recurring backup '%s', volume '%s'", name, bt.runner.volume.Name)
 	}
-	bt.runner.ctrl.BgTaskQueue().Put(&types.BgTask{Task: types.BackupBgTask{
+	bt.runner.ctrl.BgTaskQueue().Put(&types.BgTask{Task: &types.BackupBgTask{
 		Snapshot:     name,
 		BackupTarget: bt.backupTarget,
 		CleanupHook:  bt.cleanup,
+		DoneHook:     backupDoneHook(bt.runner.events, bt.runner.volume.Name, name),
 	}})
 	return nil
 }
@@ -3,6 +3,11 @@ package manager
 import (
 	"fmt"
 	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/kvstore"
+	"github.com/rancher/longhorn-manager/types"
 )
 
 type Errs []error
@@ -34,3 +39,26 @@ func (e *ctrlErr) Error() string {
 func (e *ctrlErr) Cause() error {
 	return e.err
 }
+
+// TransitionError is returned for an operation that conflicts with the
+// state of the volume, e.g. detaching a volume being restored
+type TransitionError struct {
+	Volume    string
+	Operation string
+	State     types.VolumeState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot %s volume '%s' while it's %s", e.Operation, e.Volume, e.State)
+}
+
+func IsTransitionError(err error) bool {
+	_, ok := errors.Cause(err).(*TransitionError)
+	return ok
+}
+
+// retryOnConflict reruns f, which should re-read what it updates, as long as
+// it fails because of a concurrent update
+func retryOnConflict(f func() error) error {
+	return kvstore.RetryOnConflict(f)
+}
@@ -57,12 +57,32 @@ func (t *tickerImpl) Stop() Ticker {
 }
 
 func Send(c chan<- types.Event, e types.Event) bool {
+	return send(c, e, true)
+}
+
+// TrySend is like Send, but gives up instead of blocking if nobody is
+// receiving from c
+func TrySend(c chan<- types.Event, e types.Event) bool {
+	return send(c, e, false)
+}
+
+func send(c chan<- types.Event, e types.Event, block bool) (sent bool) {
 	if c == nil {
 		return false
 	}
 	defer func() {
-		recover() // otherwise, c <- e will panic if c is closed
+		if recover() != nil { // otherwise, c <- e will panic if c is closed
+			sent = false
+		}
 	}()
-	c <- e
-	return true
+	if block {
+		c <- e
+		return true
+	}
+	select {
+	case c <- e:
+		return true
+	default:
+	}
+	return false
 }
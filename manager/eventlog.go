@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	EventRetentionPeriod = time.Hour * 24 * 7
+	EventRetentionCount  = 10000
+	EventPruneInterval   = time.Minute * 10
+)
+
+// recordEvent doesn't fail the caller, events are only for the record
+func recordEvent(log types.EventLog, eventType types.EventType, reason, volumeName, format string, args ...interface{}) {
+	event := &types.EventInfo{
+		Type:    eventType,
+		Reason:  reason,
+		Volume:  volumeName,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if err := log.AddEvent(event); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to record event %s '%s', volume '%s'", reason, event.Message, volumeName))
+	}
+}
+
+// backupDoneHook records the result of the backup of snapshot
+func backupDoneHook(log types.EventLog, volumeName, snapshot string) func(err error) {
+	return func(err error) {
+		if err != nil {
+			recordEvent(log, types.EventTypeWarning, types.EventReasonBackupFailed, volumeName,
+				"backup of snapshot '%s' failed: %v", snapshot, err)
+			return
+		}
+		recordEvent(log, types.EventTypeNormal, types.EventReasonBackupCompleted, volumeName,
+			"backup of snapshot '%s' completed", snapshot)
+	}
+}
+
+func (man *volumeManager) recordEvent(eventType types.EventType, reason, volumeName, format string, args ...interface{}) {
+	recordEvent(man.orc, eventType, reason, volumeName, format, args...)
+}
+
+// pruneEvents only runs on the leader
+func (man *volumeManager) pruneEvents(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(EventPruneInterval)
+	defer ticker.Stop()
+	for {
+		count, err := man.orc.PruneEvents(time.Now().Add(-EventRetentionPeriod), EventRetentionCount)
+		if err != nil {
+			logrus.Errorf("%+v", errors.Wrap(err, "failed to prune events"))
+		} else if count != 0 {
+			logrus.Infof("pruned %v events", count)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/kvstore"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	// FailoverInterval is how often the failover is retried while volumes
+	// are left on hosts which are down
+	FailoverInterval = 10 * time.Second
+	// HostDownTimeout is how long a host can miss its heartbeat before the
+	// orchestrator considers it down
+	HostDownTimeout = 30 * time.Second
+	// FenceWindow is how long after the last heartbeat of a host its
+	// controllers are considered stopped even if they can't be reached.
+	// The orchestrator must have stopped the controllers of a host unable
+	// to send its heartbeat by then.
+	FenceWindow = time.Minute
+)
+
+// failoverLoop only runs on the leader. Hosts are watched rather than
+// polled: every heartbeat rearms the timer of its host, which fires once the
+// host has missed its heartbeat for HostDownTimeout. The failover is only
+// retried every FailoverInterval while volumes are left on hosts which are
+// down. reported keeps the ID of the last controller reported for each
+// volume, so a dead controller is only reported once.
+func (man *volumeManager) failoverLoop(stopCh <-chan struct{}) {
+	hostCh := make(chan string)
+	go man.keepWatching("hosts", stopCh, func() error {
+		ch, err := man.orc.WatchHosts(stopCh)
+		if err != nil {
+			return err
+		}
+		for hostID := range ch {
+			select {
+			case hostCh <- hostID:
+			case <-stopCh:
+				return nil
+			}
+		}
+		return nil
+	})
+
+	silentCh := make(chan string)
+	timers := map[string]*time.Timer{}
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}()
+	rearm := func(hostID string) {
+		if t, ok := timers[hostID]; ok {
+			t.Reset(HostDownTimeout)
+			return
+		}
+		timers[hostID] = time.AfterFunc(HostDownTimeout, func() {
+			select {
+			case silentCh <- hostID:
+			case <-stopCh:
+			}
+		})
+	}
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "failed to list hosts to watch for failover"))
+	}
+	for hostID := range hosts {
+		rearm(hostID)
+	}
+
+	reported := map[string]string{}
+	var retryCh <-chan time.Time
+	failover := func() {
+		retryCh = nil
+		if man.failoverVolumes(reported) {
+			retryCh = time.After(FailoverInterval)
+		}
+	}
+	failover()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case hostID := <-hostCh:
+			rearm(hostID)
+		case hostID := <-silentCh:
+			logrus.Infof("host '%s' has missed its heartbeat for %v, checking volumes to fail over", hostID, HostDownTimeout)
+			failover()
+		case <-retryCh:
+			failover()
+		}
+	}
+}
+
+// failoverVolumes looks for the volumes whose controller is on a host which
+// is down, and attaches them to the current host if their failover policy
+// says so. It returns true if it should be retried, because volumes to fail
+// over may be left.
+func (man *volumeManager) failoverVolumes(reported map[string]string) bool {
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "failed to list hosts for failover"))
+		return true
+	}
+	volumes, err := man.orc.ListVolumes()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "failed to list volumes for failover"))
+		return true
+	}
+
+	retry := false
+
+	for _, volume := range volumes {
+		if volume.Controller == nil {
+			delete(reported, volume.Name)
+			continue
+		}
+		hostID := volume.Controller.HostID
+		if host, ok := hosts[hostID]; ok && host.State != types.HostStateDown {
+			delete(reported, volume.Name)
+			continue
+		}
+		firstReport := reported[volume.Name] != volume.Controller.ID
+		reported[volume.Name] = volume.Controller.ID
+
+		if volume.FailoverPolicy != types.FailoverPolicyReattach {
+			if firstReport {
+				man.recordEvent(types.EventTypeWarning, types.EventReasonHostDown, volume.Name,
+					"host '%s' of the controller is down, failover is disabled", hostID)
+			}
+			continue
+		}
+		// Check again until the volume has moved off the host
+		retry = true
+		if err := man.failover(volume.Name); err != nil {
+			logrus.Errorf("%+v", err)
+			if firstReport {
+				man.recordEvent(types.EventTypeWarning, types.EventReasonFailoverFailed, volume.Name,
+					"failed to fail over from host '%s': %v", hostID, err)
+			}
+		}
+	}
+	return retry
+}
+
+// failover fences the instances of the volume on the hosts which are down,
+// then attaches the volume to the current host with the remaining replicas.
+// A host is down once its manager stops sending heartbeats, while the old
+// controller may still be serving the volume, so the failover is refused
+// until the controller is confirmed stopped without its manager. It's
+// confirmed once the engine refuses the connection, or once the host has
+// been silent for FenceWindow, unless the engine still answers.
+func (man *volumeManager) failover(name string) error {
+	lock, err := man.lockVolume(name, "failover")
+	if err != nil {
+		if kvstore.IsLockedError(err) || IsTransitionError(err) || IsShuttingDown(err) {
+			// Another operation is in progress, fail over next time
+			logrus.Debugf("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer lock.Unlock()
+
+	volume, err := man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil || volume.Controller == nil {
+		return nil
+	}
+	hostID := volume.Controller.HostID
+	if man.confirmStopped == nil {
+		return errors.Errorf("refuse to fail over volume '%s', no way to confirm its controller has stopped", name)
+	}
+	if err := man.confirmStopped(volume.Controller); err != nil {
+		if errors.Cause(err) == controller.ErrStillRunning {
+			return errors.Wrapf(err, "refuse to fail over volume '%s' from host '%s'", name, hostID)
+		}
+		silent, fenceErr := man.hostSilentFor(hostID)
+		if fenceErr != nil {
+			return errors.Wrapf(err, "refuse to fail over volume '%s' from host '%s': %v", name, hostID, fenceErr)
+		}
+		if silent < FenceWindow {
+			return errors.Wrapf(err, "refuse to fail over volume '%s' from host '%s' until it has been down for %v", name, hostID, FenceWindow)
+		}
+		logrus.Warnf("failing over volume '%s' from host '%s' silent for %v, its controller is considered fenced: %v", name, hostID, silent, err)
+	}
+	if err := man.beginTransition(volume, "fail over", types.VolumeStateAttaching, types.VolumeStateNone); err != nil {
+		return err
+	}
+	fenced, err := man.orc.FenceInstances(name)
+	if err != nil {
+		man.abortTransition(volume)
+		return errors.Wrapf(err, "failed to fence volume '%s'", name)
+	}
+	for _, instance := range fenced {
+		logrus.Warnf("fenced %s '%s' of volume '%s' on host '%s'", instance.Type, instance.Name, name, instance.HostID)
+	}
+
+	// The fenced instances are gone from the volume, so doAttach won't try
+	// to reach them
+	volume, err = man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s' to fail over", name)
+	}
+	if volume.Controller != nil {
+		// The host is back
+		return man.transitVolume(volume, types.VolumeStateAttached)
+	}
+	if err := man.doAttach(volume); err != nil {
+		man.abortTransition(volume)
+		return errors.Wrapf(err, "failed to attach volume '%s' to fail over", name)
+	}
+	if err := man.transitVolume(volume, types.VolumeStateAttached); err != nil {
+		return err
+	}
+	man.recordEvent(types.EventTypeNormal, types.EventReasonFailedOver, name,
+		"failed over from host '%s' to host '%s'", hostID, volume.Controller.HostID)
+	return nil
+}
+
+// hostSilentFor tells how long ago the host sent its last heartbeat
+func (man *volumeManager) hostSilentFor(hostID string) (time.Duration, error) {
+	host, err := man.orc.GetHost(hostID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to get host '%s'", hostID)
+	}
+	if host == nil || host.LastHeartbeat == "" {
+		return 0, errors.Errorf("the last heartbeat of host '%s' is unknown", hostID)
+	}
+	heartbeat, err := util.ParseTime(host.LastHeartbeat)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid heartbeat of host '%s'", hostID)
+	}
+	return time.Since(heartbeat), nil
+}
+
+// fenceController stops and removes the controller left on the current host
+// by the volume failed over while the host was down. It's removed as an
+// orphan, since the volume has a new controller in the key value store.
+func (man *volumeManager) fenceController(volume *types.VolumeInfo) {
+	instance := volume.Controller.InstanceInfo
+	if err := man.orc.RemoveOrphanInstance(&instance); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to fence the old controller of volume '%s'", volume.Name))
+		return
+	}
+	man.recordEvent(types.EventTypeWarning, types.EventReasonFenced, volume.Name,
+		"removed old controller %s on host '%s', the volume has failed over", instance.ID, instance.HostID)
+}
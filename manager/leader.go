@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// leaderLoop only runs on the leader of the cluster. stopCh is closed when
+// the current host is no longer the leader, and the loop will be started
+// again with a new stopCh when it's elected again.
+type leaderLoop struct {
+	name   string
+	loop   func(stopCh <-chan struct{})
+	stopCh chan struct{}
+}
+
+// RegisterLeaderLoop registers loop to be run while the current host is the
+// leader of the cluster
+func (man *volumeManager) RegisterLeaderLoop(name string, loop func(stopCh <-chan struct{})) {
+	man.Lock()
+	defer man.Unlock()
+	l := &leaderLoop{
+		name: name,
+		loop: loop,
+	}
+	man.leaderLoops = append(man.leaderLoops, l)
+	if man.leader {
+		l.start()
+	}
+}
+
+func (man *volumeManager) leadershipChanged(leader bool) {
+	man.Lock()
+	defer man.Unlock()
+	if man.leader == leader {
+		return
+	}
+	man.leader = leader
+	for _, l := range man.leaderLoops {
+		if leader {
+			l.start()
+		} else {
+			l.stop()
+		}
+	}
+}
+
+func (l *leaderLoop) start() {
+	logrus.Infof("starting leader loop %s", l.name)
+	l.stopCh = make(chan struct{})
+	go l.loop(l.stopCh)
+}
+
+func (l *leaderLoop) stop() {
+	logrus.Infof("stopping leader loop %s", l.name)
+	close(l.stopCh)
+}
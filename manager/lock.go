@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/kvstore"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	VolumeLockTTL = time.Second * 30
+)
+
+// volumeLock is held by one operation of a volume, across all the managers.
+// The lease is renewed in the background until Unlock. Once the lease is
+// lost, another manager may start operating the volume, so the volume state
+// can no longer be updated under the lock, failing the operation.
+type volumeLock struct {
+	man    *volumeManager
+	volume string
+	name   string
+	holder string
+	lease  *kvstore.Lease
+	// released is set once the lock is released, by Unlock or by Shutdown
+	// interrupting the operation, guarded by the manager mutex
+	released bool
+}
+
+func volumeLockName(volumeName string) string {
+	return filepath.Join("volumes", volumeName)
+}
+
+// lockVolume fails with kvstore.LockedError if another operation of the
+// volume is in progress, or TransitionError if the operation is one of the
+// state transitions
+func (man *volumeManager) lockVolume(volumeName, operation string) (*volumeLock, error) {
+	if man.isShuttingDown() {
+		return nil, errors.Wrapf(ErrShuttingDown, "unable to lock volume '%s' for %s", volumeName, operation)
+	}
+	l := &volumeLock{
+		man:    man,
+		volume: volumeName,
+		name:   volumeLockName(volumeName),
+		holder: man.orc.GetCurrentHostID() + "/" + operation + "/" + util.RandomID(),
+	}
+	if err := man.orc.TryLock(l.name, l.holder, VolumeLockTTL); err != nil {
+		if kvstore.IsLockedError(err) {
+			if volume, _ := man.orc.GetVolume(volumeName); volume != nil && isTransitional(volume.CurrentState) {
+				return nil, &TransitionError{
+					Volume:    volumeName,
+					Operation: operation,
+					State:     volume.CurrentState,
+				}
+			}
+		}
+		return nil, errors.Wrapf(err, "unable to lock volume '%s' for %s", volumeName, operation)
+	}
+	l.lease = kvstore.NewLease(l.name, VolumeLockTTL, func() error {
+		return man.orc.TryLock(l.name, l.holder, VolumeLockTTL)
+	})
+
+	man.Lock()
+	if man.volumeLocks == nil {
+		man.volumeLocks = map[string]*volumeLock{}
+	}
+	man.volumeLocks[volumeName] = l
+	man.Unlock()
+	return l, nil
+}
+
+// Err returns nil as long as the lock is held
+func (l *volumeLock) Err() error {
+	l.man.Lock()
+	released := l.released
+	l.man.Unlock()
+	if released {
+		return errors.Wrapf(ErrShuttingDown, "operation of volume '%s' is aborted, its lock is released", l.volume)
+	}
+	if err := l.lease.Err(); err != nil {
+		return errors.Wrapf(err, "operation of volume '%s' is aborted", l.volume)
+	}
+	return nil
+}
+
+func (l *volumeLock) Unlock() {
+	l.man.Lock()
+	if l.man.volumeLocks[l.volume] == l {
+		delete(l.man.volumeLocks, l.volume)
+	}
+	l.man.Unlock()
+	l.release()
+}
+
+// release the lock in the key value store, only once
+func (l *volumeLock) release() {
+	l.man.Lock()
+	released := l.released
+	l.released = true
+	l.man.Unlock()
+	if released {
+		return
+	}
+
+	// Make sure the lease won't be renewed after released
+	l.lease.Stop()
+	if l.lease.Err() != nil {
+		// Someone else may be holding it now
+		return
+	}
+	if err := l.man.orc.Unlock(l.name, l.holder); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to release lock %s", l.name))
+	}
+}
+
+// checkVolumeLock fails if the current manager has lost the lock of the
+// volume while operating it
+func (man *volumeManager) checkVolumeLock(volumeName string) error {
+	man.Lock()
+	l := man.volumeLocks[volumeName]
+	man.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Err()
+}
@@ -8,27 +8,45 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	"github.com/rancher/longhorn-manager/kvstore"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
 
 var (
+	// KeepBadReplicasPeriod applies if neither the volume nor the settings
+	// have StaleReplicaTimeout
 	KeepBadReplicasPeriod = time.Hour * 2
 )
 
 type volumeManager struct {
 	sync.Mutex
 
-	monitors       map[string]types.Monitor
-	addingReplicas map[string]int
+	monitors        map[string]types.Monitor
+	addingReplicas  map[string]int
+	reportedOrphans map[string]struct{}
 
 	orc     types.Orchestrator
 	monitor types.BeginMonitoring
 
-	getController types.GetController
-	getBackups    types.GetManagerBackupOps
+	getController    types.GetController
+	getBackups       types.GetManagerBackupOps
+	getReplicaStatus types.GetReplicaStatus
+	confirmStopped   types.ConfirmControllerStopped
 
 	settings types.Settings
+
+	leaderLoops []*leaderLoop
+	leader      bool
+
+	// volumeLocks are the locks held by the operations of this manager
+	volumeLocks map[string]*volumeLock
+
+	shuttingDown bool
+	background   sync.WaitGroup
+
+	stopCh       chan struct{}
+	electionDone chan struct{}
 }
 
 func (man *volumeManager) GetControllerName(volumeName string) string {
@@ -39,23 +57,34 @@ func (man *volumeManager) GetReplicaName(volumeName string) string {
 	return volumeName + "-replica-" + util.RandomID()
 }
 
-func New(orc types.Orchestrator, monitor types.BeginMonitoring, getController types.GetController, getBackups types.GetManagerBackupOps) types.VolumeManager {
-	return &volumeManager{
-		monitors:       map[string]types.Monitor{},
-		addingReplicas: map[string]int{},
+func New(orc types.Orchestrator, monitor types.BeginMonitoring, getController types.GetController, getBackups types.GetManagerBackupOps, getReplicaStatus types.GetReplicaStatus, confirmStopped types.ConfirmControllerStopped) types.VolumeManager {
+	man := &volumeManager{
+		monitors:        map[string]types.Monitor{},
+		addingReplicas:  map[string]int{},
+		reportedOrphans: map[string]struct{}{},
 
 		orc:     orc,
 		monitor: monitor,
 
-		getController: getController,
-		getBackups:    getBackups,
+		getController:    getController,
+		getBackups:       getBackups,
+		getReplicaStatus: getReplicaStatus,
+		confirmStopped:   confirmStopped,
 
 		settings: orc,
+
+		stopCh:       make(chan struct{}),
+		electionDone: make(chan struct{}),
 	}
+	man.RegisterLeaderLoop("pruneEvents", man.pruneEvents)
+	man.RegisterLeaderLoop("failover", man.failoverLoop)
+	return man
 }
 
 func (man *volumeManager) doCreate(volume *types.VolumeInfo) (*types.VolumeInfo, error) {
 	volume.Created = util.Now()
+	volume.DesiredState = types.VolumeStateDetached
+	volume.CurrentState = types.VolumeStateCreating
 	vol, err := man.orc.CreateVolume(volume)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create volume '%s'", volume.Name)
@@ -70,40 +99,107 @@ func (man *volumeManager) doCreate(volume *types.VolumeInfo) (*types.VolumeInfo,
 	return man.Get(volume.Name)
 }
 
+// cleanupFailedCreate is called with the volume lock held
 func (man *volumeManager) cleanupFailedCreate(vol *types.VolumeInfo) {
-	if err := man.Delete(vol.Name); err != nil {
+	if err := man.delete(vol.Name); err != nil {
 		logrus.Warnf("%+v", errors.Wrapf(err, "error deleting volume (failed create) '%s'", vol.Name))
 	} else {
 		logrus.Debugf("cleaned up after failing to create volume '%s'", vol.Name)
 	}
 }
 
+// createFromBackup only creates the volume and sets it restoring, the
+// restore is done by restoreBackup in the background
 func (man *volumeManager) createFromBackup(volume *types.VolumeInfo, backup *types.BackupInfo) (*types.VolumeInfo, error) {
 	size, err := strconv.ParseInt(backup.VolumeSize, 10, 64)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error parsing backup.VolumeSize, backup: %+v", backup)
 	}
 	volume.Size = size
+	volume.RestoreStatus = &types.RestoreStatus{
+		Backup:  backup.URL,
+		Phase:   types.RestorePhaseAttaching,
+		Started: util.Now(),
+	}
 	vol, err := man.doCreate(volume)
 	if err != nil {
 		return nil, err
 	}
-	if err := man.doAttach(vol); err != nil {
+	if err := man.transitVolume(vol, types.VolumeStateRestoring); err != nil {
 		defer man.cleanupFailedCreate(vol)
-		return nil, errors.Wrapf(err, "failed to attach to restore the backup, volume '%s', backup '%+v'", vol.Name, backup)
+		return nil, err
 	}
-	if err := man.getController(vol).BackupOps().Restore(backup.URL); err != nil {
-		defer man.cleanupFailedCreate(vol)
-		return nil, errors.Wrapf(err, "failed to restore the backup, volume '%s', backup '%+v'", vol.Name, backup)
+	return vol, nil
+}
+
+// createFromSnapshot only creates the volume and sets it restoring, the
+// snapshot chain is copied by cloneSnapshot in the background. The source
+// volume must be attached, since its controller copies the chain. The lock of
+// the source volume is returned to be handed over to cloneSnapshot, so the
+// source isn't detached in the middle.
+func (man *volumeManager) createFromSnapshot(volume *types.VolumeInfo) (*types.VolumeInfo, *volumeLock, types.Controller, error) {
+	src := volume.FromSnapshot
+	srcLock, err := man.lockVolume(src.Volume, "clone")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vol, srcCtrl, err := man.doCreateFromSnapshot(volume)
+	if err != nil {
+		srcLock.Unlock()
+		return nil, nil, nil, err
+	}
+	return vol, srcLock, srcCtrl, nil
+}
+
+func (man *volumeManager) doCreateFromSnapshot(volume *types.VolumeInfo) (*types.VolumeInfo, types.Controller, error) {
+	src := volume.FromSnapshot
+	srcVolume, err := man.Get(src.Volume)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error getting source volume '%s'", src.Volume)
+	}
+	if srcVolume == nil {
+		return nil, nil, errors.Errorf("cannot find source volume '%s'", src.Volume)
 	}
-	if err := man.doDetach(vol); err != nil {
+	srcCtrl := man.getController(srcVolume)
+	if srcCtrl == nil {
+		return nil, nil, errors.Errorf("source volume '%s' must be attached to clone from", src.Volume)
+	}
+	snapshot, err := srcCtrl.SnapshotOps().Get(src.Snapshot)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error getting snapshot '%s' of volume '%s'", src.Snapshot, src.Volume)
+	}
+	if snapshot == nil || snapshot.Removed {
+		return nil, nil, errors.Errorf("cannot find snapshot '%s' of volume '%s'", src.Snapshot, src.Volume)
+	}
+
+	volume.Size = srcVolume.Size
+	volume.RestoreStatus = &types.RestoreStatus{
+		Phase:   types.RestorePhaseCopying,
+		Started: util.Now(),
+	}
+	vol, err := man.doCreate(volume)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := man.transitVolume(vol, types.VolumeStateRestoring); err != nil {
 		defer man.cleanupFailedCreate(vol)
-		return nil, errors.Wrapf(err, "failed to detach after restoring the backup, volume '%s', backup '%+v'", vol.Name, backup)
+		return nil, nil, err
 	}
-	return vol, nil
+	return vol, srcCtrl, nil
 }
 
 func (man *volumeManager) Create(volume *types.VolumeInfo) (*types.VolumeInfo, error) {
+	lock, err := man.lockVolume(volume.Name, "create")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// The lock may have been handed over to the restore
+		if lock != nil {
+			lock.Unlock()
+		}
+	}()
+
 	vol, err := man.Get(volume.Name)
 	if err != nil {
 		return nil, err
@@ -121,22 +217,74 @@ func (man *volumeManager) Create(volume *types.VolumeInfo) (*types.VolumeInfo, e
 			return nil, errors.New("create volume fail: No EngineImage specified")
 		}
 	}
-	if volume.FromBackup != "" {
-		backupTarget := settings.BackupTarget
+	if volume.FromBackup != "" && volume.FromSnapshot != nil {
+		return nil, errors.New("create volume fail: cannot create from both backup and snapshot")
+	}
+	backupTarget := settings.BackupTarget
+	switch {
+	case volume.FromSnapshot != nil:
+		if volume.FromSnapshot.Volume == "" || volume.FromSnapshot.Snapshot == "" {
+			return nil, errors.New("create volume fail: both volume and snapshot are required to create from snapshot")
+		}
+		var srcLock *volumeLock
+		var srcCtrl types.Controller
+		if vol, srcLock, srcCtrl, err = man.createFromSnapshot(volume); err != nil {
+			return nil, err
+		}
+		restoreLock := lock
+		if err := man.goBackground(func() {
+			man.cloneSnapshot(restoreLock, srcLock, vol, srcCtrl)
+		}); err != nil {
+			srcLock.Unlock()
+			return nil, err
+		}
+		lock = nil
+		return man.Get(vol.Name)
+	case volume.FromBackup != "":
 		if backupTarget == "" {
 			return nil, errors.New("create volume fail: No BackupTarget specified")
 		}
 
-		backup, err := man.getBackups(backupTarget).Get(volume.FromBackup)
+		var backup *types.BackupInfo
+		backup, err = man.getBackups(backupTarget).Get(volume.FromBackup)
 		if err != nil {
 			return nil, errors.Wrapf(err, "error getting backup (to create volume) '%s'", volume.FromBackup)
 		}
-		return man.createFromBackup(volume, backup)
+		if vol, err = man.createFromBackup(volume, backup); err != nil {
+			return nil, err
+		}
+		restoreLock := lock
+		if err := man.goBackground(func() {
+			man.restoreBackup(restoreLock, vol, backup)
+		}); err != nil {
+			return nil, err
+		}
+		lock = nil
+		return man.Get(vol.Name)
+	default:
+		vol, err = man.doCreate(volume)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := man.transitVolume(vol, types.VolumeStateDetached); err != nil {
+		return nil, err
 	}
-	return man.doCreate(volume)
+	return man.Get(vol.Name)
 }
 
 func (man *volumeManager) Delete(name string) error {
+	lock, err := man.lockVolume(name, "delete")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return man.delete(name)
+}
+
+// delete is Delete for the callers holding the volume lock already
+func (man *volumeManager) delete(name string) error {
 	volume, err := man.Get(name)
 	if err != nil {
 		return err
@@ -145,21 +293,33 @@ func (man *volumeManager) Delete(name string) error {
 		logrus.Warnf("volume %v no longer exist for delete", name)
 		return nil
 	}
+	if err := man.beginTransition(volume, "delete", types.VolumeStateDeleting, types.VolumeStateNone); err != nil {
+		return err
+	}
 
 	if err := man.doDetach(volume); err != nil {
+		man.abortTransition(volume)
 		return errors.Wrapf(err, "error detaching for delete, volume '%s'", volume.Name)
 	}
 
 	for _, replica := range volume.Replicas {
 		if _, err := man.orc.RemoveInstance(&replica.InstanceInfo); err != nil {
+			man.abortTransition(volume)
 			return errors.Wrapf(err, "error removing replica container %s(%s), volume '%s'", replica.Name, replica.ID, volume.Name)
 		}
 	}
 
-	return errors.Wrapf(man.orc.DeleteVolume(name), "failed to delete volume '%s'", name)
+	if err := man.orc.DeleteVolume(name); err != nil {
+		man.abortTransition(volume)
+		return errors.Wrapf(err, "failed to delete volume '%s'", name)
+	}
+	return nil
 }
 
 func volumeState(volume *types.VolumeInfo) types.VolumeState {
+	if isTransitional(volume.CurrentState) {
+		return volume.CurrentState
+	}
 	goodReplicaCount := 0
 	for _, replica := range volume.Replicas {
 		if replica.BadTimestamp == "" {
@@ -177,9 +337,40 @@ func volumeState(volume *types.VolumeInfo) types.VolumeState {
 	return types.VolumeStateDegraded
 }
 
+// staleReplicaTimeout is how long to keep the bad replicas of the volume
+func (man *volumeManager) staleReplicaTimeout(volume *types.VolumeInfo) time.Duration {
+	if volume.StaleReplicaTimeout > 0 {
+		return volume.StaleReplicaTimeout
+	}
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "unable to get settings for stale replica timeout"))
+	} else if settings != nil && settings.StaleReplicaTimeout > 0 {
+		return time.Duration(settings.StaleReplicaTimeout) * time.Minute
+	}
+	return KeepBadReplicasPeriod
+}
+
+// completeVolumeState fills the fields decided from the rest of the volume
 func (man *volumeManager) completeVolumeState(vol *types.VolumeInfo) *types.VolumeInfo {
+	vol.CurrentState = currentState(vol)
 	vol.State = volumeState(vol)
 
+	var timeout time.Duration
+	for _, replica := range vol.Replicas {
+		if replica.BadTimestamp == "" {
+			continue
+		}
+		badTime, err := util.ParseTime(replica.BadTimestamp)
+		if err != nil {
+			continue
+		}
+		if timeout == 0 {
+			timeout = man.staleReplicaTimeout(vol)
+		}
+		replica.GCTimestamp = badTime.Add(timeout).UTC().Format(time.RFC3339)
+	}
+
 	vol.Endpoint = ""
 	if vol.Controller != nil && vol.Controller.Running {
 		vol.Endpoint = man.getController(vol).Endpoint()
@@ -210,6 +401,20 @@ func (man *volumeManager) List() ([]*types.VolumeInfo, error) {
 }
 
 func (man *volumeManager) Start() error {
+	// The host has been registered with the first heartbeat, keep it up
+	// while migrating
+	go man.orc.RunHeartbeat(man.stopCh)
+
+	changes, err := man.orc.MigrateKV(false)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		logrus.Infof("key value store migrated: %v", change)
+	}
+	// Find out what has changed while the manager was down
+	man.reconcile()
+
 	vs, err := man.List()
 	if err != nil {
 		return err
@@ -219,6 +424,12 @@ func (man *volumeManager) Start() error {
 			man.startMonitoring(v)
 		}
 	}
+	man.startWatching()
+	go man.reconcileLoop()
+	go func() {
+		defer close(man.electionDone)
+		man.orc.RunElection(man.stopCh, man.leadershipChanged)
+	}()
 	return nil
 }
 
@@ -231,14 +442,12 @@ func (man *volumeManager) startMonitoring(volume *types.VolumeInfo) {
 }
 
 func (man *volumeManager) updateCron(volume *types.VolumeInfo, jobs []*types.RecurringJob) {
-	man.Lock()
-	defer man.Unlock()
-	monitor := man.monitors[volume.Name]
+	monitor := man.getMonitor(volume.Name)
 	if monitor == nil {
 		return
 	}
-	if cronCh := monitor.CronCh(); cronCh != nil {
-		cronCh <- CronUpdate(jobs)
+	// Don't hold the lock while sending, the jobs may be busy
+	if Send(monitor.CronCh(), CronUpdate(jobs)) {
 		logrus.Infof("updated recurring jobs schedule, volume '%s'", volume.Name)
 	}
 }
@@ -253,11 +462,33 @@ func (man *volumeManager) stopMonitoring(volume *types.VolumeInfo) {
 }
 
 func (man *volumeManager) Attach(name string) error {
+	lock, err := man.lockVolume(name, "attach")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	volume, err := man.Get(name)
 	if err != nil {
 		return err
 	}
-	return man.doAttach(volume)
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s' to attach", name)
+	}
+	return man.attach(volume, types.VolumeStateAttached)
+}
+
+// attach is doAttach as a transition of the volume state. desired is left as
+// is if it's empty.
+func (man *volumeManager) attach(volume *types.VolumeInfo, desired types.VolumeState) error {
+	if err := man.beginTransition(volume, "attach", types.VolumeStateAttaching, desired); err != nil {
+		return err
+	}
+	if err := man.doAttach(volume); err != nil {
+		man.abortTransition(volume)
+		return err
+	}
+	return man.transitVolume(volume, types.VolumeStateAttached)
 }
 
 func (man *volumeManager) doAttach(volume *types.VolumeInfo) error {
@@ -266,7 +497,7 @@ func (man *volumeManager) doAttach(volume *types.VolumeInfo) error {
 			man.startMonitoring(volume)
 			return nil
 		}
-		if err := man.Detach(volume.Name); err != nil {
+		if err := man.doDetach(volume); err != nil {
 			return errors.Wrapf(err, "failed to detach before reattaching volume '%s'", volume.Name)
 		}
 	}
@@ -293,12 +524,17 @@ func (man *volumeManager) doAttach(volume *types.VolumeInfo) error {
 				logrus.Errorf("%+v", err)
 				continue
 			}
+			if recentBadReplica == nil {
+				recentBadReplica = replica
+				recentBadK = k
+				continue
+			}
 			recentBadTime, err := util.ParseTime(recentBadReplica.BadTimestamp)
 			if err != nil {
 				logrus.Errorf("%+v", err)
 				continue
 			}
-			if recentBadReplica == nil || replicaBadTime.After(recentBadTime) {
+			if replicaBadTime.After(recentBadTime) {
 				recentBadReplica = replica
 				recentBadK = k
 			}
@@ -346,17 +582,33 @@ func (man *volumeManager) doAttach(volume *types.VolumeInfo) error {
 		return errs
 	}
 
+	if err := man.checkVolumeLock(volume.Name); err != nil {
+		return err
+	}
 	controller, err := man.orc.CreateController(volume.Name, man.GetControllerName(volume.Name), replicas)
 	if err != nil {
 		return errors.Wrapf(err, "failed to start the controller for volume '%s'", volume.Name)
 	}
 
 	volume.Controller = controller
+	man.expandOnAttach(volume)
 	man.startMonitoring(volume)
 	return nil
 }
 
 func (man *volumeManager) Detach(name string) error {
+	lock, err := man.lockVolume(name, "detach")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return man.detach(name, types.VolumeStateDetached)
+}
+
+// detach is Detach for the callers holding the volume lock already. desired
+// is left as is if it's empty, e.g. for the volume detached automatically.
+func (man *volumeManager) detach(name string, desired types.VolumeState) error {
 	volume, err := man.Get(name)
 	if err != nil {
 		return err
@@ -365,7 +617,14 @@ func (man *volumeManager) Detach(name string) error {
 		logrus.Warnf("volume %v no longer exist for detach", name)
 		return nil
 	}
-	return man.doDetach(volume)
+	if err := man.beginTransition(volume, "detach", types.VolumeStateDetaching, desired); err != nil {
+		return err
+	}
+	if err := man.doDetach(volume); err != nil {
+		man.abortTransition(volume)
+		return err
+	}
+	return man.transitVolume(volume, types.VolumeStateDetached)
 }
 
 func (man *volumeManager) doDetach(volume *types.VolumeInfo) error {
@@ -407,6 +666,97 @@ func (man *volumeManager) doDetach(volume *types.VolumeInfo) error {
 	return nil
 }
 
+// Expand grows the volume to size. The engine does it online if the volume
+// is attached, otherwise it's done by expandOnAttach next time.
+func (man *volumeManager) Expand(name string, size int64) error {
+	lock, err := man.lockVolume(name, "expand")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	volume, err := man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s' to expand", name)
+	}
+	if size < volume.Size {
+		return errors.Errorf("cannot shrink volume '%s' from %v to %v", name, volume.Size, size)
+	}
+	if size == volume.Size {
+		return nil
+	}
+	switch volume.State {
+	case types.VolumeStateDetached:
+	case types.VolumeStateHealthy:
+		ctrl := man.getController(volume)
+		if ctrl == nil {
+			return errors.Errorf("cannot find the controller of volume '%s'", name)
+		}
+		if _, err := ctrl.Size(); err != nil {
+			man.recordEvent(types.EventTypeWarning, types.EventReasonExpandFailed, name,
+				"failed to expand from %v to %v: %v", volume.Size, size, err)
+			return errors.Wrapf(err, "failed to get size of volume '%s'", name)
+		}
+		if err := ctrl.Expand(size); err != nil {
+			man.recordEvent(types.EventTypeWarning, types.EventReasonExpandFailed, name,
+				"failed to expand from %v to %v: %v", volume.Size, size, err)
+			return errors.Wrapf(err, "failed to expand volume '%s'", name)
+		}
+	default:
+		return errors.Errorf("cannot expand volume '%s' in state %v, it must be detached or healthy", name, volume.State)
+	}
+
+	if err := retryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.Size = size
+		if err := man.orc.UpdateVolume(volume); err != nil {
+			return errors.Wrapf(err, "unable to update volume '%s'", name)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	man.recordEvent(types.EventTypeNormal, types.EventReasonExpanded, name,
+		"expanded from %v to %v", volume.Size, size)
+	return nil
+}
+
+// expandOnAttach finishes the expansion done while the volume was detached.
+// It doesn't fail the attach, the volume is still usable with the old size.
+func (man *volumeManager) expandOnAttach(volume *types.VolumeInfo) {
+	ctrl := man.getController(volume)
+	if ctrl == nil {
+		return
+	}
+	size, err := ctrl.Size()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to get size of volume '%s'", volume.Name))
+		man.recordEvent(types.EventTypeWarning, types.EventReasonExpandFailed, volume.Name,
+			"cannot tell if the volume needs to expand to %v on attach: %v", volume.Size, err)
+		return
+	}
+	if size >= volume.Size {
+		return
+	}
+	if err := ctrl.Expand(volume.Size); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to expand volume '%s' on attach", volume.Name))
+		man.recordEvent(types.EventTypeWarning, types.EventReasonExpandFailed, volume.Name,
+			"failed to expand from %v to %v on attach: %v", size, volume.Size, err)
+		return
+	}
+	man.recordEvent(types.EventTypeNormal, types.EventReasonExpanded, volume.Name,
+		"expanded from %v to %v on attach", size, volume.Size)
+}
+
 func (man *volumeManager) createAndAddReplicaToController(volumeName string, ctrl types.Controller) error {
 	replica, err := man.orc.CreateReplica(volumeName, man.GetReplicaName(volumeName))
 	if err != nil {
@@ -418,22 +768,43 @@ func (man *volumeManager) createAndAddReplicaToController(volumeName string, ctr
 	}
 	// Update replica.InstanceInfo to provide address for ctrl.AddReplica() call
 	replica.InstanceInfo = *instance
-	go func() {
-		man.addingReplicasCount(volumeName, 1)
+	man.addingReplicasCount(volumeName, 1)
+	if err := man.goBackground(func() {
 		defer man.addingReplicasCount(volumeName, -1)
+		man.setReplicaRebuilding(volumeName, replica, true)
 		if err := ctrl.AddReplica(replica); err != nil {
 			logrus.Errorf("%+v", errors.Wrapf(err, "failed to add replica '%s' to volume '%s'", replica.Name, volumeName))
+			man.recordEvent(types.EventTypeWarning, types.EventReasonReplicaAddFailed, volumeName,
+				"failed to add replica '%s': %v", replica.Name, err)
 			if _, err := man.orc.StopInstance(&replica.InstanceInfo); err != nil {
 				logrus.Errorf("%+v", errors.Wrapf(err, "failed to stop stale replica '%s' of volume '%s'", replica.Name, volumeName))
 			}
 			if _, err := man.orc.RemoveInstance(&replica.InstanceInfo); err != nil {
 				logrus.Errorf("%+v", errors.Wrapf(err, "failed to remove stale replica '%s' of volume '%s'", replica.Name, volumeName))
 			}
+			return
 		}
-	}()
+		man.setReplicaRebuilding(volumeName, replica, false)
+		man.recordEvent(types.EventTypeNormal, types.EventReasonReplicaAdded, volumeName,
+			"added replica '%s' on host '%s'", replica.Name, replica.HostID)
+	}); err != nil {
+		man.addingReplicasCount(volumeName, -1)
+		return err
+	}
 	return nil
 }
 
+// setReplicaRebuilding only logs the error, Rebuilding is only counted by the
+// scheduler, and cleared by CheckController if it's left behind
+func (man *volumeManager) setReplicaRebuilding(volumeName string, replica *types.ReplicaInfo, rebuilding bool) {
+	if err := retryOnConflict(func() error {
+		return man.orc.SetReplicaRebuilding(volumeName, replica, rebuilding)
+	}); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to set rebuilding of replica '%s' of volume '%s' to %v",
+			replica.Name, volumeName, rebuilding))
+	}
+}
+
 func (man *volumeManager) addingReplicasCount(name string, add int) int {
 	man.Lock()
 	defer man.Unlock()
@@ -443,13 +814,23 @@ func (man *volumeManager) addingReplicasCount(name string, add int) int {
 }
 
 func (man *volumeManager) UpdateRecurring(name string, jobs []*types.RecurringJob) error {
-	volume, err := man.orc.GetVolume(name)
-	if err != nil {
-		return errors.Wrapf(err, "unable to get volume '%s'", name)
-	}
-	volume.RecurringJobs = jobs
-	if err := man.orc.UpdateVolume(volume); err != nil {
-		return errors.Wrapf(err, "unable to update volume '%s'", name)
+	var volume *types.VolumeInfo
+	if err := retryOnConflict(func() error {
+		var err error
+		volume, err = man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.RecurringJobs = jobs
+		if err := man.orc.UpdateVolume(volume); err != nil {
+			return errors.Wrapf(err, "unable to update volume '%s'", name)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	if err := ValidateJobs(jobs); err != nil {
@@ -462,6 +843,35 @@ func (man *volumeManager) UpdateRecurring(name string, jobs []*types.RecurringJo
 }
 
 func (man *volumeManager) CheckController(ctrl types.Controller, volume *types.VolumeInfo) error {
+	lock, err := man.lockVolume(volume.Name, "check")
+	if err != nil {
+		if kvstore.IsLockedError(err) || IsTransitionError(err) || IsShuttingDown(err) {
+			// Another operation is in progress, check next time
+			logrus.Debugf("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer lock.Unlock()
+
+	// The volume may have failed over to another host while the current
+	// host was down
+	current, err := man.orc.GetVolume(volume.Name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", volume.Name)
+	}
+	if current == nil {
+		return errors.Errorf("cannot find volume '%s'", volume.Name)
+	}
+	if current.Controller != nil && volume.Controller != nil &&
+		current.Controller.ID != volume.Controller.ID &&
+		current.Controller.HostID != man.orc.GetCurrentHostID() {
+		logrus.Warnf("volume '%s' has failed over to host '%s', stop monitoring", volume.Name, current.Controller.HostID)
+		man.stopMonitoring(volume)
+		man.fenceController(volume)
+		return nil
+	}
+
 	replicas, err := ctrl.GetReplicaStates()
 	if err != nil {
 		return NewControllerError(err)
@@ -490,7 +900,13 @@ func (man *volumeManager) CheckController(ctrl types.Controller, volume *types.V
 				}()
 				go func() {
 					defer wg.Done()
-					err := man.orc.MarkBadReplica(volume.Name, replica)
+					err := retryOnConflict(func() error {
+						return man.orc.MarkBadReplica(volume.Name, replica)
+					})
+					if err == nil {
+						man.recordEvent(types.EventTypeWarning, types.EventReasonReplicaBad, volume.Name,
+							"replica '%s' is in ERR mode, marked bad", replica.Address)
+					}
 					errCh <- errors.Wrapf(err, "failed to mark replica '%s' bad for volume '%s'", replica.Address, volume.Name)
 				}()
 			}(replica)
@@ -513,24 +929,200 @@ func (man *volumeManager) CheckController(ctrl types.Controller, volume *types.V
 	}
 	if len(goodReplicas) == 0 {
 		logrus.Errorf("volume '%s' has no more good replicas, shutting it down", volume.Name)
-		return man.Detach(volume.Name)
+		man.recordEvent(types.EventTypeWarning, types.EventReasonAutoDetached, volume.Name,
+			"no more good replicas, detaching")
+		if err := man.detach(volume.Name, types.VolumeStateNone); err != nil {
+			return err
+		}
+		// The monitoring has stopped, don't report the error to it
+		if err := man.autoSalvage(volume.Name); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to auto salvage volume '%s'", volume.Name))
+		}
+		return nil
+	}
+
+	// NumberOfReplicas may have been updated since the monitoring started
+	current, err = man.orc.GetVolume(volume.Name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", volume.Name)
+	}
+	if current == nil {
+		return errors.Errorf("cannot find volume '%s'", volume.Name)
 	}
 
 	addingReplicas := man.addingReplicasCount(volume.Name, 0)
+	if addingReplicas == 0 {
+		// Left behind by a manager which died in the middle
+		for _, replica := range current.Replicas {
+			if replica.Rebuilding {
+				man.setReplicaRebuilding(volume.Name, replica, false)
+			}
+		}
+	}
 	logrus.Debugf("'%s' replicas by state: RW=%v, WO=%v, adding=%v", volume.Name, len(goodReplicas), len(woReplicas), addingReplicas)
-	if len(goodReplicas) < volume.NumberOfReplicas && len(woReplicas) == 0 && addingReplicas == 0 {
+	if len(goodReplicas) < current.NumberOfReplicas && len(woReplicas) == 0 && addingReplicas == 0 {
 		if err := man.createAndAddReplicaToController(volume.Name, ctrl); err != nil {
 			return err
 		}
 	}
-	if len(goodReplicas)+len(woReplicas) > volume.NumberOfReplicas {
-		logrus.Warnf("volume '%s' has more replicas than needed: has %v, needs %v", volume.Name, len(goodReplicas), volume.NumberOfReplicas)
+	if len(goodReplicas)+len(woReplicas) > current.NumberOfReplicas && addingReplicas == 0 {
+		logrus.Infof("volume '%s' has more replicas than needed: has %v, needs %v", volume.Name, len(goodReplicas)+len(woReplicas), current.NumberOfReplicas)
+		if err := man.removeExcessReplicas(ctrl, current, append(woReplicas, goodReplicas...)); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// removeExcessReplicas removes the replicas beyond NumberOfReplicas from the
+// controller, then their instances. replicas are reported by the controller.
+func (man *volumeManager) removeExcessReplicas(ctrl types.Controller, volume *types.VolumeInfo, replicas []*types.ReplicaInfo) error {
+	byAddress := map[string]*types.ReplicaInfo{}
+	for _, replica := range volume.Replicas {
+		byAddress[replica.Address] = replica
+	}
+	candidates := []*types.ReplicaInfo{}
+	for _, replica := range replicas {
+		r := byAddress[replica.Address]
+		if r == nil {
+			logrus.Warnf("cannot find replica '%s' of volume '%s', not removing it", replica.Address, volume.Name)
+			continue
+		}
+		candidate := *r
+		candidate.Mode = replica.Mode
+		candidates = append(candidates, &candidate)
+	}
+	count := len(replicas) - volume.NumberOfReplicas
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+	for _, replica := range pickReplicasToRemove(candidates, count) {
+		if err := ctrl.RemoveReplica(replica); err != nil {
+			return errors.Wrapf(err, "failed to remove excess replica '%s' from volume '%s'", replica.Name, volume.Name)
+		}
+		if err := man.removeReplicaInstance(volume.Name, replica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (man *volumeManager) removeReplicaInstance(volumeName string, replica *types.ReplicaInfo) error {
+	if replica.Running {
+		if _, err := man.orc.StopInstance(&replica.InstanceInfo); err != nil {
+			logrus.Warnf("cannot stop replica %v of volume %v, push on", replica.Name, volumeName)
+		}
+	}
+	if _, err := man.orc.RemoveInstance(&replica.InstanceInfo); err != nil {
+		return errors.Wrapf(err, "fail to remove replica %v of volume %v", replica.Name, volumeName)
+	}
+	man.recordEvent(types.EventTypeNormal, types.EventReasonReplicaRemoved, volumeName,
+		"removed replica '%s' on host '%s'", replica.Name, replica.HostID)
+	return nil
+}
+
+var replicaHealth = map[types.ReplicaMode]int{
+	types.ReplicaModeERR: -2,
+	types.ReplicaModeWO:  -1,
+}
+
+// pickReplicasToRemove picks count replicas, the least healthy first, then
+// the ones sharing a host with the most replicas, so the rest stay spread
+// across the hosts
+func pickReplicasToRemove(replicas []*types.ReplicaInfo, count int) []*types.ReplicaInfo {
+	remaining := append([]*types.ReplicaInfo{}, replicas...)
+	picked := []*types.ReplicaInfo{}
+	for len(picked) < count && len(remaining) != 0 {
+		hostReplicas := map[string]int{}
+		for _, r := range remaining {
+			hostReplicas[r.HostID]++
+		}
+		worse := func(a, b *types.ReplicaInfo) bool {
+			if replicaHealth[a.Mode] != replicaHealth[b.Mode] {
+				return replicaHealth[a.Mode] < replicaHealth[b.Mode]
+			}
+			if hostReplicas[a.HostID] != hostReplicas[b.HostID] {
+				return hostReplicas[a.HostID] > hostReplicas[b.HostID]
+			}
+			return a.Name > b.Name
+		}
+		worst := 0
+		for i, r := range remaining {
+			if worse(r, remaining[worst]) {
+				worst = i
+			}
+		}
+		picked = append(picked, remaining[worst])
+		remaining = append(remaining[:worst], remaining[worst+1:]...)
+	}
+	return picked
+}
+
+// UpdateReplicaCount only removes the excess replicas of a detached volume.
+// For an attached volume, CheckController adds or removes replicas.
+func (man *volumeManager) UpdateReplicaCount(name string, count int) error {
+	if count < 1 {
+		return errors.Errorf("invalid number of replicas %v, volume '%s'", count, name)
+	}
+
+	lock, err := man.lockVolume(name, "updateReplicaCount")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	var volume *types.VolumeInfo
+	if err := retryOnConflict(func() error {
+		var err error
+		volume, err = man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.NumberOfReplicas = count
+		if err := man.orc.UpdateVolume(volume); err != nil {
+			return errors.Wrapf(err, "unable to update volume '%s'", name)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if volume.Controller != nil {
+		return nil
+	}
+
+	goodReplicas := []*types.ReplicaInfo{}
+	for _, replica := range volume.Replicas {
+		if replica.BadTimestamp == "" {
+			goodReplicas = append(goodReplicas, replica)
+		}
+	}
+	if len(goodReplicas) <= count {
+		return nil
+	}
+	for _, replica := range pickReplicasToRemove(goodReplicas, len(goodReplicas)-count) {
+		if err := man.removeReplicaInstance(name, replica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (man *volumeManager) Cleanup(v *types.VolumeInfo) error {
+	lock, err := man.lockVolume(v.Name, "cleanup")
+	if err != nil {
+		if kvstore.IsLockedError(err) || IsTransitionError(err) || IsShuttingDown(err) {
+			// Another operation is in progress, clean up next time
+			logrus.Debugf("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer lock.Unlock()
+
 	volume, err := man.Get(v.Name)
 	if err != nil {
 		return errors.Wrapf(err, "error getting volume '%s'", v.Name)
@@ -541,6 +1133,7 @@ func (man *volumeManager) Cleanup(v *types.VolumeInfo) error {
 	}
 	logrus.Infof("running cleanup, volume '%s'", volume.Name)
 	now := time.Now().UTC()
+	timeout := man.staleReplicaTimeout(volume)
 	errCh := make(chan error)
 	wg := &sync.WaitGroup{}
 	for _, replica := range volume.Replicas {
@@ -563,7 +1156,7 @@ func (man *volumeManager) Cleanup(v *types.VolumeInfo) error {
 				errCh <- errors.Wrapf(err, "fail to parse bad timestamp %v", replica.BadTimestamp)
 				return
 			}
-			if badTime.Add(KeepBadReplicasPeriod).Before(now) {
+			if badTime.Add(timeout).Before(now) {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
@@ -608,11 +1201,58 @@ func (man *volumeManager) SnapshotOps(name string) (types.SnapshotOps, error) {
 }
 
 func (man *volumeManager) ListHosts() (map[string]*types.HostInfo, error) {
-	return man.orc.ListHosts()
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	if err := man.fillDiskProvisioned(hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
 }
 
 func (man *volumeManager) GetHost(id string) (*types.HostInfo, error) {
-	return man.orc.GetHost(id)
+	host, err := man.orc.GetHost(id)
+	if err != nil || host == nil {
+		return host, err
+	}
+	if err := man.fillDiskProvisioned(map[string]*types.HostInfo{id: host}); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+func (man *volumeManager) fillDiskProvisioned(hosts map[string]*types.HostInfo) error {
+	loads, err := man.orc.ListHostLoads()
+	if err != nil {
+		return errors.Wrap(err, "failed to list host loads")
+	}
+	for id, host := range hosts {
+		load := loads[id]
+		if load == nil {
+			continue
+		}
+		for diskID, disk := range host.Disks {
+			disk.StorageProvisioned = load.DiskProvisioned[diskID]
+		}
+	}
+	return nil
+}
+
+// UpdateDisk only works on the current host, since the host record is only
+// written by its own manager
+func (man *volumeManager) UpdateDisk(hostID, diskID string, tags []string, schedulable bool) (*types.HostInfo, error) {
+	if currentHostID := man.orc.GetCurrentHostID(); hostID != currentHostID {
+		return nil, errors.Errorf("cannot update disk '%s' of host '%s' on host '%s'", diskID, hostID, currentHostID)
+	}
+	host, err := man.orc.UpdateDisk(diskID, tags, schedulable)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to update disk '%s'", diskID)
+	}
+	if err := man.fillDiskProvisioned(map[string]*types.HostInfo{hostID: host}); err != nil {
+		return nil, err
+	}
+	return host, nil
 }
 
 func (man *volumeManager) VolumeBackupOps(name string) (types.VolumeBackupOps, error) {
@@ -620,13 +1260,56 @@ func (man *volumeManager) VolumeBackupOps(name string) (types.VolumeBackupOps, e
 	if err != nil {
 		return nil, err
 	}
-	return controller.BackupOps(), nil
+	return &volumeBackupOps{
+		VolumeBackupOps: controller.BackupOps(),
+		ctrl:            controller,
+		events:          man.orc,
+		volumeName:      name,
+	}, nil
+}
+
+// volumeBackupOps records the result of the backups started from the API,
+// the same as the recurring ones
+type volumeBackupOps struct {
+	types.VolumeBackupOps
+
+	ctrl       types.Controller
+	events     types.EventLog
+	volumeName string
+}
+
+func (b *volumeBackupOps) StartBackup(snapName, backupTarget string) error {
+	snap, err := b.ctrl.SnapshotOps().Get(snapName)
+	if err != nil {
+		return errors.Wrapf(err, "error getting snapshot '%s', volume '%s'", snapName, b.volumeName)
+	}
+	if snap == nil {
+		return errors.Errorf("could not find snapshot '%s' to backup, volume '%s'", snapName, b.volumeName)
+	}
+	b.ctrl.BgTaskQueue().Put(&types.BgTask{Task: &types.BackupBgTask{
+		Snapshot:     snapName,
+		BackupTarget: backupTarget,
+		DoneHook:     backupDoneHook(b.events, b.volumeName, snapName),
+	}})
+	return nil
 }
 
 func (man *volumeManager) Settings() types.Settings {
 	return man.settings
 }
 
+func (man *volumeManager) KVArchiver() types.KVArchiver {
+	return man.orc
+}
+
+func (man *volumeManager) EventLog() types.EventLog {
+	return man.orc
+}
+
+func (man *volumeManager) GetLeader() (string, error) {
+	return man.orc.GetLeader()
+}
+
 func (man *volumeManager) ManagerBackupOps(backupTarget string) types.ManagerBackupOps {
 	return man.getBackups(backupTarget)
 }
@@ -639,22 +1322,43 @@ func (man *volumeManager) ProcessSchedule(spec *types.ScheduleSpec, item *types.
 	return scheduler.Process(spec, item)
 }
 
+// ExplainSchedule evaluates the hosts for a new replica of the volume, or of
+// spec if name is empty
+func (man *volumeManager) ExplainSchedule(name string, spec *types.VolumeInfo) ([]*types.ScheduleCandidate, error) {
+	volume := spec
+	if name != "" {
+		v, err := man.orc.GetVolume(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if v == nil {
+			return nil, errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume = v
+	}
+	if volume == nil {
+		return nil, errors.Errorf("either a volume or a spec is required to explain the schedule")
+	}
+	return man.orc.ExplainReplicaSchedule(volume)
+}
+
 func (man *volumeManager) ReplicaRemove(volumeName, replicaName string) error {
+	lock, err := man.lockVolume(volumeName, "replicaRemove")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	volume, err := man.Get(volumeName)
 	if err != nil {
 		return errors.Wrapf(err, "fail to remove replica %v of volume %v", replicaName, volumeName)
 	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume %v", volumeName)
+	}
 	replica := volume.Replicas[replicaName]
 	if replica == nil {
 		return errors.Errorf("cannot find replica %v of volume %v", replicaName, volumeName)
 	}
-	if replica.Running {
-		if _, err := man.orc.StopInstance(&replica.InstanceInfo); err != nil {
-			logrus.Warnf("cannot stop replica %v of volume %v, push on", replicaName, volumeName)
-		}
-	}
-	if _, err := man.orc.RemoveInstance(&replica.InstanceInfo); err != nil {
-		return errors.Wrapf(err, "fail to remove replica %v of volume %v", replicaName, volumeName)
-	}
-	return nil
+	return man.removeReplicaInstance(volumeName, replica)
 }
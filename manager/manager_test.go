@@ -0,0 +1,948 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testReplica(name, hostID string, mode types.ReplicaMode) *types.ReplicaInfo {
+	return &types.ReplicaInfo{
+		InstanceInfo: types.InstanceInfo{
+			Name:   name,
+			HostID: hostID,
+		},
+		Mode: mode,
+	}
+}
+
+func replicaNames(replicas []*types.ReplicaInfo) []string {
+	names := []string{}
+	for _, r := range replicas {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func TestPickReplicasToRemove(t *testing.T) {
+	assert := require.New(t)
+
+	replicas := []*types.ReplicaInfo{
+		testReplica("r1", "host1", types.ReplicaModeRW),
+		testReplica("r2", "host1", types.ReplicaModeRW),
+		testReplica("r3", "host2", types.ReplicaModeRW),
+		testReplica("r4", "host3", types.ReplicaModeWO),
+	}
+
+	// The rebuilding one goes first, then the one sharing host1
+	assert.Equal([]string{"r4"}, replicaNames(pickReplicasToRemove(replicas, 1)))
+	assert.Equal([]string{"r4", "r2"}, replicaNames(pickReplicasToRemove(replicas, 2)))
+	assert.Equal([]string{"r4", "r2", "r3"}, replicaNames(pickReplicasToRemove(replicas, 3)))
+	assert.Len(pickReplicasToRemove(replicas, 10), 4)
+	assert.Len(pickReplicasToRemove(replicas, 0), 0)
+	assert.Len(replicas, 4)
+
+	// Without modes, e.g. detached, only the spread matters
+	replicas = []*types.ReplicaInfo{
+		testReplica("r1", "host1", ""),
+		testReplica("r2", "host2", ""),
+		testReplica("r3", "host2", ""),
+		testReplica("r4", "host2", ""),
+	}
+	assert.Equal([]string{"r4", "r3"}, replicaNames(pickReplicasToRemove(replicas, 2)))
+}
+
+type testSettings struct {
+	settings *types.SettingsInfo
+}
+
+func (s *testSettings) GetSettings() (*types.SettingsInfo, error) {
+	return s.settings, nil
+}
+
+func (s *testSettings) SetSettings(settings *types.SettingsInfo) error {
+	s.settings = settings
+	return nil
+}
+
+func TestStaleReplicaTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	settings := &testSettings{settings: &types.SettingsInfo{}}
+	man := &volumeManager{settings: settings}
+	volume := &types.VolumeInfo{
+		Name: "vol",
+		Replicas: map[string]*types.ReplicaInfo{
+			"r1": {
+				BadTimestamp: "2017-06-01T10:00:00Z",
+			},
+			"r2": {},
+		},
+	}
+
+	assert.Equal(KeepBadReplicasPeriod, man.staleReplicaTimeout(volume))
+
+	settings.settings.StaleReplicaTimeout = 30
+	assert.Equal(30*time.Minute, man.staleReplicaTimeout(volume))
+
+	volume.StaleReplicaTimeout = 10 * time.Minute
+	assert.Equal(10*time.Minute, man.staleReplicaTimeout(volume))
+
+	man.completeVolumeState(volume)
+	assert.Equal("2017-06-01T10:10:00Z", volume.Replicas["r1"].GCTimestamp)
+	assert.Equal("", volume.Replicas["r2"].GCTimestamp)
+}
+
+func TestChooseSalvageReplica(t *testing.T) {
+	assert := require.New(t)
+
+	chosen, _ := chooseSalvageReplica([]*types.SalvageCandidate{
+		{Replica: "r1", Error: "not responding"},
+	})
+	assert.Nil(chosen)
+
+	candidates := []*types.SalvageCandidate{
+		{Replica: "r1", RevisionCounter: 10, Chain: []string{"head", "snap1"}, BadTimestamp: "2017-06-01T10:00:00Z"},
+		{Replica: "r2", RevisionCounter: 12, Chain: []string{"head"}, BadTimestamp: "2017-06-01T09:00:00Z"},
+		{Replica: "r3", Error: "not responding"},
+	}
+	chosen, reason := chooseSalvageReplica(candidates)
+	assert.Equal("r2", chosen.Replica)
+	assert.Contains(reason, "revision counter")
+
+	candidates[1].RevisionCounter = 10
+	chosen, reason = chooseSalvageReplica(candidates)
+	assert.Equal("r1", chosen.Replica)
+	assert.Contains(reason, "snapshot chain")
+
+	candidates[1].Chain = []string{"head", "snap1"}
+	chosen, reason = chooseSalvageReplica(candidates)
+	assert.Equal("r1", chosen.Replica)
+	assert.Contains(reason, "failed last")
+
+	// The candidates are not reordered
+	assert.Equal("r2", candidates[1].Replica)
+}
+
+func TestVolumeTransitions(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	man := &volumeManager{orc: orc}
+	volume := &types.VolumeInfo{Name: "vol"}
+
+	// Volumes from before the state was persisted
+	assert.Equal(types.VolumeStateAttached, currentState(&types.VolumeInfo{Name: "vol", Controller: &types.ControllerInfo{}}))
+
+	orc.setVolume(&types.VolumeInfo{Name: "vol", CurrentState: types.VolumeStateRestoring})
+	err := man.beginTransition(volume, "detach", types.VolumeStateDetaching, types.VolumeStateDetached)
+	assert.True(IsTransitionError(err))
+	assert.Equal("cannot detach volume 'vol' while it's restoring", err.Error())
+	assert.Equal(types.VolumeStateRestoring, orc.volume("vol").CurrentState)
+	assert.Equal(types.VolumeStateRestoring, volumeState(orc.volume("vol")))
+	assert.Nil(man.beginTransition(volume, "delete", types.VolumeStateDeleting, types.VolumeStateNone))
+	assert.Equal(types.VolumeStateDeleting, orc.volume("vol").CurrentState)
+
+	orc.setVolume(&types.VolumeInfo{Name: "vol", CurrentState: types.VolumeStateDetached})
+	assert.Nil(man.beginTransition(volume, "attach", types.VolumeStateAttaching, types.VolumeStateAttached))
+	assert.Equal(types.VolumeStateAttaching, orc.volume("vol").CurrentState)
+	assert.Equal(types.VolumeStateAttached, orc.volume("vol").DesiredState)
+	assert.Equal(types.VolumeStateAttaching, volume.CurrentState)
+	assert.NotNil(man.transitVolume(volume, types.VolumeStateDetaching))
+	assert.Nil(man.transitVolume(volume, types.VolumeStateAttached))
+	assert.Equal(types.VolumeStateAttached, orc.volume("vol").CurrentState)
+
+	// Left attaching by a dead manager, abandoned
+	orc.setVolume(&types.VolumeInfo{Name: "vol", CurrentState: types.VolumeStateAttaching})
+	assert.Nil(man.beginTransition(volume, "detach", types.VolumeStateDetaching, types.VolumeStateNone))
+	assert.Equal(types.VolumeStateDetaching, orc.volume("vol").CurrentState)
+	assert.Equal(types.VolumeStateNone, orc.volume("vol").DesiredState)
+	v := orc.volume("vol")
+	v.Controller = &types.ControllerInfo{}
+	orc.setVolume(v)
+	man.abortTransition(volume)
+	assert.Equal(types.VolumeStateAttached, orc.volume("vol").CurrentState)
+
+	orc.setVolume(&types.VolumeInfo{Name: "vol", CurrentState: types.VolumeStateCreating})
+	err = man.beginTransition(volume, "attach", types.VolumeStateAttaching, types.VolumeStateAttached)
+	assert.True(IsTransitionError(err))
+}
+
+func TestRestoreStatus(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	man := &volumeManager{orc: orc}
+
+	orc.setVolume(&types.VolumeInfo{Name: "vol"})
+	assert.NotNil(man.updateRestoreStatus("vol", func(status *types.RestoreStatus) {}))
+
+	orc.setVolume(&types.VolumeInfo{
+		Name:          "vol",
+		CurrentState:  types.VolumeStateRestoring,
+		RestoreStatus: &types.RestoreStatus{Backup: "backup"},
+	})
+	man.setRestorePhase("vol", types.RestorePhaseRestoring)
+	assert.Equal(types.RestorePhaseRestoring, orc.volume("vol").RestoreStatus.Phase)
+	// Unknown while a backup is restored
+	assert.Nil(orc.volume("vol").RestoreStatus.Progress)
+	man.setRestoreProgress("vol", 50)
+	assert.Equal(50, *orc.volume("vol").RestoreStatus.Progress)
+	assert.Nil(man.updateRestoreStatus("vol", func(status *types.RestoreStatus) {
+		status.Error = "failed"
+	}))
+	v := orc.volume("vol")
+	assert.Equal("failed", v.RestoreStatus.Error)
+	assert.Equal("backup", v.RestoreStatus.Backup)
+	assert.Equal(types.VolumeStateRestoring, volumeState(v))
+}
+
+func TestReconcileOrphans(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	orc.orphans = []*types.InstanceInfo{
+		{ID: "c1", Name: "vol-replica-1", VolumeName: "vol"},
+	}
+	man := &volumeManager{
+		orc:             orc,
+		settings:        orc,
+		reportedOrphans: map[string]struct{}{},
+	}
+
+	// Reported only once by default
+	assert.Nil(man.reconcileOrphans())
+	assert.Nil(man.reconcileOrphans())
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonOrphanFound, orc.events[0].Reason)
+	assert.Empty(orc.removed)
+
+	orc.orphans = append(orc.orphans, &types.InstanceInfo{ID: "c2", Name: "vol-controller", VolumeName: "vol"})
+	assert.Nil(man.reconcileOrphans())
+	assert.Len(orc.events, 2)
+
+	orc.settings.OrphanPolicy = types.OrphanPolicyRemove
+	assert.Nil(man.reconcileOrphans())
+	assert.Equal([]string{"c1", "c2"}, orc.removed)
+	assert.Len(orc.events, 4)
+	assert.Equal(types.EventReasonOrphanRemoved, orc.events[3].Reason)
+}
+
+func TestShutdown(t *testing.T) {
+	assert := require.New(t)
+
+	man := &volumeManager{
+		monitors:     map[string]types.Monitor{},
+		stopCh:       make(chan struct{}),
+		electionDone: make(chan struct{}),
+	}
+	close(man.electionDone)
+
+	release := make(chan struct{})
+	finished := false
+	assert.Nil(man.goBackground(func() {
+		<-release
+		finished = true
+	}))
+
+	done := make(chan error)
+	go func() {
+		done <- man.Shutdown(time.Minute)
+	}()
+	select {
+	case <-done:
+		assert.FailNow("shutdown didn't wait for the background operation")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	assert.Nil(<-done)
+	assert.True(finished)
+
+	err := man.goBackground(func() {})
+	assert.True(IsShuttingDown(err))
+	_, err = man.lockVolume("vol", "attach")
+	assert.True(IsShuttingDown(err))
+	assert.True(IsShuttingDown(man.Shutdown(time.Minute)))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	man := &volumeManager{
+		orc:          orc,
+		monitors:     map[string]types.Monitor{},
+		stopCh:       make(chan struct{}),
+		electionDone: make(chan struct{}),
+	}
+	close(man.electionDone)
+
+	lock, err := man.lockVolume("vol", "restore")
+	assert.Nil(err)
+	release := make(chan struct{})
+	checked := make(chan error)
+	assert.Nil(man.goBackground(func() {
+		defer lock.Unlock()
+		<-release
+		checked <- man.checkVolumeLock("vol")
+	}))
+
+	// The operation is still running at the deadline
+	assert.Nil(man.Shutdown(100 * time.Millisecond))
+	assert.Empty(orc.locks)
+	// Another manager may take the lock right away
+	assert.Nil(orc.TryLock(volumeLockName("vol"), "host-2/attach", VolumeLockTTL))
+
+	close(release)
+	assert.True(IsShuttingDown(<-checked))
+	man.background.Wait()
+	// The lock of the other manager is left alone
+	assert.Equal("host-2/attach", orc.locks[volumeLockName("vol")])
+	assert.Empty(man.volumeLocks)
+}
+
+func TestFailoverVolumes(t *testing.T) {
+	assert := require.New(t)
+
+	controller := func(id, hostID string) *types.ControllerInfo {
+		return &types.ControllerInfo{InstanceInfo: types.InstanceInfo{ID: id, HostID: hostID}}
+	}
+	orc := newFakeOrc()
+	orc.hosts["host-2"] = &types.HostInfo{UUID: "host-2", State: types.HostStateDown}
+	orc.setVolume(&types.VolumeInfo{Name: "up", Controller: controller("c1", "host-1")})
+	orc.setVolume(&types.VolumeInfo{Name: "detached"})
+	orc.setVolume(&types.VolumeInfo{Name: "down", Controller: controller("c2", "host-2")})
+	orc.lockErr = fmt.Errorf("kvstore unavailable")
+	man := &volumeManager{orc: orc}
+	reported := map[string]string{}
+
+	// Reported only once per controller without the failover policy
+	man.failoverVolumes(reported)
+	man.failoverVolumes(reported)
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonHostDown, orc.events[0].Reason)
+	assert.Equal("down", orc.events[0].Volume)
+
+	down := orc.volume("down")
+	down.Controller = controller("c3", "host-2")
+	orc.setVolume(down)
+	man.failoverVolumes(reported)
+	assert.Len(orc.events, 2)
+
+	// The failure to fail over is reported once as well
+	down.FailoverPolicy = types.FailoverPolicyReattach
+	down.Controller = controller("c4", "host-2")
+	orc.setVolume(down)
+	man.failoverVolumes(reported)
+	man.failoverVolumes(reported)
+	assert.Len(orc.events, 3)
+	assert.Equal(types.EventReasonFailoverFailed, orc.events[2].Reason)
+
+	// Forgotten once the host is back
+	orc.hosts["host-2"].State = types.HostStateUp
+	man.failoverVolumes(reported)
+	assert.Empty(reported)
+}
+
+func TestExplainSchedule(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	orc.candidates = []*types.ScheduleCandidate{{HostID: "host-1", Score: 100}}
+	orc.setVolume(&types.VolumeInfo{Name: "vol", Size: 1024})
+	man := &volumeManager{orc: orc, settings: orc}
+
+	// The volume is read from the key value store
+	candidates, err := man.ExplainSchedule("vol", nil)
+	assert.Nil(err)
+	assert.Len(candidates, 1)
+	assert.Equal("vol", orc.explained.Name)
+	assert.Equal(int64(1024), orc.explained.Size)
+
+	// The spec is evaluated as is
+	spec := &types.VolumeInfo{Size: 2048, DiskSelector: []string{"ssd"}}
+	_, err = man.ExplainSchedule("", spec)
+	assert.Nil(err)
+	assert.Equal(spec, orc.explained)
+
+	_, err = man.ExplainSchedule("", nil)
+	assert.NotNil(err)
+	_, err = man.ExplainSchedule("missing", nil)
+	assert.NotNil(err)
+
+	// Nothing is scheduled or recorded
+	assert.Equal(0, orc.getWrites())
+	assert.Empty(orc.started)
+	assert.Empty(orc.locks)
+	assert.Empty(orc.events)
+}
+
+func TestVolumeLockLost(t *testing.T) {
+	assert := require.New(t)
+
+	defer func(ttl time.Duration) {
+		VolumeLockTTL = ttl
+	}(VolumeLockTTL)
+	VolumeLockTTL = 300 * time.Millisecond
+
+	orc := newFakeOrc()
+	orc.setVolume(&types.VolumeInfo{Name: "vol", CurrentState: types.VolumeStateDetached})
+	man := &volumeManager{orc: orc, settings: orc}
+
+	lock, err := man.lockVolume("vol", "attach")
+	assert.Nil(err)
+	volume, err := man.Get("vol")
+	assert.Nil(err)
+	assert.Nil(man.beginTransition(volume, "attach", types.VolumeStateAttaching, types.VolumeStateAttached))
+
+	// Taken over by another manager, e.g. after the lease expired
+	lockName := volumeLockName("vol")
+	orc.mutex.Lock()
+	orc.locks[lockName] = "host-2/detach/1"
+	orc.mutex.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for lock.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NotNil(lock.Err())
+
+	// The operation can no longer move the volume on
+	assert.NotNil(man.transitVolume(volume, types.VolumeStateAttached))
+	v, err := orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateAttaching, v.CurrentState)
+
+	// The lock of the new holder is left alone
+	lock.Unlock()
+	assert.Equal("host-2/detach/1", orc.locks[lockName])
+	assert.Nil(man.checkVolumeLock("vol"))
+}
+
+func TestCleanupLocked(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	replica := testReplica("r1", "host-1", types.ReplicaModeERR)
+	replica.VolumeName = "vol"
+	replica.BadTimestamp = "2017-06-01T10:00:00Z"
+	orc.setVolume(&types.VolumeInfo{
+		Name:     "vol",
+		Replicas: map[string]*types.ReplicaInfo{"r1": replica},
+	})
+	man := &volumeManager{orc: orc, settings: orc}
+
+	// Another operation is in progress, clean up next time
+	orc.locks[volumeLockName("vol")] = "host-2/attach/1"
+	assert.Nil(man.Cleanup(&types.VolumeInfo{Name: "vol"}))
+	assert.Empty(orc.removed)
+
+	delete(orc.locks, volumeLockName("vol"))
+	assert.Nil(man.Cleanup(&types.VolumeInfo{Name: "vol"}))
+	assert.Equal([]string{"r1"}, orc.removed)
+	assert.Empty(orc.locks)
+}
+
+func TestVolumeBackupEvents(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	orc.setVolume(&types.VolumeInfo{Name: "vol"})
+	ctrl := newFakeController("vol-controller")
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return ctrl },
+	}
+
+	backups, err := man.VolumeBackupOps("vol")
+	assert.Nil(err)
+	assert.NotNil(backups.StartBackup("snap1", "s3://bucket@region/"))
+	assert.Empty(ctrl.tasks.List())
+
+	_, err = ctrl.SnapshotOps().Create("snap1", nil)
+	assert.Nil(err)
+	assert.Nil(backups.StartBackup("snap1", "s3://bucket@region/"))
+	tasks := ctrl.tasks.List()
+	assert.Len(tasks, 1)
+	task := tasks[0].Task.(*types.BackupBgTask)
+	assert.Equal("snap1", task.Snapshot)
+	assert.NotNil(task.DoneHook)
+
+	task.DoneHook(nil)
+	task.DoneHook(fmt.Errorf("target unreachable"))
+	assert.Len(orc.events, 2)
+	assert.Equal(types.EventReasonBackupCompleted, orc.events[0].Reason)
+	assert.Equal(types.EventReasonBackupFailed, orc.events[1].Reason)
+	assert.Equal("vol", orc.events[1].Volume)
+}
+
+func testAttachedVolume(name string) *types.VolumeInfo {
+	replica := testReplica("r1", "host-1", types.ReplicaModeRW)
+	replica.VolumeName = name
+	return &types.VolumeInfo{
+		Name:             name,
+		Size:             1024,
+		NumberOfReplicas: 1,
+		Controller: &types.ControllerInfo{
+			InstanceInfo: types.InstanceInfo{
+				Name:       name + "-controller",
+				HostID:     "host-1",
+				Running:    true,
+				VolumeName: name,
+			},
+		},
+		Replicas: map[string]*types.ReplicaInfo{"r1": replica},
+	}
+}
+
+func TestExpand(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	ctrl := newFakeController("vol-controller")
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return ctrl },
+	}
+
+	orc.setVolume(testAttachedVolume("vol"))
+	assert.NotNil(man.Expand("vol", 512))
+
+	// The engine doesn't report the size, so it cannot expand
+	err := man.Expand("vol", 2048)
+	assert.NotNil(err)
+	assert.Empty(ctrl.expanded)
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonExpandFailed, orc.events[0].Reason)
+	v, err := orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Equal(int64(1024), v.Size)
+
+	ctrl.size = 1024
+	assert.Nil(man.Expand("vol", 2048))
+	assert.Equal([]int64{2048}, ctrl.expanded)
+	assert.Equal(types.EventReasonExpanded, orc.events[1].Reason)
+	v, err = orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Equal(int64(2048), v.Size)
+
+	// Detached, only the size is updated
+	orc.setVolume(&types.VolumeInfo{
+		Name:             "detached",
+		Size:             1024,
+		NumberOfReplicas: 1,
+		Replicas:         map[string]*types.ReplicaInfo{"r1": testReplica("r1", "host-1", types.ReplicaModeRW)},
+	})
+	assert.Nil(man.Expand("detached", 4096))
+	assert.Equal([]int64{2048}, ctrl.expanded)
+	v, err = orc.GetVolume("detached")
+	assert.Nil(err)
+	assert.Equal(int64(4096), v.Size)
+	assert.Empty(orc.locks)
+}
+
+func TestExpandOnAttach(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	ctrl := newFakeController("vol-controller")
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return ctrl },
+	}
+	volume := testAttachedVolume("vol")
+
+	man.expandOnAttach(volume)
+	assert.Empty(ctrl.expanded)
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonExpandFailed, orc.events[0].Reason)
+
+	ctrl.size = 1024
+	man.expandOnAttach(volume)
+	assert.Empty(ctrl.expanded)
+	assert.Len(orc.events, 1)
+
+	ctrl.size = 512
+	man.expandOnAttach(volume)
+	assert.Equal([]int64{1024}, ctrl.expanded)
+	assert.Len(orc.events, 2)
+	assert.Equal(types.EventReasonExpanded, orc.events[1].Reason)
+
+	ctrl.size = 512
+	ctrl.expandErr = fmt.Errorf("engine failure")
+	man.expandOnAttach(volume)
+	assert.Len(orc.events, 3)
+	assert.Equal(types.EventReasonExpandFailed, orc.events[2].Reason)
+}
+
+func TestCreateFromSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	orc.settings = &types.SettingsInfo{EngineImage: "engine"}
+	controllers := map[string]*fakeController{
+		"src":  newFakeController("src-controller"),
+		"vol":  newFakeController("vol-controller"),
+		"vol2": newFakeController("vol2-controller"),
+	}
+	man := &volumeManager{
+		orc:      orc,
+		settings: orc,
+		getController: func(volume *types.VolumeInfo) types.Controller {
+			if volume.Controller == nil || !volume.Controller.Running {
+				return nil
+			}
+			return controllers[volume.Name]
+		},
+		monitors: map[string]types.Monitor{},
+		monitor:  func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor { return nil },
+	}
+	src := controllers["src"]
+	from := &types.SnapshotSource{Volume: "src", Snapshot: "snap1"}
+
+	_, err := man.Create(&types.VolumeInfo{Name: "vol", NumberOfReplicas: 2, FromSnapshot: from})
+	assert.NotNil(err)
+
+	// The source must be attached
+	orc.setVolume(&types.VolumeInfo{
+		Name:             "src",
+		Size:             2048,
+		NumberOfReplicas: 1,
+		Replicas:         map[string]*types.ReplicaInfo{"r1": testReplica("r1", "host-1", types.ReplicaModeRW)},
+	})
+	_, err = man.Create(&types.VolumeInfo{Name: "vol", NumberOfReplicas: 2, FromSnapshot: from})
+	assert.NotNil(err)
+
+	srcVolume := testAttachedVolume("src")
+	srcVolume.Size = 2048
+	orc.setVolume(srcVolume)
+	_, err = man.Create(&types.VolumeInfo{Name: "vol", NumberOfReplicas: 2, FromSnapshot: from})
+	assert.NotNil(err)
+	assert.Nil(orc.volumes["vol"])
+	assert.Empty(orc.locks)
+
+	// No backup target is needed
+	_, err = src.SnapshotOps().Create("snap1", nil)
+	assert.Nil(err)
+	vol, err := man.Create(&types.VolumeInfo{Name: "vol", NumberOfReplicas: 2, FromSnapshot: from})
+	assert.Nil(err)
+	assert.Equal(int64(2048), vol.Size)
+	assert.NotNil(vol.RestoreStatus)
+	man.background.Wait()
+
+	// Each replica is rebuilt by the source controller, then taken out of
+	// it, and the new volume is reverted to the snapshot
+	replicas := []string{}
+	for name := range vol.Replicas {
+		replicas = append(replicas, name)
+	}
+	sort.Strings(replicas)
+	sort.Strings(src.added)
+	assert.Equal(replicas, src.added)
+	assert.Empty(src.replicas)
+	assert.Equal([]string{"snap1"}, controllers["vol"].reverted)
+	assert.Empty(controllers["vol"].restored)
+	v, err := man.Get("vol")
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateDetached, v.State)
+	assert.Equal("", v.RestoreStatus.Backup)
+	assert.Equal("", v.RestoreStatus.Error)
+	assert.Equal(types.RestorePhaseDone, v.RestoreStatus.Phase)
+	assert.Equal(100, *v.RestoreStatus.Progress)
+	assert.NotEqual("", v.RestoreStatus.Finished)
+	assert.Nil(v.Controller)
+	for _, r := range v.Replicas {
+		assert.False(r.Running)
+	}
+	assert.Equal(types.EventReasonRestored, orc.events[len(orc.events)-1].Reason)
+	assert.Empty(orc.locks)
+
+	// The volume is left restoring with the error if the copy fails
+	src.addErr = fmt.Errorf("replica unreachable")
+	_, err = man.Create(&types.VolumeInfo{Name: "vol2", NumberOfReplicas: 1, FromSnapshot: from})
+	assert.Nil(err)
+	man.background.Wait()
+	v, err = man.Get("vol2")
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateRestoring, v.State)
+	assert.Contains(v.RestoreStatus.Error, "replica unreachable")
+	assert.Equal(types.RestorePhaseCopying, v.RestoreStatus.Phase)
+	assert.Equal(0, *v.RestoreStatus.Progress)
+	assert.Empty(controllers["vol2"].reverted)
+	assert.Equal(types.EventReasonRestoreFailed, orc.events[len(orc.events)-1].Reason)
+	assert.Empty(orc.locks)
+
+	// The source is locked while it's copied
+	src.addErr = nil
+	orc.locks[volumeLockName("src")] = "host-2/detach/1"
+	_, err = man.Create(&types.VolumeInfo{Name: "vol3", NumberOfReplicas: 1, FromSnapshot: from})
+	assert.NotNil(err)
+	assert.Nil(orc.volumes["vol3"])
+}
+
+func TestAttachAllReplicasBad(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return nil },
+		monitors:      map[string]types.Monitor{},
+		monitor:       func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor { return nil },
+	}
+	replicas := map[string]*types.ReplicaInfo{}
+	for name, badTimestamp := range map[string]string{
+		"r1": "2017-06-01T10:00:00Z",
+		"r2": "2017-06-01T12:00:00Z",
+		"r3": "2017-06-01T11:00:00Z",
+	} {
+		replica := testReplica(name, "host-1", types.ReplicaModeERR)
+		replica.VolumeName = "vol"
+		replica.BadTimestamp = badTimestamp
+		replicas[name] = replica
+	}
+	orc.setVolume(&types.VolumeInfo{Name: "vol", NumberOfReplicas: 3, Replicas: replicas})
+
+	// The replica failed last is the most up to date one
+	volume, err := orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Nil(man.doAttach(volume))
+	assert.Equal([]string{"r2", "vol-controller"}, orc.started)
+	assert.NotNil(volume.Controller)
+}
+
+func TestReconcileCurrentHost(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	man := &volumeManager{orc: orc, settings: orc, reportedOrphans: map[string]struct{}{}}
+	orc.setVolume(testAttachedVolume("attached"))
+	orc.setVolume(&types.VolumeInfo{
+		Name:     "replica",
+		Replicas: map[string]*types.ReplicaInfo{"r1": testReplica("r1", "host-1", types.ReplicaModeRW)},
+	})
+	orc.setVolume(&types.VolumeInfo{
+		Name:     "other",
+		Replicas: map[string]*types.ReplicaInfo{"r1": testReplica("r1", "host-2", types.ReplicaModeRW)},
+	})
+	orc.setVolume(&types.VolumeInfo{Name: "empty"})
+
+	writes := orc.getWrites()
+	man.reconcile()
+	assert.Equal([]string{"attached", "replica"}, orc.reconciled)
+	// Only the volumes on the current host are locked and unlocked
+	assert.Equal(writes+4, orc.getWrites())
+	assert.Empty(orc.locks)
+}
+
+func TestReconcileInterruptedRestore(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	man := &volumeManager{
+		orc:             orc,
+		settings:        orc,
+		reportedOrphans: map[string]struct{}{},
+		monitors:        map[string]types.Monitor{},
+	}
+	for _, name := range []string{"interrupted", "running"} {
+		volume := testAttachedVolume(name)
+		volume.CurrentState = types.VolumeStateRestoring
+		volume.RestoreStatus = &types.RestoreStatus{
+			Backup:  "vfs:///backup?backup=b1&volume=src",
+			Phase:   types.RestorePhaseRestoring,
+			Started: "2017-06-01T10:00:00Z",
+		}
+		orc.setVolume(volume)
+	}
+	// Still being restored by another manager
+	orc.locks[volumeLockName("running")] = "host-2/create/1"
+
+	man.reconcile()
+	v, err := orc.GetVolume("interrupted")
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateRestoring, v.CurrentState)
+	assert.Contains(v.RestoreStatus.Error, "interrupted in phase restoring")
+	assert.NotEqual("", v.RestoreStatus.Finished)
+	assert.Nil(v.Controller)
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonRestoreFailed, orc.events[0].Reason)
+
+	v, err = orc.GetVolume("running")
+	assert.Nil(err)
+	assert.Equal("", v.RestoreStatus.Error)
+	assert.NotNil(v.Controller)
+
+	// Failed once only
+	man.reconcile()
+	assert.Len(orc.events, 1)
+}
+
+func TestFailoverManagerDead(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	// Down for long, but the controller still answers
+	orc.hosts["host-2"] = &types.HostInfo{UUID: "host-2", Name: "host-2", State: types.HostStateDown,
+		LastHeartbeat: time.Now().Add(-2 * FenceWindow).UTC().Format(time.RFC3339)}
+	stopped := controller.ErrStillRunning
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return newFakeController(volume.Name) },
+		monitors:      map[string]types.Monitor{},
+		monitor:       func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor { return nil },
+		confirmStopped: func(controller *types.ControllerInfo) error {
+			return stopped
+		},
+	}
+	volume := testAttachedVolume("vol")
+	volume.FailoverPolicy = types.FailoverPolicyReattach
+	volume.Controller.ID = "c1"
+	volume.Controller.HostID = "host-2"
+	volume.Replicas["r1"].VolumeName = "vol"
+	orc.setVolume(volume)
+
+	// Only the manager of host-2 is dead, the controller is still running
+	reported := map[string]string{}
+	man.failoverVolumes(reported)
+	assert.Empty(orc.started)
+	v, err := orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Equal("host-2", v.Controller.HostID)
+	assert.Equal("", v.Replicas["r1"].BadTimestamp)
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonFailoverFailed, orc.events[0].Reason)
+	assert.Contains(orc.events[0].Message, "still running")
+	assert.Empty(orc.locks)
+
+	// The controller has stopped
+	stopped = nil
+	man.failoverVolumes(reported)
+	assert.Equal([]string{"r1", "vol-controller"}, orc.started)
+	v, err = orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Equal("host-1", v.Controller.HostID)
+	assert.Equal(types.EventReasonFailedOver, orc.events[len(orc.events)-1].Reason)
+	assert.Empty(orc.locks)
+}
+
+func TestFailoverFenceWindow(t *testing.T) {
+	assert := require.New(t)
+
+	orc := newFakeOrc()
+	heartbeat := func(ago time.Duration) string {
+		return time.Now().Add(-ago).UTC().Format(time.RFC3339)
+	}
+	orc.hosts["host-2"] = &types.HostInfo{UUID: "host-2", Name: "host-2", State: types.HostStateDown,
+		LastHeartbeat: heartbeat(FenceWindow / 2)}
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return newFakeController(volume.Name) },
+		monitors:      map[string]types.Monitor{},
+		monitor:       func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor { return nil },
+		confirmStopped: func(controller *types.ControllerInfo) error {
+			// The host is powered off or partitioned away
+			return fmt.Errorf("dial tcp %v:9501: i/o timeout", controller.Address)
+		},
+	}
+	volume := testAttachedVolume("vol")
+	volume.FailoverPolicy = types.FailoverPolicyReattach
+	volume.Controller.ID = "c1"
+	volume.Controller.HostID = "host-2"
+	volume.Controller.Address = "10.0.0.2"
+	orc.setVolume(volume)
+
+	// The host may not have fenced itself yet
+	reported := map[string]string{}
+	man.failoverVolumes(reported)
+	assert.Empty(orc.started)
+	assert.Len(orc.events, 1)
+	assert.Equal(types.EventReasonFailoverFailed, orc.events[0].Reason)
+	assert.Contains(orc.events[0].Message, "i/o timeout")
+
+	// Without a heartbeat there's no telling
+	orc.hosts["host-2"].LastHeartbeat = ""
+	man.failoverVolumes(reported)
+	assert.Empty(orc.started)
+
+	// Silent for longer than the fence window
+	orc.hosts["host-2"].LastHeartbeat = heartbeat(FenceWindow + time.Second)
+	man.failoverVolumes(reported)
+	assert.Equal([]string{"r1", "vol-controller"}, orc.started)
+	v, err := orc.GetVolume("vol")
+	assert.Nil(err)
+	assert.Equal("host-1", v.Controller.HostID)
+	assert.Equal(types.EventReasonFailedOver, orc.events[len(orc.events)-1].Reason)
+	assert.Empty(orc.locks)
+}
+
+func TestFailoverLoopWatchHosts(t *testing.T) {
+	assert := require.New(t)
+
+	defer func(interval, timeout time.Duration) {
+		FailoverInterval = interval
+		HostDownTimeout = timeout
+	}(FailoverInterval, HostDownTimeout)
+	// Only the watch can trigger the failover
+	FailoverInterval = time.Hour
+	HostDownTimeout = 200 * time.Millisecond
+
+	orc := newFakeOrc()
+	orc.hosts["host-2"] = &types.HostInfo{UUID: "host-2", Name: "host-2", State: types.HostStateUp}
+	man := &volumeManager{
+		orc:           orc,
+		settings:      orc,
+		getController: func(volume *types.VolumeInfo) types.Controller { return newFakeController(volume.Name) },
+		monitors:      map[string]types.Monitor{},
+		monitor:       func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor { return nil },
+		confirmStopped: func(controller *types.ControllerInfo) error {
+			return nil
+		},
+	}
+	volume := testAttachedVolume("vol")
+	volume.FailoverPolicy = types.FailoverPolicyReattach
+	volume.Controller.ID = "c1"
+	volume.Controller.HostID = "host-2"
+	orc.setVolume(volume)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		man.failoverLoop(stopCh)
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	// The heartbeats keep rearming the timer of the host
+	for i := 0; i < 8; i++ {
+		orc.heartbeats <- "host-2"
+		time.Sleep(HostDownTimeout / 4)
+	}
+	assert.Equal("host-2", orc.volume("vol").Controller.HostID)
+
+	// The heartbeats stop
+	orc.setHost(&types.HostInfo{UUID: "host-2", Name: "host-2", State: types.HostStateDown})
+	failedOver := func() bool {
+		v := orc.volume("vol")
+		return v.Controller != nil && v.Controller.HostID == "host-1"
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !failedOver() {
+		if time.Now().After(deadline) {
+			assert.FailNow("volume has not failed over")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
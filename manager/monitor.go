@@ -36,6 +36,14 @@ func (mc *monitorChan) CronCh() chan<- types.Event {
 	return mc.cronCh
 }
 
+func (mc *monitorChan) MonitorCh() chan<- types.Event {
+	return mc.monitorCh
+}
+
+func (mc *monitorChan) CleanupCh() chan<- types.Event {
+	return mc.cleanupCh
+}
+
 func Monitor(getController types.GetController) types.BeginMonitoring {
 	return func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor {
 		monitorCh := make(chan types.Event)
@@ -43,7 +51,7 @@ func Monitor(getController types.GetController) types.BeginMonitoring {
 		cleanupCh := make(chan types.Event)
 		go cleanup(volume, man, cleanupCh)
 		cronCh := make(chan types.Event)
-		go RunJobs(volume, getController(volume), man.Settings(), cronCh)
+		go RunJobs(volume, getController(volume), man.Settings(), man.EventLog(), cronCh)
 		return &monitorChan{volume: volume, cronCh: cronCh, monitorCh: monitorCh, cleanupCh: cleanupCh}
 	}
 }
@@ -58,6 +66,8 @@ func monitor(ctrl types.Controller, volume *types.VolumeInfo, man types.VolumeMa
 			defer ticker.Stop().Start()
 			if err := man.CheckController(ctrl, volume); err != nil {
 				if err, ok := err.(ControllerError); ok {
+					recordEvent(man.EventLog(), types.EventTypeWarning, types.EventReasonControllerFailed, volume.Name,
+						"controller failed: %v", err.Cause())
 					return errors.Wrapf(err.Cause(), "controller failed, volume '%s'", volume.Name)
 				}
 				if failedAttempts++; failedAttempts > MonitoringMaxRetries {
@@ -71,6 +81,8 @@ func monitor(ctrl types.Controller, volume *types.VolumeInfo, man types.VolumeMa
 		}(); err != nil {
 			close(ch)
 			logrus.Error(errors.Wrapf(err, "detaching volume"))
+			recordEvent(man.EventLog(), types.EventTypeWarning, types.EventReasonAutoDetached, volume.Name,
+				"detaching: %v", err)
 			if err := man.Detach(volume.Name); err != nil {
 				logrus.Errorf("%+v", errors.Wrapf(err, "error detaching failed volume '%s'", volume.Name))
 			}
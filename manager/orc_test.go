@@ -0,0 +1,559 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher/longhorn-manager/kvstore"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// fakeOrc is the Orchestrator of the manager tests, keeping everything in
+// memory. Every call changing anything counts in writes. The instances are
+// created on currentHost, and their names are recorded when started,
+// stopped or removed.
+type fakeOrc struct {
+	mutex sync.Mutex
+
+	currentHost string
+	volumes     map[string]*types.VolumeInfo
+	hosts       map[string]*types.HostInfo
+	settings    *types.SettingsInfo
+	locks       map[string]string
+	events      []*types.EventInfo
+	orphans     []*types.InstanceInfo
+	candidates  []*types.ScheduleCandidate
+
+	// lockErr fails TryLock if set, e.g. to lose the volume locks
+	lockErr error
+	// heartbeats are reported by WatchHosts
+	heartbeats chan string
+
+	writes     int
+	revision   int64
+	started    []string
+	stopped    []string
+	removed    []string
+	reconciled []string
+	explained  *types.VolumeInfo
+}
+
+func newFakeOrc() *fakeOrc {
+	return &fakeOrc{
+		currentHost: "host-1",
+		volumes:     map[string]*types.VolumeInfo{},
+		hosts: map[string]*types.HostInfo{
+			"host-1": {UUID: "host-1", Name: "host-1", Address: "10.0.0.1:9500", State: types.HostStateUp},
+		},
+		settings:   &types.SettingsInfo{},
+		locks:      map[string]string{},
+		heartbeats: make(chan string),
+	}
+}
+
+func copyVolume(volume *types.VolumeInfo) *types.VolumeInfo {
+	data, err := json.Marshal(volume)
+	if err != nil {
+		panic(err)
+	}
+	v := &types.VolumeInfo{}
+	if err := json.Unmarshal(data, v); err != nil {
+		panic(err)
+	}
+	v.ResourceVersion = volume.ResourceVersion
+	return v
+}
+
+// setVolume stores a copy of the volume as is
+func (o *fakeOrc) setVolume(volume *types.VolumeInfo) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.revision++
+	v := copyVolume(volume)
+	v.ResourceVersion = o.revision
+	o.volumes[v.Name] = v
+}
+
+// volume returns a copy of the volume stored, nil if there is none
+func (o *fakeOrc) setHost(host *types.HostInfo) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	h := *host
+	o.hosts[h.UUID] = &h
+}
+
+func (o *fakeOrc) volume(name string) *types.VolumeInfo {
+	v, _ := o.GetVolume(name)
+	return v
+}
+
+func (o *fakeOrc) getWrites() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.writes
+}
+
+func (o *fakeOrc) CreateVolume(volume *types.VolumeInfo) (*types.VolumeInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.volumes[volume.Name] != nil {
+		return nil, fmt.Errorf("volume %v already exists", volume.Name)
+	}
+	o.writes++
+	o.revision++
+	v := copyVolume(volume)
+	v.Controller = nil
+	v.Replicas = map[string]*types.ReplicaInfo{}
+	v.ResourceVersion = o.revision
+	o.volumes[v.Name] = v
+	volume.ResourceVersion = o.revision
+	return volume, nil
+}
+
+func (o *fakeOrc) DeleteVolume(volumeName string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.writes++
+	delete(o.volumes, volumeName)
+	return nil
+}
+
+func (o *fakeOrc) GetVolume(volumeName string) (*types.VolumeInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	v := o.volumes[volumeName]
+	if v == nil {
+		return nil, nil
+	}
+	return copyVolume(v), nil
+}
+
+func (o *fakeOrc) ListVolumes() ([]*types.VolumeInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	names := []string{}
+	for name := range o.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	volumes := []*types.VolumeInfo{}
+	for _, name := range names {
+		volumes = append(volumes, copyVolume(o.volumes[name]))
+	}
+	return volumes, nil
+}
+
+// updateReplica is called with lock held
+func (o *fakeOrc) updateReplica(volumeName string, replica *types.ReplicaInfo, f func(r *types.ReplicaInfo)) error {
+	v := o.volumes[volumeName]
+	if v == nil {
+		return fmt.Errorf("cannot find volume %v", volumeName)
+	}
+	for _, r := range v.Replicas {
+		if (replica.Name != "" && r.Name == replica.Name) ||
+			(replica.Name == "" && r.Address == replica.Address) {
+			o.writes++
+			f(r)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot find replica %v(%v) of volume %v", replica.Name, replica.Address, volumeName)
+}
+
+func (o *fakeOrc) MarkBadReplica(volumeName string, replica *types.ReplicaInfo) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.updateReplica(volumeName, replica, func(r *types.ReplicaInfo) {
+		if r.BadTimestamp == "" {
+			r.BadTimestamp = util.Now()
+		}
+	})
+}
+
+func (o *fakeOrc) ClearBadReplica(volumeName string, replica *types.ReplicaInfo) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.updateReplica(volumeName, replica, func(r *types.ReplicaInfo) {
+		r.BadTimestamp = ""
+	})
+}
+
+func (o *fakeOrc) SetReplicaRebuilding(volumeName string, replica *types.ReplicaInfo, rebuilding bool) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.updateReplica(volumeName, replica, func(r *types.ReplicaInfo) {
+		r.Rebuilding = rebuilding
+	})
+}
+
+// UpdateVolume updates the volume base, the same as the docker orchestrator
+func (o *fakeOrc) UpdateVolume(volume *types.VolumeInfo) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	v := o.volumes[volume.Name]
+	if v == nil {
+		return fmt.Errorf("cannot find volume %v", volume.Name)
+	}
+	if v.ResourceVersion != volume.ResourceVersion {
+		return kvstore.NewConflictError(volume.Name, volume.ResourceVersion)
+	}
+	o.writes++
+	o.revision++
+	updated := copyVolume(volume)
+	updated.Controller = v.Controller
+	updated.Replicas = v.Replicas
+	updated.ResourceVersion = o.revision
+	o.volumes[volume.Name] = updated
+	volume.ResourceVersion = o.revision
+	return nil
+}
+
+func (o *fakeOrc) CreateController(volumeName, controllerName string, replicas map[string]*types.ReplicaInfo) (*types.ControllerInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	v := o.volumes[volumeName]
+	if v == nil {
+		return nil, fmt.Errorf("cannot find volume %v", volumeName)
+	}
+	o.writes++
+	o.started = append(o.started, controllerName)
+	v.Controller = &types.ControllerInfo{
+		InstanceInfo: types.InstanceInfo{
+			ID:         controllerName + "-" + util.RandomID(),
+			Type:       types.InstanceTypeController,
+			Name:       controllerName,
+			HostID:     o.currentHost,
+			Address:    controllerName,
+			Running:    true,
+			VolumeName: volumeName,
+		},
+	}
+	c := *v.Controller
+	return &c, nil
+}
+
+func (o *fakeOrc) CreateReplica(volumeName, replicaName string) (*types.ReplicaInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	v := o.volumes[volumeName]
+	if v == nil {
+		return nil, fmt.Errorf("cannot find volume %v", volumeName)
+	}
+	o.writes++
+	r := &types.ReplicaInfo{
+		InstanceInfo: types.InstanceInfo{
+			ID:         replicaName + "-" + util.RandomID(),
+			Type:       types.InstanceTypeReplica,
+			Name:       replicaName,
+			HostID:     o.currentHost,
+			Address:    replicaName,
+			VolumeName: volumeName,
+		},
+	}
+	if v.Replicas == nil {
+		v.Replicas = map[string]*types.ReplicaInfo{}
+	}
+	v.Replicas[replicaName] = r
+	copied := *r
+	return &copied, nil
+}
+
+func (o *fakeOrc) ExplainReplicaSchedule(volume *types.VolumeInfo) ([]*types.ScheduleCandidate, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.explained = volume
+	return o.candidates, nil
+}
+
+// findInstance is called with lock held
+func (o *fakeOrc) findInstance(instance *types.InstanceInfo) (*types.VolumeInfo, *types.InstanceInfo) {
+	v := o.volumes[instance.VolumeName]
+	if v == nil {
+		return nil, nil
+	}
+	if v.Controller != nil && v.Controller.Name == instance.Name {
+		return v, &v.Controller.InstanceInfo
+	}
+	if r := v.Replicas[instance.Name]; r != nil {
+		return v, &r.InstanceInfo
+	}
+	return v, nil
+}
+
+func (o *fakeOrc) setRunning(instance *types.InstanceInfo, running bool) (*types.InstanceInfo, error) {
+	_, i := o.findInstance(instance)
+	if i == nil {
+		return nil, fmt.Errorf("cannot find instance %v of volume %v", instance.Name, instance.VolumeName)
+	}
+	o.writes++
+	i.Running = running
+	copied := *i
+	return &copied, nil
+}
+
+func (o *fakeOrc) StartInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.started = append(o.started, instance.Name)
+	return o.setRunning(instance, true)
+}
+
+func (o *fakeOrc) StopInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.stopped = append(o.stopped, instance.Name)
+	return o.setRunning(instance, false)
+}
+
+func (o *fakeOrc) RemoveInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	v, i := o.findInstance(instance)
+	if i == nil {
+		return nil, fmt.Errorf("cannot find instance %v of volume %v", instance.Name, instance.VolumeName)
+	}
+	o.writes++
+	o.removed = append(o.removed, instance.Name)
+	copied := *i
+	copied.Running = false
+	if v.Controller != nil && v.Controller.Name == instance.Name {
+		v.Controller = nil
+	} else {
+		delete(v.Replicas, instance.Name)
+	}
+	return &copied, nil
+}
+
+func (o *fakeOrc) ListHosts() (map[string]*types.HostInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	hosts := map[string]*types.HostInfo{}
+	for id, host := range o.hosts {
+		h := *host
+		hosts[id] = &h
+	}
+	return hosts, nil
+}
+
+func (o *fakeOrc) GetHost(id string) (*types.HostInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	host := o.hosts[id]
+	if host == nil {
+		return nil, nil
+	}
+	h := *host
+	return &h, nil
+}
+
+func (o *fakeOrc) ListHostLoads() (map[string]*types.HostLoad, error) {
+	return map[string]*types.HostLoad{}, nil
+}
+
+func (o *fakeOrc) UpdateDisk(diskID string, tags []string, schedulable bool) (*types.HostInfo, error) {
+	return nil, fmt.Errorf("cannot find disk %v on host %v", diskID, o.currentHost)
+}
+
+func (o *fakeOrc) Scheduler() types.Scheduler {
+	return nil
+}
+
+func (o *fakeOrc) GetCurrentHostID() string {
+	return o.currentHost
+}
+
+func (o *fakeOrc) GetAddress(hostID string) (string, error) {
+	host, _ := o.GetHost(hostID)
+	if host == nil {
+		return "", fmt.Errorf("cannot find host %v", hostID)
+	}
+	return host.Address, nil
+}
+
+func (o *fakeOrc) RunHeartbeat(stopCh <-chan struct{}) {
+	<-stopCh
+}
+
+func (o *fakeOrc) GetSettings() (*types.SettingsInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	settings := *o.settings
+	return &settings, nil
+}
+
+func (o *fakeOrc) SetSettings(settings *types.SettingsInfo) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.writes++
+	s := *settings
+	o.settings = &s
+	return nil
+}
+
+func (o *fakeOrc) watch(stopCh <-chan struct{}) {
+	<-stopCh
+}
+
+func (o *fakeOrc) WatchVolumes(stopCh <-chan struct{}) (<-chan string, error) {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		o.watch(stopCh)
+	}()
+	return ch, nil
+}
+
+func (o *fakeOrc) WatchHosts(stopCh <-chan struct{}) (<-chan string, error) {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case id := <-o.heartbeats:
+				select {
+				case ch <- id:
+				case <-stopCh:
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (o *fakeOrc) WatchSettings(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		o.watch(stopCh)
+	}()
+	return ch, nil
+}
+
+func (o *fakeOrc) MigrateKV(dryRun bool) ([]string, error) {
+	return nil, nil
+}
+
+func (o *fakeOrc) ExportKV() (*types.KVArchive, error) {
+	return nil, fmt.Errorf("export is not supported")
+}
+
+func (o *fakeOrc) ImportKV(archive *types.KVArchive, overwrite bool) (*types.KVImportResult, error) {
+	return nil, fmt.Errorf("import is not supported")
+}
+
+func (o *fakeOrc) TryLock(name, holder string, ttl time.Duration) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.lockErr != nil {
+		return o.lockErr
+	}
+	if current := o.locks[name]; current != "" && current != holder {
+		return kvstore.NewLockedError(&kvstore.LockInfo{Name: name, Holder: current})
+	}
+	o.writes++
+	o.locks[name] = holder
+	return nil
+}
+
+func (o *fakeOrc) Unlock(name, holder string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.locks[name] != holder {
+		return fmt.Errorf("unable to unlock %v, it's held by %v rather than %v", name, o.locks[name], holder)
+	}
+	o.writes++
+	delete(o.locks, name)
+	return nil
+}
+
+func (o *fakeOrc) RunElection(stopCh <-chan struct{}, onChange func(leader bool)) {
+	<-stopCh
+}
+
+func (o *fakeOrc) GetLeader() (string, error) {
+	return "", nil
+}
+
+func (o *fakeOrc) AddEvent(event *types.EventInfo) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.writes++
+	o.events = append(o.events, event)
+	return nil
+}
+
+func (o *fakeOrc) ListEvents(volumeName string, since time.Time) ([]*types.EventInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	events := []*types.EventInfo{}
+	for _, event := range o.events {
+		if volumeName == "" || event.Volume == volumeName {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (o *fakeOrc) PruneEvents(before time.Time, max int) (int, error) {
+	return 0, nil
+}
+
+func (o *fakeOrc) ReconcileVolume(volumeName string) (*types.ReconcileResult, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.reconciled = append(o.reconciled, volumeName)
+	return &types.ReconcileResult{}, nil
+}
+
+func (o *fakeOrc) ListOrphanInstances(grace time.Duration) ([]*types.InstanceInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.orphans, nil
+}
+
+func (o *fakeOrc) RemoveOrphanInstance(instance *types.InstanceInfo) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.writes++
+	o.removed = append(o.removed, instance.ID)
+	return nil
+}
+
+// FenceInstances takes the controller on a host which is down out of the
+// volume, and marks the replicas there bad
+func (o *fakeOrc) FenceInstances(volumeName string) ([]*types.InstanceInfo, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	v := o.volumes[volumeName]
+	if v == nil {
+		return nil, nil
+	}
+	down := func(hostID string) bool {
+		host := o.hosts[hostID]
+		return host == nil || host.State == types.HostStateDown
+	}
+	fenced := []*types.InstanceInfo{}
+	if v.Controller != nil && down(v.Controller.HostID) {
+		o.writes++
+		fenced = append(fenced, &v.Controller.InstanceInfo)
+		v.Controller = nil
+	}
+	for _, r := range v.Replicas {
+		if down(r.HostID) && r.BadTimestamp == "" {
+			o.writes++
+			r.BadTimestamp = util.Now()
+			r.Running = false
+			fenced = append(fenced, &r.InstanceInfo)
+		}
+	}
+	return fenced, nil
+}
+
+var _ types.Orchestrator = &fakeOrc{}
@@ -0,0 +1,173 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/kvstore"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	ReconcileInterval = 5 * time.Minute
+	// OrphanGracePeriod gives the containers just created time to be
+	// recorded in the key value store
+	OrphanGracePeriod = 10 * time.Minute
+)
+
+func (man *volumeManager) reconcileLoop() {
+	ticker := time.NewTicker(ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-man.stopCh:
+			return
+		case <-ticker.C:
+			man.reconcile()
+		}
+	}
+}
+
+// reconcile brings the key value store in line with the containers of the
+// current host, and deals with the containers unknown to the key value store
+// according to the orphan policy
+func (man *volumeManager) reconcile() {
+	volumes, err := man.orc.ListVolumes()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "failed to list volumes to reconcile"))
+	} else {
+		currentHostID := man.orc.GetCurrentHostID()
+		for _, volume := range volumes {
+			// Don't lock the volumes of the other hosts for nothing
+			if !hasInstanceOnHost(volume, currentHostID) {
+				continue
+			}
+			if err := man.reconcileVolume(volume.Name); err != nil {
+				logrus.Errorf("%+v", err)
+			}
+		}
+	}
+	if err := man.reconcileOrphans(); err != nil {
+		logrus.Errorf("%+v", err)
+	}
+}
+
+// hasInstanceOnHost tells if the controller or any replica of the volume is
+// on the host
+func hasInstanceOnHost(volume *types.VolumeInfo, hostID string) bool {
+	if volume.Controller != nil && volume.Controller.HostID == hostID {
+		return true
+	}
+	for _, replica := range volume.Replicas {
+		if replica.HostID == hostID {
+			return true
+		}
+	}
+	return false
+}
+
+func (man *volumeManager) reconcileVolume(name string) error {
+	lock, err := man.lockVolume(name, "reconcile")
+	if err != nil {
+		if kvstore.IsLockedError(err) || IsTransitionError(err) || IsShuttingDown(err) {
+			// Another operation is in progress, reconcile next time
+			logrus.Debugf("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer lock.Unlock()
+
+	if err := man.failInterruptedRestore(name); err != nil {
+		return err
+	}
+	result, err := man.orc.ReconcileVolume(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reconcile volume '%s'", name)
+	}
+	for _, instance := range result.Updated {
+		logrus.Infof("reconciled %s '%s' of volume '%s': running=%v, address=%v",
+			instance.Type, instance.Name, name, instance.Running, instance.Address)
+	}
+	controllerMissing := false
+	for _, instance := range result.Missing {
+		man.recordEvent(types.EventTypeWarning, types.EventReasonInstanceMissing, name,
+			"container %s of %s '%s' is missing on host '%s'", instance.ID, instance.Type, instance.Name, instance.HostID)
+		if instance.Type == types.InstanceTypeController {
+			controllerMissing = true
+		}
+	}
+	if controllerMissing {
+		man.recordEvent(types.EventTypeWarning, types.EventReasonAutoDetached, name,
+			"controller is missing, detaching")
+		return man.detach(name, types.VolumeStateNone)
+	}
+	return nil
+}
+
+// failInterruptedRestore is called with the volume lock held. A restore holds
+// the lock until it's finished, so an unfinished restore found here has been
+// interrupted, e.g. by the manager shutting down. It's failed, so the volume
+// can be deleted and created again.
+func (man *volumeManager) failInterruptedRestore(name string) error {
+	volume, err := man.orc.GetVolume(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", name)
+	}
+	if volume == nil || volume.CurrentState != types.VolumeStateRestoring ||
+		volume.RestoreStatus == nil || volume.RestoreStatus.Finished != "" {
+		return nil
+	}
+	err = errors.Errorf("restore of volume '%s' was interrupted in phase %v, delete the volume and create it again",
+		name, volume.RestoreStatus.Phase)
+	logrus.Errorf("%v", err)
+	if err := man.doDetach(volume); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach volume '%s' after the restore was interrupted", name))
+	}
+	man.recordEvent(types.EventTypeWarning, types.EventReasonRestoreFailed, name, "%v", err)
+	return man.updateRestoreStatus(name, func(status *types.RestoreStatus) {
+		status.Finished = util.Now()
+		status.Error = err.Error()
+	})
+}
+
+func (man *volumeManager) reconcileOrphans() error {
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		return errors.Wrap(err, "unable to get settings for orphan policy")
+	}
+	policy := types.OrphanPolicyReport
+	if settings != nil && settings.OrphanPolicy != "" {
+		policy = settings.OrphanPolicy
+	}
+
+	orphans, err := man.orc.ListOrphanInstances(OrphanGracePeriod)
+	if err != nil {
+		return errors.Wrap(err, "failed to list orphan instances")
+	}
+
+	// Only report the orphans once. reconcile never runs concurrently, so
+	// reportedOrphans doesn't need the lock.
+	reported := man.reportedOrphans
+	man.reportedOrphans = map[string]struct{}{}
+	for _, orphan := range orphans {
+		if policy != types.OrphanPolicyRemove {
+			man.reportedOrphans[orphan.ID] = struct{}{}
+			if _, ok := reported[orphan.ID]; !ok {
+				man.recordEvent(types.EventTypeWarning, types.EventReasonOrphanFound, orphan.VolumeName,
+					"found orphan container %s(%s) on host '%s'", orphan.Name, orphan.ID, orphan.HostID)
+			}
+			continue
+		}
+		if err := man.orc.RemoveOrphanInstance(orphan); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to remove orphan container %s(%s)", orphan.Name, orphan.ID))
+			continue
+		}
+		man.recordEvent(types.EventTypeNormal, types.EventReasonOrphanRemoved, orphan.VolumeName,
+			"removed orphan container %s(%s) on host '%s'", orphan.Name, orphan.ID, orphan.HostID)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package manager
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// restoreBackup restores the backup to the volume created by
+// createFromBackup, holding the volume lock handed over by Create. The volume
+// is detached once restored. If the restore fails, the volume is left
+// restoring with the error in RestoreStatus, so it can only be deleted.
+func (man *volumeManager) restoreBackup(lock *volumeLock, volume *types.VolumeInfo, backup *types.BackupInfo) {
+	defer lock.Unlock()
+
+	what := fmt.Sprintf("backup '%s'", backup.URL)
+	err := man.doRestore(volume, what, func(ctrl types.Controller) error {
+		return ctrl.BackupOps().Restore(backup.URL)
+	})
+	man.finishRestore(volume, what, err)
+}
+
+// cloneSnapshot copies the snapshot chain of the source volume to the
+// replicas of the volume created by createFromSnapshot, then reverts the
+// volume to the snapshot. It holds the locks of both volumes handed over by
+// Create, the one of the source only while the chain is copied. Failures are
+// left in RestoreStatus, the same as restoreBackup.
+func (man *volumeManager) cloneSnapshot(lock, srcLock *volumeLock, volume *types.VolumeInfo, srcCtrl types.Controller) {
+	defer lock.Unlock()
+
+	src := volume.FromSnapshot
+	what := fmt.Sprintf("snapshot '%s' of volume '%s'", src.Snapshot, src.Volume)
+	err := man.copySnapshotChain(volume, srcCtrl)
+	srcLock.Unlock()
+	if err == nil {
+		err = man.doRestore(volume, what, func(ctrl types.Controller) error {
+			return ctrl.SnapshotOps().Revert(src.Snapshot)
+		})
+	}
+	man.finishRestore(volume, what, err)
+}
+
+// copySnapshotChain has the source controller rebuild each replica of the
+// volume, the same as a replica added to the source volume, which copies all
+// its snapshots. The replicas are taken out of the source volume and stopped
+// right after, and counted in the progress of the restore.
+func (man *volumeManager) copySnapshotChain(volume *types.VolumeInfo, srcCtrl types.Controller) error {
+	src := volume.FromSnapshot
+	copied := 0
+	man.setRestoreProgress(volume.Name, 0)
+	for _, replica := range volume.Replicas {
+		if err := man.checkVolumeLock(volume.Name); err != nil {
+			return err
+		}
+		if err := man.checkVolumeLock(src.Volume); err != nil {
+			return err
+		}
+		instance, err := man.orc.StartInstance(&replica.InstanceInfo)
+		if err != nil {
+			return errors.Wrapf(err, "failed to start replica '%s' for volume '%s'", replica.Name, volume.Name)
+		}
+		added := &types.ReplicaInfo{InstanceInfo: *instance}
+		err = srcCtrl.AddReplica(added)
+		// It may be in the source volume even if the rebuild failed
+		if rmErr := srcCtrl.RemoveReplica(added); rmErr != nil {
+			if err == nil {
+				err = rmErr
+			} else {
+				logrus.Warnf("%v", rmErr)
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy the snapshots of volume '%s' to replica '%s'", src.Volume, replica.Name)
+		}
+		if _, err := man.orc.StopInstance(instance); err != nil {
+			return errors.Wrapf(err, "failed to stop replica '%s' for volume '%s'", replica.Name, volume.Name)
+		}
+		copied++
+		man.setRestoreProgress(volume.Name, copied*100/len(volume.Replicas))
+	}
+	return nil
+}
+
+// doRestore attaches the volume, restores what by restore, and detaches the
+// volume
+func (man *volumeManager) doRestore(volume *types.VolumeInfo, what string, restore func(ctrl types.Controller) error) error {
+	man.setRestorePhase(volume.Name, types.RestorePhaseAttaching)
+	if err := man.doAttach(volume); err != nil {
+		return errors.Wrapf(err, "failed to attach to restore %s, volume '%s'", what, volume.Name)
+	}
+
+	man.setRestorePhase(volume.Name, types.RestorePhaseRestoring)
+	if err := restore(man.getController(volume)); err != nil {
+		return errors.Wrapf(err, "failed to restore %s, volume '%s'", what, volume.Name)
+	}
+
+	man.setRestorePhase(volume.Name, types.RestorePhaseDetaching)
+	if err := man.doDetach(volume); err != nil {
+		return errors.Wrapf(err, "failed to detach after restoring %s, volume '%s'", what, volume.Name)
+	}
+	if err := man.transitVolume(volume, types.VolumeStateDetached); err != nil {
+		return err
+	}
+	man.setRestorePhase(volume.Name, types.RestorePhaseDone)
+	man.setRestoreProgress(volume.Name, 100)
+	return nil
+}
+
+// finishRestore records the result of restoring what to the volume. The
+// volume is detached if the restore failed.
+func (man *volumeManager) finishRestore(volume *types.VolumeInfo, what string, err error) {
+	if err != nil {
+		logrus.Errorf("%+v", err)
+		if err := man.doDetach(volume); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach volume '%s' after failing to restore", volume.Name))
+		}
+		man.recordEvent(types.EventTypeWarning, types.EventReasonRestoreFailed, volume.Name,
+			"failed to restore %s: %v", what, err)
+	} else {
+		man.recordEvent(types.EventTypeNormal, types.EventReasonRestored, volume.Name,
+			"restored %s", what)
+	}
+
+	if err := man.updateRestoreStatus(volume.Name, func(status *types.RestoreStatus) {
+		status.Finished = util.Now()
+		if err != nil {
+			status.Error = err.Error()
+		}
+	}); err != nil {
+		logrus.Errorf("%+v", err)
+	}
+}
+
+// setRestorePhase only logs the error, the restore goes on anyway
+func (man *volumeManager) setRestorePhase(volumeName string, phase types.RestorePhase) {
+	if err := man.updateRestoreStatus(volumeName, func(status *types.RestoreStatus) {
+		status.Phase = phase
+	}); err != nil {
+		logrus.Errorf("%+v", err)
+	}
+}
+
+// setRestoreProgress only logs the error, the same as setRestorePhase
+func (man *volumeManager) setRestoreProgress(volumeName string, progress int) {
+	if err := man.updateRestoreStatus(volumeName, func(status *types.RestoreStatus) {
+		status.Progress = &progress
+	}); err != nil {
+		logrus.Errorf("%+v", err)
+	}
+}
+
+func (man *volumeManager) updateRestoreStatus(volumeName string, f func(status *types.RestoreStatus)) error {
+	return retryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", volumeName)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", volumeName)
+		}
+		if volume.RestoreStatus == nil {
+			return errors.Errorf("BUG: volume '%s' has no restore status", volumeName)
+		}
+		f(volume.RestoreStatus)
+		if err := man.orc.UpdateVolume(volume); err != nil {
+			return errors.Wrapf(err, "unable to update the restore status of volume '%s'", volumeName)
+		}
+		return nil
+	})
+}
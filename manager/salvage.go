@@ -0,0 +1,199 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// Salvage brings a faulted volume back with the most complete one of its bad
+// replicas. The other replicas stay bad, so they will be replaced by the
+// replicas rebuilt from the salvaged one once the volume is attached.
+func (man *volumeManager) Salvage(name string) (*types.SalvageResult, error) {
+	lock, err := man.lockVolume(name, "salvage")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	volume, err := man.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if volume == nil {
+		return nil, errors.Errorf("cannot find volume '%s' to salvage", name)
+	}
+	return man.salvage(volume)
+}
+
+// autoSalvage salvages and attaches the faulted volume if AutoSalvage is
+// set. It's called with the volume lock held.
+func (man *volumeManager) autoSalvage(name string) error {
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		return errors.Wrap(err, "unable to get settings for auto salvage")
+	}
+	if settings == nil || !settings.AutoSalvage {
+		return nil
+	}
+	volume, err := man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil || volume.State != types.VolumeStateFaulted {
+		return nil
+	}
+	logrus.Infof("auto salvaging volume '%s'", name)
+	if _, err := man.salvage(volume); err != nil {
+		return err
+	}
+	volume, err = man.Get(name)
+	if err != nil {
+		return err
+	}
+	return man.attach(volume, types.VolumeStateNone)
+}
+
+func (man *volumeManager) salvage(volume *types.VolumeInfo) (*types.SalvageResult, error) {
+	if volume.State != types.VolumeStateFaulted {
+		return nil, errors.Errorf("cannot salvage volume '%s' in state %v, it must be faulted", volume.Name, volume.State)
+	}
+	if volume.Controller != nil {
+		return nil, errors.Errorf("cannot salvage volume '%s', it must be detached", volume.Name)
+	}
+
+	candidates := []*types.SalvageCandidate{}
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, replica := range volume.Replicas {
+		wg.Add(1)
+		go func(replica *types.ReplicaInfo) {
+			defer wg.Done()
+			candidate := man.inspectReplica(volume.Name, replica)
+			lock.Lock()
+			defer lock.Unlock()
+			candidates = append(candidates, candidate)
+		}(replica)
+	}
+	wg.Wait()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Replica < candidates[j].Replica
+	})
+
+	result := &types.SalvageResult{
+		Volume:     volume.Name,
+		Candidates: candidates,
+	}
+	chosen, reason := chooseSalvageReplica(candidates)
+	if chosen == nil {
+		man.recordEvent(types.EventTypeWarning, types.EventReasonSalvageFailed, volume.Name,
+			"no replica can be salvaged: %s", describeSalvageCandidates(candidates))
+		return result, errors.Errorf("no replica of volume '%s' can be salvaged", volume.Name)
+	}
+	result.Chosen = chosen.Replica
+	result.Reason = reason
+
+	replica := volume.Replicas[chosen.Replica]
+	if err := retryOnConflict(func() error {
+		return man.orc.ClearBadReplica(volume.Name, replica)
+	}); err != nil {
+		return result, errors.Wrapf(err, "failed to clear bad replica '%s' of volume '%s'", replica.Name, volume.Name)
+	}
+	logrus.Infof("salvaged volume '%s' with replica '%s': %s", volume.Name, chosen.Replica, reason)
+	man.recordEvent(types.EventTypeNormal, types.EventReasonSalvaged, volume.Name,
+		"salvaged with replica '%s', %s; candidates: %s", chosen.Replica, reason, describeSalvageCandidates(candidates))
+	return result, nil
+}
+
+// inspectReplica starts the replica to read its metadata, and stops it again
+func (man *volumeManager) inspectReplica(volumeName string, replica *types.ReplicaInfo) *types.SalvageCandidate {
+	candidate := &types.SalvageCandidate{
+		Replica:      replica.Name,
+		HostID:       replica.HostID,
+		BadTimestamp: replica.BadTimestamp,
+	}
+	instance, err := man.orc.StartInstance(&replica.InstanceInfo)
+	if err != nil {
+		candidate.Error = errors.Wrapf(err, "failed to start replica '%s'", replica.Name).Error()
+		return candidate
+	}
+	defer func() {
+		if _, err := man.orc.StopInstance(instance); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to stop replica '%s' of volume '%s' after inspection", replica.Name, volumeName))
+		}
+	}()
+	r := *replica
+	r.InstanceInfo = *instance
+	status, err := man.getReplicaStatus(&r)
+	if err != nil {
+		candidate.Error = err.Error()
+		return candidate
+	}
+	candidate.RevisionCounter = status.RevisionCounter
+	candidate.Chain = status.Chain
+	return candidate
+}
+
+// chooseSalvageReplica prefers the replica with the most writes, then the
+// longest snapshot chain, then the one failed last. It returns nil if no
+// replica could be inspected.
+func chooseSalvageReplica(candidates []*types.SalvageCandidate) (*types.SalvageCandidate, string) {
+	valid := []*types.SalvageCandidate{}
+	for _, c := range candidates {
+		if c.Error == "" {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, ""
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		a, b := valid[i], valid[j]
+		if a.RevisionCounter != b.RevisionCounter {
+			return a.RevisionCounter > b.RevisionCounter
+		}
+		if len(a.Chain) != len(b.Chain) {
+			return len(a.Chain) > len(b.Chain)
+		}
+		if a.BadTimestamp != b.BadTimestamp {
+			return a.BadTimestamp > b.BadTimestamp
+		}
+		return a.Replica < b.Replica
+	})
+	chosen := valid[0]
+	if len(valid) == 1 {
+		return chosen, "it's the only replica that could be inspected"
+	}
+	next := valid[1]
+	switch {
+	case chosen.RevisionCounter != next.RevisionCounter:
+		return chosen, fmt.Sprintf("it has the highest revision counter %v, next %v",
+			chosen.RevisionCounter, next.RevisionCounter)
+	case len(chosen.Chain) != len(next.Chain):
+		return chosen, fmt.Sprintf("it has the longest snapshot chain of %v, next %v",
+			len(chosen.Chain), len(next.Chain))
+	case chosen.BadTimestamp != next.BadTimestamp:
+		return chosen, fmt.Sprintf("it failed last at %v, next %v",
+			chosen.BadTimestamp, next.BadTimestamp)
+	}
+	return chosen, "the replicas are equally complete"
+}
+
+func describeSalvageCandidates(candidates []*types.SalvageCandidate) string {
+	s := []string{}
+	for _, c := range candidates {
+		if c.Error != "" {
+			s = append(s, fmt.Sprintf("%s(error: %s)", c.Replica, c.Error))
+			continue
+		}
+		s = append(s, fmt.Sprintf("%s(revision %v, %v snapshots, bad since %s)",
+			c.Replica, c.RevisionCounter, len(c.Chain), c.BadTimestamp))
+	}
+	return strings.Join(s, ", ")
+}
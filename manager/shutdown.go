@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	ErrShuttingDown = errors.New("the manager is shutting down")
+
+	// LeaderResignTimeout is how long Shutdown waits for the leadership to
+	// be released, in addition to its timeout
+	LeaderResignTimeout = 10 * time.Second
+)
+
+func IsShuttingDown(err error) bool {
+	return errors.Cause(err) == ErrShuttingDown
+}
+
+func (man *volumeManager) isShuttingDown() bool {
+	man.Lock()
+	defer man.Unlock()
+	return man.shuttingDown
+}
+
+// goBackground runs f in the background, and Shutdown waits for it. It
+// fails with ErrShuttingDown once Shutdown is called.
+func (man *volumeManager) goBackground(f func()) error {
+	man.Lock()
+	defer man.Unlock()
+	if man.shuttingDown {
+		return ErrShuttingDown
+	}
+	man.background.Add(1)
+	go func() {
+		defer man.background.Done()
+		f()
+	}()
+	return nil
+}
+
+// Shutdown should be called after the API stops taking requests. No more
+// volume operations can start from then on. It stops the recurring jobs,
+// waits for the running bg tasks and the background operations (e.g.
+// restores and replicas being added), closes the monitors, then stops the
+// loops and resigns the leadership. The operations still running after
+// timeout are interrupted: their volume locks are released, so they fail
+// on their next check of the lock, leaving their volumes in transitional
+// states. Attaching, detaching and deleting are abandoned by the next
+// operation of the volume. An interrupted restore cannot be resumed,
+// reconcile fails it, and the volume has to be deleted and created again.
+func (man *volumeManager) Shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	man.Lock()
+	if man.shuttingDown {
+		man.Unlock()
+		return ErrShuttingDown
+	}
+	man.shuttingDown = true
+	monitors := map[string]types.Monitor{}
+	for name, mon := range man.monitors {
+		monitors[name] = mon
+	}
+	man.Unlock()
+
+	logrus.Infof("shutting down: stopping recurring jobs")
+	for name, mon := range monitors {
+		if !TrySend(mon.CronCh(), CronUpdate(nil)) {
+			logrus.Warnf("failed to stop recurring jobs of volume '%s', will be stopped with the monitor", name)
+		}
+	}
+
+	logrus.Infof("shutting down: waiting for bg tasks")
+	if !controller.DrainBgTasks(time.Until(deadline)) {
+		logrus.Warnf("shutting down: timeout waiting for bg tasks, interrupting them")
+	}
+	logrus.Infof("shutting down: waiting for background operations")
+	done := make(chan struct{})
+	go func() {
+		man.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		logrus.Warnf("shutting down: timeout waiting for background operations, interrupting them")
+		man.releaseVolumeLocks()
+	}
+
+	logrus.Infof("shutting down: closing monitors")
+	man.Lock()
+	for name, mon := range man.monitors {
+		mon.Close()
+		delete(man.monitors, name)
+	}
+	man.Unlock()
+
+	logrus.Infof("shutting down: stopping loops and resigning leadership")
+	close(man.stopCh)
+	select {
+	case <-man.electionDone:
+	case <-time.After(LeaderResignTimeout):
+		logrus.Warnf("shutting down: timeout resigning leadership, it will expire")
+	}
+	logrus.Infof("manager is shut down")
+	return nil
+}
+
+// releaseVolumeLocks releases the locks held by the operations interrupted by
+// Shutdown, rather than leaving them until they expire. The locks are kept
+// in volumeLocks, so checkVolumeLock fails with ErrShuttingDown.
+func (man *volumeManager) releaseVolumeLocks() {
+	man.Lock()
+	locks := []*volumeLock{}
+	for _, l := range man.volumeLocks {
+		locks = append(locks, l)
+	}
+	man.Unlock()
+
+	for _, l := range locks {
+		logrus.Warnf("shutting down: releasing lock of volume '%s' held by %s", l.volume, l.holder)
+		l.release()
+	}
+}
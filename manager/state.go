@@ -0,0 +1,133 @@
+package manager
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// volumeTransitions are the valid changes of the CurrentState of a volume.
+// The transitional states are only set with the volume lock held, so the
+// operation is in flight as long as the lock is held.
+var volumeTransitions = map[types.VolumeState][]types.VolumeState{
+	types.VolumeStateCreating:  {types.VolumeStateRestoring, types.VolumeStateDetached, types.VolumeStateDeleting},
+	types.VolumeStateRestoring: {types.VolumeStateDetached, types.VolumeStateDeleting},
+	types.VolumeStateDetached:  {types.VolumeStateAttaching, types.VolumeStateDetaching, types.VolumeStateDeleting},
+	types.VolumeStateAttaching: {types.VolumeStateAttached, types.VolumeStateDetached},
+	types.VolumeStateAttached:  {types.VolumeStateAttaching, types.VolumeStateDetaching, types.VolumeStateDeleting},
+	types.VolumeStateDetaching: {types.VolumeStateDetached, types.VolumeStateAttached},
+	types.VolumeStateDeleting:  {types.VolumeStateDetached, types.VolumeStateAttached},
+}
+
+func isTransitional(state types.VolumeState) bool {
+	switch state {
+	case types.VolumeStateCreating, types.VolumeStateRestoring,
+		types.VolumeStateAttaching, types.VolumeStateDetaching, types.VolumeStateDeleting:
+		return true
+	}
+	return false
+}
+
+func validTransition(from, to types.VolumeState) bool {
+	for _, state := range volumeTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// steadyState is where the volume is according to its controller
+func steadyState(volume *types.VolumeInfo) types.VolumeState {
+	if volume.Controller != nil {
+		return types.VolumeStateAttached
+	}
+	return types.VolumeStateDetached
+}
+
+func currentState(volume *types.VolumeInfo) types.VolumeState {
+	if volume.CurrentState == types.VolumeStateNone {
+		return steadyState(volume)
+	}
+	return volume.CurrentState
+}
+
+// updateVolumeState persists the state returned by f, which is given the
+// latest volume read from the orchestrator. It fails if the volume lock held
+// by the operation has been lost.
+func (man *volumeManager) updateVolumeState(volume *types.VolumeInfo, f func(v *types.VolumeInfo) error) error {
+	if err := man.checkVolumeLock(volume.Name); err != nil {
+		return err
+	}
+	return retryOnConflict(func() error {
+		v, err := man.orc.GetVolume(volume.Name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", volume.Name)
+		}
+		if v == nil {
+			return errors.Errorf("cannot find volume '%s'", volume.Name)
+		}
+		if err := f(v); err != nil {
+			return err
+		}
+		if err := man.orc.UpdateVolume(v); err != nil {
+			return errors.Wrapf(err, "unable to update the state of volume '%s'", volume.Name)
+		}
+		volume.DesiredState = v.DesiredState
+		volume.CurrentState = v.CurrentState
+		return nil
+	})
+}
+
+// beginTransition moves the volume to the transitional state to for
+// operation, and records desired unless it's empty. It's called with the
+// volume lock held, so a transitional state found here has been left by a
+// manager which died in the middle of it. Attaching, detaching and deleting
+// are abandoned then, while a volume left creating or restoring can only be
+// deleted.
+func (man *volumeManager) beginTransition(volume *types.VolumeInfo, operation string, to, desired types.VolumeState) error {
+	return man.updateVolumeState(volume, func(v *types.VolumeInfo) error {
+		from := currentState(v)
+		if isTransitional(from) && from != types.VolumeStateCreating && from != types.VolumeStateRestoring {
+			logrus.Warnf("volume '%s' was left %s, abandoning it", v.Name, from)
+			from = steadyState(v)
+		}
+		if !validTransition(from, to) {
+			return &TransitionError{
+				Volume:    v.Name,
+				Operation: operation,
+				State:     from,
+			}
+		}
+		v.CurrentState = to
+		if desired != types.VolumeStateNone {
+			v.DesiredState = desired
+		}
+		return nil
+	})
+}
+
+// transitVolume moves the volume on from the transitional state it has been
+// put in by this manager, e.g. by beginTransition
+func (man *volumeManager) transitVolume(volume *types.VolumeInfo, to types.VolumeState) error {
+	return man.updateVolumeState(volume, func(v *types.VolumeInfo) error {
+		if v.CurrentState != volume.CurrentState || !validTransition(v.CurrentState, to) {
+			return errors.Errorf("BUG: invalid transition of volume '%s' from %s (expected %s) to %s",
+				v.Name, v.CurrentState, volume.CurrentState, to)
+		}
+		v.CurrentState = to
+		return nil
+	})
+}
+
+// abortTransition moves the volume to where it's according to the
+// controller, after the operation failed in the middle
+func (man *volumeManager) abortTransition(volume *types.VolumeInfo) {
+	if err := man.updateVolumeState(volume, func(v *types.VolumeInfo) error {
+		v.CurrentState = steadyState(v)
+		return nil
+	}); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to abort the transition of volume '%s'", volume.Name))
+	}
+}
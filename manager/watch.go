@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	WatchRetryPeriod = time.Second * 5
+)
+
+func (man *volumeManager) startWatching() {
+	go man.keepWatching("volumes", man.stopCh, man.watchVolumes)
+	go man.keepWatching("settings", man.stopCh, man.watchSettings)
+}
+
+// keepWatching restarts watch every time it fails, until stopCh is closed
+func (man *volumeManager) keepWatching(name string, stopCh <-chan struct{}, watch func() error) {
+	for {
+		if err := watch(); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to watch %s", name))
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(WatchRetryPeriod):
+			logrus.Infof("restarting the watch of %s", name)
+		}
+	}
+}
+
+func (man *volumeManager) watchVolumes() error {
+	ch, err := man.orc.WatchVolumes(man.stopCh)
+	if err != nil {
+		return err
+	}
+	for name := range ch {
+		man.volumeChanged(name)
+	}
+	return nil
+}
+
+func (man *volumeManager) watchSettings() error {
+	ch, err := man.orc.WatchSettings(man.stopCh)
+	if err != nil {
+		return err
+	}
+	for range ch {
+		man.settingsChanged()
+	}
+	return nil
+}
+
+func (man *volumeManager) getMonitor(name string) types.Monitor {
+	man.Lock()
+	defer man.Unlock()
+	return man.monitors[name]
+}
+
+// volumeChanged wakes up the monitor of the volume, instead of waiting for
+// the next tick, or stops monitoring if the volume is no longer attached
+// to the current host
+func (man *volumeManager) volumeChanged(name string) {
+	mon := man.getMonitor(name)
+	if mon == nil {
+		return
+	}
+	volume, err := man.orc.GetVolume(name)
+	if err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "error getting changed volume '%s'", name))
+		return
+	}
+	if volume == nil {
+		logrus.Infof("volume '%s' has been deleted, stop monitoring", name)
+		man.stopMonitoring(&types.VolumeInfo{Name: name})
+		return
+	}
+	if volume.Controller == nil || volume.Controller.HostID != man.orc.GetCurrentHostID() {
+		logrus.Infof("volume '%s' is no longer attached to current host, stop monitoring", name)
+		man.stopMonitoring(volume)
+		return
+	}
+	// The monitor may be busy, it will check again on the next tick anyway
+	TrySend(mon.MonitorCh(), TimeEvent())
+	TrySend(mon.CleanupCh(), TimeEvent())
+}
+
+// settingsChanged reschedules recurring jobs, since they're using e.g. the
+// backup target at the time of scheduling
+func (man *volumeManager) settingsChanged() {
+	man.Lock()
+	names := []string{}
+	for name := range man.monitors {
+		names = append(names, name)
+	}
+	man.Unlock()
+
+	for _, name := range names {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "error getting volume '%s' to update recurring jobs", name))
+			continue
+		}
+		if volume == nil {
+			continue
+		}
+		go man.updateCron(volume, volume.RecurringJobs)
+	}
+}
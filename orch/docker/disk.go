@@ -0,0 +1,133 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// registerDisks sets the disks of the host to the directories specified. The
+// tags and the schedulable flag of the disks already registered are kept
+// from the key value store.
+func (d *dockerOrc) registerDisks(host *types.HostInfo) error {
+	registered, err := d.kv.GetHost(host.UUID)
+	if err != nil {
+		return errors.Wrap(err, "fail to get the registered disks")
+	}
+	host.Disks = map[string]*types.DiskInfo{}
+	for _, path := range d.disks {
+		path = filepath.Clean(path)
+		id, err := getDiskID(path)
+		if err != nil {
+			return err
+		}
+		if disk, ok := host.Disks[id]; ok {
+			return errors.Errorf("disk %v is specified twice, at %v and %v", id, disk.Path, path)
+		}
+		disk := &types.DiskInfo{
+			ID:          id,
+			Path:        path,
+			Schedulable: true,
+		}
+		if registered != nil && registered.Disks[id] != nil {
+			disk.Tags = registered.Disks[id].Tags
+			disk.Schedulable = registered.Disks[id].Schedulable
+		}
+		host.Disks[id] = disk
+		logrus.Infof("Disk %v at %v, tags %v, schedulable %v", id, path, disk.Tags, disk.Schedulable)
+	}
+	if registered != nil {
+		for id, disk := range registered.Disks {
+			if _, ok := host.Disks[id]; !ok {
+				logrus.Warnf("Disk %v at %v is no longer specified, the data of its replicas won't be removed", id, disk.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// getDiskID creates the directory of the disk and its ID if they don't exist
+func getDiskID(path string) (string, error) {
+	idFile := filepath.Join(path, diskIDFile)
+	id, err := ioutil.ReadFile(idFile)
+	if err == nil {
+		return strings.TrimSpace(string(id)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "fail to read disk id file %v", idFile)
+	}
+
+	newID := util.UUID()
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", errors.Wrapf(err, "fail to create disk directory %v", path)
+	}
+	if err := ioutil.WriteFile(idFile, []byte(newID), 0600); err != nil {
+		return "", errors.Wrapf(err, "fail to write disk id file %v", idFile)
+	}
+	return newID, nil
+}
+
+// updateStorage leaves the capacity of a disk as is if it fails. The storage
+// of the host only counts the schedulable disks.
+func updateStorage(host *types.HostInfo) {
+	host.StorageCapacity = 0
+	host.StorageAvailable = 0
+	for _, disk := range host.Disks {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(disk.Path, &stat); err != nil {
+			logrus.Warnf("Fail to get the capacity of disk %v at %v: %v", disk.ID, disk.Path, err)
+		} else {
+			disk.StorageCapacity = int64(stat.Blocks) * int64(stat.Bsize)
+			disk.StorageAvailable = int64(stat.Bavail) * int64(stat.Bsize)
+		}
+		if disk.Schedulable {
+			host.StorageCapacity += disk.StorageCapacity
+			host.StorageAvailable += disk.StorageAvailable
+		}
+	}
+}
+
+func (d *dockerOrc) UpdateDisk(diskID string, tags []string, schedulable bool) (*types.HostInfo, error) {
+	d.hostLock.Lock()
+	defer d.hostLock.Unlock()
+
+	disk := d.currentHost.Disks[diskID]
+	if disk == nil {
+		return nil, errors.Errorf("cannot find disk %v on host %v", diskID, d.currentHost.UUID)
+	}
+	oldTags, oldSchedulable := disk.Tags, disk.Schedulable
+	disk.Tags = tags
+	disk.Schedulable = schedulable
+	updateStorage(d.currentHost)
+	if err := d.kv.UpdateHostHeartbeat(d.currentHost); err != nil {
+		disk.Tags, disk.Schedulable = oldTags, oldSchedulable
+		return nil, errors.Wrapf(err, "fail to update disk %v", diskID)
+	}
+	logrus.Infof("Updated disk %v at %v, tags %v, schedulable %v", diskID, disk.Path, tags, schedulable)
+	return d.GetHost(d.currentHost.UUID)
+}
+
+// replicaDataPath is where the replica keeps its data on the disk
+func (d *dockerOrc) replicaDataPath(diskID, replicaName string) (string, error) {
+	d.hostLock.Lock()
+	defer d.hostLock.Unlock()
+
+	disk := d.currentHost.Disks[diskID]
+	if disk == nil {
+		return "", errors.Errorf("cannot find disk %v on host %v", diskID, d.currentHost.UUID)
+	}
+	// The replica name comes from the API, don't let it escape the disk
+	path := filepath.Join(disk.Path, replicaName)
+	if filepath.Dir(path) != filepath.Clean(disk.Path) {
+		return "", errors.Errorf("invalid replica name %v for disk %v", replicaName, diskID)
+	}
+	return path, nil
+}
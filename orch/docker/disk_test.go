@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type DiskSuite struct{}
+
+var _ = Suite(&DiskSuite{})
+
+func (s *DiskSuite) TestDiskID(c *C) {
+	dir, err := ioutil.TempDir("", "longhorn-disk")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// The directory is created along the ID, which is kept
+	path := filepath.Join(dir, "replicas")
+	id, err := getDiskID(path)
+	c.Assert(err, IsNil)
+	c.Assert(id, Not(Equals), "")
+	again, err := getDiskID(path)
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, id)
+
+	other, err := getDiskID(filepath.Join(dir, "other"))
+	c.Assert(err, IsNil)
+	c.Assert(other, Not(Equals), id)
+}
+
+func (s *DiskSuite) TestUpdateStorage(c *C) {
+	dir, err := ioutil.TempDir("", "longhorn-disk")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	host := &types.HostInfo{
+		Disks: map[string]*types.DiskInfo{
+			"disk-1": {ID: "disk-1", Path: dir, Schedulable: true},
+			"disk-2": {ID: "disk-2", Path: dir, Schedulable: false},
+			"disk-3": {ID: "disk-3", Path: filepath.Join(dir, "missing"), Schedulable: true},
+		},
+	}
+	updateStorage(host)
+	disk := host.Disks["disk-1"]
+	c.Assert(disk.StorageCapacity > 0, Equals, true)
+	c.Assert(disk.StorageAvailable <= disk.StorageCapacity, Equals, true)
+	c.Assert(host.Disks["disk-2"].StorageCapacity, Equals, disk.StorageCapacity)
+	c.Assert(host.Disks["disk-3"].StorageCapacity, Equals, int64(0))
+
+	// Only the schedulable disks are counted for the host
+	c.Assert(host.StorageCapacity, Equals, disk.StorageCapacity)
+}
+
+func (s *DiskSuite) TestReplicaDataPath(c *C) {
+	d := &dockerOrc{
+		currentHost: &types.HostInfo{
+			UUID: "host-1",
+			Disks: map[string]*types.DiskInfo{
+				"disk-1": {ID: "disk-1", Path: "/var/lib/longhorn/replicas"},
+			},
+		},
+	}
+
+	path, err := d.replicaDataPath("disk-1", "vol-replica-1")
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "/var/lib/longhorn/replicas/vol-replica-1")
+
+	_, err = d.replicaDataPath("disk-2", "vol-replica-1")
+	c.Assert(err, NotNil)
+
+	// The replica directory must be right under the disk
+	for _, name := range []string{"", ".", "..", "../vol-replica-1", "vol/replica-1", "/vol-replica-1/.."} {
+		_, err = d.replicaDataPath("disk-1", name)
+		c.Assert(err, NotNil, Commentf("replica name %q", name))
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
@@ -25,6 +28,16 @@ import (
 const (
 	cfgDirectory = "/var/lib/rancher/longhorn/"
 	hostUUIDFile = cfgDirectory + ".physical_host_uuid"
+	// hostLabelsFile has "zone=<zone>" and "region=<region>" lines, which
+	// are overridden by the flags
+	hostLabelsFile = cfgDirectory + ".host_labels"
+	// defaultDisk is used if no disk is specified
+	defaultDisk = cfgDirectory + "replicas"
+	// diskIDFile is in each disk, keeping the ID of the disk
+	diskIDFile = ".disk_id"
+
+	kvBackendETCD = "etcd"
+	kvBackendFile = "file"
 )
 
 type dockerOrc struct {
@@ -32,7 +45,14 @@ type dockerOrc struct {
 	Network     string
 	IP          string
 
+	// hostLock protects the storage and the disks of currentHost, which
+	// are updated after registration
+	hostLock    sync.Mutex
 	currentHost *types.HostInfo
+	hostTags    []string
+	hostZone    string
+	hostRegion  string
+	disks       []string
 
 	kv  *kvstore.KVStore
 	cli *dCli.Client
@@ -41,34 +61,101 @@ type dockerOrc struct {
 }
 
 type dockerOrcConfig struct {
-	servers []string
-	prefix  string
-	image   string
-	network string
+	kvBackend   string
+	kvPath      string
+	servers     []string
+	etcdVersion string
+	prefix      string
+	image       string
+	network     string
+	hostTags    []string
+	hostZone    string
+	hostRegion  string
+	disks       []string
 }
 
 func New(c *cli.Context) (types.Orchestrator, error) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	return newDocker(cfg)
+}
+
+// NewKVStore connects to the key value store specified by the flags, for
+// the commands working on the key value store without the orchestrator
+func NewKVStore(c *cli.Context) (*kvstore.KVStore, error) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return kvstore.NewKVStore(cfg.prefix, backend)
+}
+
+func getConfig(c *cli.Context) (*dockerOrcConfig, error) {
+	kvBackend := c.String("kv-backend")
+	kvPath := c.String("kv-path")
 	servers := c.StringSlice("etcd-servers")
-	if len(servers) == 0 {
+	if kvBackend == kvBackendETCD && len(servers) == 0 {
 		return nil, fmt.Errorf("Unspecified etcd servers")
 	}
+	etcdVersion := c.String("etcd-version")
 	prefix := c.String("etcd-prefix")
 	image := c.String(orch.EngineImageParam)
 	network := c.String("docker-network")
-	return newDocker(&dockerOrcConfig{
-		servers: servers,
-		prefix:  prefix,
-		image:   image,
-		network: network,
-	})
+	hostTags := c.StringSlice("host-tags")
+	hostZone := c.String("host-zone")
+	hostRegion := c.String("host-region")
+	disks := c.StringSlice("disk")
+	if len(disks) == 0 {
+		disks = []string{defaultDisk}
+	}
+	return &dockerOrcConfig{
+		kvBackend:   kvBackend,
+		kvPath:      kvPath,
+		servers:     servers,
+		etcdVersion: etcdVersion,
+		prefix:      prefix,
+		image:       image,
+		network:     network,
+		hostTags:    hostTags,
+		hostZone:    hostZone,
+		hostRegion:  hostRegion,
+		disks:       disks,
+	}, nil
+}
+
+func newBackend(cfg *dockerOrcConfig) (kvstore.Backend, error) {
+	switch cfg.kvBackend {
+	case "", kvBackendETCD:
+	case kvBackendFile:
+		if cfg.kvPath == "" {
+			return nil, errors.Errorf("unspecified path for kv backend %v", cfg.kvBackend)
+		}
+		return kvstore.NewFileBackend(cfg.kvPath)
+	default:
+		return nil, errors.Errorf("invalid kv backend %v", cfg.kvBackend)
+	}
+
+	switch cfg.etcdVersion {
+	case "", "v2":
+		return kvstore.NewETCDBackend(cfg.servers)
+	case "v3":
+		return kvstore.NewETCD3Backend(cfg.servers)
+	}
+	return nil, errors.Errorf("invalid etcd version %v", cfg.etcdVersion)
 }
 
 func newDocker(cfg *dockerOrcConfig) (types.Orchestrator, error) {
-	etcdBackend, err := kvstore.NewETCDBackend(cfg.servers)
+	backend, err := newBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
-	kvStore, err := kvstore.NewKVStore(cfg.prefix, etcdBackend)
+	kvStore, err := kvstore.NewKVStore(cfg.prefix, backend)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +163,10 @@ func newDocker(cfg *dockerOrcConfig) (types.Orchestrator, error) {
 	docker := &dockerOrc{
 		EngineImage: cfg.image,
 		kv:          kvStore,
+		hostTags:    cfg.hostTags,
+		hostZone:    cfg.hostZone,
+		hostRegion:  cfg.hostRegion,
+		disks:       cfg.disks,
 	}
 	docker.scheduler = scheduler.NewOrcScheduler(docker)
 
@@ -173,6 +264,24 @@ func (d *dockerOrc) Register(address string) error {
 		return err
 	}
 
+	currentHost.Tags = d.hostTags
+	labels, err := readHostLabels(hostLabelsFile)
+	if err != nil {
+		return err
+	}
+	currentHost.Zone = labels["zone"]
+	if d.hostZone != "" {
+		currentHost.Zone = d.hostZone
+	}
+	currentHost.Region = labels["region"]
+	if d.hostRegion != "" {
+		currentHost.Region = d.hostRegion
+	}
+	if err := d.registerDisks(currentHost); err != nil {
+		return err
+	}
+	updateStorage(currentHost)
+	currentHost.LastHeartbeat = util.Now()
 	if err := d.kv.SetHost(currentHost); err != nil {
 		return err
 	}
@@ -180,12 +289,49 @@ func (d *dockerOrc) Register(address string) error {
 	return nil
 }
 
+// readHostLabels returns no labels if the file doesn't exist
+func readHostLabels(file string) (map[string]string, error) {
+	labels := map[string]string{}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return labels, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to read host labels file %v", file)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid line %q in host labels file %v", line, file)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
 func (d *dockerOrc) GetHost(id string) (*types.HostInfo, error) {
-	return d.kv.GetHost(id)
+	host, err := d.kv.GetHost(id)
+	if err != nil || host == nil {
+		return host, err
+	}
+	host.State = hostState(host, time.Now())
+	return host, nil
 }
 
 func (d *dockerOrc) ListHosts() (map[string]*types.HostInfo, error) {
-	return d.kv.ListHosts()
+	hosts, err := d.kv.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, host := range hosts {
+		host.State = hostState(host, now)
+	}
+	return hosts, nil
 }
 
 func (d *dockerOrc) GetCurrentHostID() string {
@@ -222,9 +368,11 @@ func (d *dockerOrc) GetVolume(volumeName string) (*types.VolumeInfo, error) {
 	return d.kv.GetVolume(volumeName)
 }
 
+// UpdateVolume updates the volume base. It fails with kvstore.ConflictError
+// if the volume has been modified since it was read.
 func (d *dockerOrc) UpdateVolume(volume *types.VolumeInfo) error {
 	v, err := d.kv.GetVolumeBase(volume.Name)
-	if err != nil {
+	if err != nil || v == nil {
 		return errors.Errorf("cannot update volume %v because it doesn't exists %+v", volume.Name, v)
 	}
 	return d.kv.SetVolumeBase(volume)
@@ -234,20 +382,102 @@ func (d *dockerOrc) ListVolumes() ([]*types.VolumeInfo, error) {
 	return d.kv.ListVolumes()
 }
 
+// SetReplicaRebuilding finds the replica by name. It fails with
+// kvstore.ConflictError if the replica is modified concurrently.
+func (d *dockerOrc) SetReplicaRebuilding(volumeName string, replica *types.ReplicaInfo, rebuilding bool) error {
+	r, err := d.kv.GetVolumeReplica(volumeName, replica.Name)
+	if err != nil {
+		return errors.Wrap(err, "fail to set replica rebuilding, cannot get replica")
+	}
+	if r == nil {
+		return errors.Errorf("fail to set replica rebuilding, cannot find replica %v of volume %v",
+			replica.Name, volumeName)
+	}
+	if r.Rebuilding == rebuilding {
+		return nil
+	}
+	r.Rebuilding = rebuilding
+	if err := d.kv.UpdateVolumeReplica(r); err != nil {
+		return errors.Wrap(err, "fail to set replica rebuilding, cannot update replica")
+	}
+	return nil
+}
+
+func (d *dockerOrc) ListHostLoads() (map[string]*types.HostLoad, error) {
+	volumes, err := d.kv.ListVolumes()
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to list host loads")
+	}
+	loads := map[string]*types.HostLoad{}
+	for _, volume := range volumes {
+		for _, replica := range volume.Replicas {
+			if replica.BadTimestamp != "" {
+				continue
+			}
+			load := loads[replica.HostID]
+			if load == nil {
+				load = &types.HostLoad{
+					DiskProvisioned: map[string]int64{},
+				}
+				loads[replica.HostID] = load
+			}
+			load.Replicas++
+			load.Provisioned += volume.Size
+			if replica.DiskID != "" {
+				load.DiskProvisioned[replica.DiskID] += volume.Size
+			}
+			if replica.Rebuilding {
+				load.Rebuilding++
+			}
+		}
+	}
+	return loads, nil
+}
+
+// MarkBadReplica finds the replica by name, or by address if the name is
+// unknown (e.g. replica reported by the controller). It fails with
+// kvstore.ConflictError if the replica is modified concurrently.
 func (d *dockerOrc) MarkBadReplica(volumeName string, replica *types.ReplicaInfo) error {
 	v, err := d.kv.GetVolume(volumeName)
 	if err != nil {
 		return errors.Wrap(err, "fail to mark bad replica, cannot get volume")
 	}
-	for k, r := range v.Replicas {
-		if r.Name == replica.Name {
+	if v == nil {
+		return errors.Errorf("fail to mark bad replica, cannot find volume %v", volumeName)
+	}
+	for _, r := range v.Replicas {
+		if (replica.Name != "" && r.Name == replica.Name) ||
+			(replica.Name == "" && r.Address == replica.Address) {
+			if r.BadTimestamp != "" {
+				return nil
+			}
 			r.BadTimestamp = util.Now()
-			v.Replicas[k] = r
-			break
+			if err := d.kv.UpdateVolumeReplica(r); err != nil {
+				return errors.Wrap(err, "fail to mark bad replica, cannot update replica")
+			}
+			return nil
 		}
 	}
-	if err := d.UpdateVolume(v); err != nil {
-		return errors.Wrap(err, "fail to mark bad replica, cannot update volume")
+	return errors.Errorf("fail to mark bad replica, cannot find replica %v(%v) of volume %v",
+		replica.Name, replica.Address, volumeName)
+}
+
+// ClearBadReplica finds the replica by name
+func (d *dockerOrc) ClearBadReplica(volumeName string, replica *types.ReplicaInfo) error {
+	r, err := d.kv.GetVolumeReplica(volumeName, replica.Name)
+	if err != nil {
+		return errors.Wrap(err, "fail to clear bad replica, cannot get replica")
+	}
+	if r == nil {
+		return errors.Errorf("fail to clear bad replica, cannot find replica %v of volume %v",
+			replica.Name, volumeName)
+	}
+	if r.BadTimestamp == "" {
+		return nil
+	}
+	r.BadTimestamp = ""
+	if err := d.kv.UpdateVolumeReplica(r); err != nil {
+		return errors.Wrap(err, "fail to clear bad replica, cannot update replica")
 	}
 	return nil
 }
@@ -270,6 +500,63 @@ func (d *dockerOrc) SetSettings(settings *types.SettingsInfo) error {
 	return d.kv.SetSettings(settings)
 }
 
+func (d *dockerOrc) TryLock(name, holder string, ttl time.Duration) error {
+	_, err := d.kv.TryLock(name, holder, ttl)
+	return err
+}
+
+func (d *dockerOrc) Unlock(name, holder string) error {
+	return d.kv.Unlock(name, holder)
+}
+
+func (d *dockerOrc) RunElection(stopCh <-chan struct{}, onChange func(leader bool)) {
+	d.kv.NewElector(d.currentHost.UUID).Run(stopCh, onChange)
+}
+
+func (d *dockerOrc) GetLeader() (string, error) {
+	return d.kv.GetLeader()
+}
+
+// AddEvent records the event on the current host, unless HostID is set
+func (d *dockerOrc) AddEvent(event *types.EventInfo) error {
+	if event.HostID == "" {
+		event.HostID = d.currentHost.UUID
+	}
+	return d.kv.AddEvent(event)
+}
+
+func (d *dockerOrc) ListEvents(volumeName string, since time.Time) ([]*types.EventInfo, error) {
+	return d.kv.ListEvents(volumeName, since)
+}
+
+func (d *dockerOrc) PruneEvents(before time.Time, max int) (int, error) {
+	return d.kv.PruneEvents(before, max)
+}
+
+func (d *dockerOrc) MigrateKV(dryRun bool) ([]string, error) {
+	return d.kv.Migrate(d.currentHost.UUID, dryRun)
+}
+
+func (d *dockerOrc) ExportKV() (*types.KVArchive, error) {
+	return d.kv.Export()
+}
+
+func (d *dockerOrc) ImportKV(archive *types.KVArchive, overwrite bool) (*types.KVImportResult, error) {
+	return d.kv.Import(archive, overwrite)
+}
+
+func (d *dockerOrc) WatchVolumes(stopCh <-chan struct{}) (<-chan string, error) {
+	return d.kv.WatchVolumes(stopCh)
+}
+
+func (d *dockerOrc) WatchHosts(stopCh <-chan struct{}) (<-chan string, error) {
+	return d.kv.WatchHosts(stopCh)
+}
+
+func (d *dockerOrc) WatchSettings(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	return d.kv.WatchSettings(stopCh)
+}
+
 func (d *dockerOrc) Scheduler() types.Scheduler {
 	return d.scheduler
 }
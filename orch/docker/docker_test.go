@@ -90,9 +90,16 @@ func (s *TestSuite) TestCreateVolume(c *C) {
 		InstanceName: Replica1Name,
 		EngineImage:  volume.EngineImage,
 	}
-	replica1, err := s.d.createReplica(replica1Data)
+	// The first replica is on a disk, the second in an anonymous volume
+	diskID := ""
+	for id := range s.d.currentHost.Disks {
+		diskID = id
+	}
+	c.Assert(diskID, Not(Equals), "")
+	replica1, err := s.d.createReplica(replica1Data, diskID)
 	c.Assert(err, IsNil)
 	c.Assert(replica1.ID, NotNil)
+	c.Assert(replica1.DiskID, Equals, diskID)
 	s.instanceBin[replica1.ID] = replica1
 
 	c.Assert(replica1.HostID, Equals, s.d.GetCurrentHostID())
@@ -125,7 +132,7 @@ func (s *TestSuite) TestCreateVolume(c *C) {
 		InstanceName: Replica2Name,
 		EngineImage:  volume.EngineImage,
 	}
-	replica2, err := s.d.createReplica(replica2Data)
+	replica2, err := s.d.createReplica(replica2Data, "")
 	c.Assert(err, IsNil)
 	c.Assert(replica2.ID, NotNil)
 	s.instanceBin[replica2.ID] = replica2
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	HeartbeatInterval = 5 * time.Second
+	// HostDownTimeout is how long a host can miss its heartbeat before
+	// it's considered down
+	HostDownTimeout = 30 * time.Second
+	// SelfFenceTimeout is how long a host can fail to send its heartbeat
+	// before stopping its controllers. It's shorter than HostDownTimeout,
+	// so the controllers are stopped before their volumes are failed over
+	// to other hosts.
+	SelfFenceTimeout = 15 * time.Second
+	// FenceMargin is added to the timeouts for the controllers of a host
+	// which is down to be considered stopped. It covers the clock skew
+	// between the hosts and the time taken to stop the controllers.
+	FenceMargin = 15 * time.Second
+)
+
+func (d *dockerOrc) RunHeartbeat(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	lastHeartbeat := time.Now()
+	fenced := false
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		d.hostLock.Lock()
+		updateStorage(d.currentHost)
+		err := d.kv.UpdateHostHeartbeat(d.currentHost)
+		d.hostLock.Unlock()
+		if err != nil {
+			logrus.Errorf("Fail to send heartbeat: %v", err)
+			if !fenced && time.Since(lastHeartbeat) > SelfFenceTimeout {
+				logrus.Warnf("Fail to send heartbeat since %v, fencing the controllers", lastHeartbeat)
+				if err := d.fenceControllers(); err != nil {
+					logrus.Errorf("Fail to fence the controllers: %v", err)
+				} else {
+					fenced = true
+				}
+			}
+			continue
+		}
+		lastHeartbeat = time.Now()
+		fenced = false
+	}
+}
+
+func hostState(host *types.HostInfo, now time.Time) types.HostState {
+	if host.LastHeartbeat == "" {
+		return types.HostStateDown
+	}
+	heartbeat, err := util.ParseTime(host.LastHeartbeat)
+	if err != nil {
+		logrus.Warnf("Invalid heartbeat %v of host %v: %v", host.LastHeartbeat, host.UUID, err)
+		return types.HostStateDown
+	}
+	if now.Sub(heartbeat) > HostDownTimeout {
+		return types.HostStateDown
+	}
+	return types.HostStateUp
+}
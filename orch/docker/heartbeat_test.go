@@ -0,0 +1,30 @@
+package docker
+
+import (
+	"time"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type HeartbeatSuite struct{}
+
+var _ = Suite(&HeartbeatSuite{})
+
+func (s *HeartbeatSuite) TestHostState(c *C) {
+	now := time.Now()
+	host := &types.HostInfo{
+		UUID: "host-1",
+	}
+	c.Assert(hostState(host, now), Equals, types.HostStateDown)
+
+	host.LastHeartbeat = now.Add(-HeartbeatInterval).UTC().Format(time.RFC3339)
+	c.Assert(hostState(host, now), Equals, types.HostStateUp)
+
+	host.LastHeartbeat = now.Add(-HostDownTimeout - time.Second).UTC().Format(time.RFC3339)
+	c.Assert(hostState(host, now), Equals, types.HostStateDown)
+
+	host.LastHeartbeat = "invalid"
+	c.Assert(hostState(host, now), Equals, types.HostStateDown)
+}
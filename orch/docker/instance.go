@@ -2,7 +2,7 @@ package docker
 
 import (
 	"encoding/json"
-	"fmt"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -14,7 +14,9 @@ import (
 
 	dTypes "github.com/docker/docker/api/types"
 	dContainer "github.com/docker/docker/api/types/container"
+	dCli "github.com/docker/docker/client"
 
+	"github.com/rancher/longhorn-manager/kvstore"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
@@ -61,12 +63,13 @@ func (d *dockerOrc) ProcessSchedule(item *types.ScheduleItem) (*types.InstanceIn
 		Type:       item.Instance.Type,
 		VolumeName: item.Instance.VolumeName,
 		Name:       item.Instance.Name,
+		DiskID:     item.Instance.DiskID,
 	}
 	switch item.Action {
 	case types.ScheduleActionCreateController:
 		instance, err = d.createController(&data)
 	case types.ScheduleActionCreateReplica:
-		instance, err = d.createReplica(&data)
+		instance, err = d.createReplica(&data, item.Instance.DiskID)
 	case types.ScheduleActionStartInstance:
 		instance, err = d.startInstance(input)
 	case types.ScheduleActionStopInstance:
@@ -97,11 +100,18 @@ func (d *dockerOrc) ProcessSchedule(item *types.ScheduleItem) (*types.InstanceIn
 }
 
 func (d *dockerOrc) CreateController(volumeName, controllerName string, replicas map[string]*types.ReplicaInfo) (*types.ControllerInfo, error) {
+	volume, err := d.kv.GetVolume(volumeName)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create controller")
+	}
+	if volume == nil {
+		return nil, errors.Errorf("unable to find volume %v", volumeName)
+	}
 	replicaNames := []string{}
 	for name := range replicas {
 		replicaNames = append(replicaNames, name)
 	}
-	data, err := d.prepareCreateController(volumeName, controllerName, replicaNames)
+	data, err := d.prepareCreateController(volume, controllerName, replicaNames)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Fail to create controller for %v", volumeName)
 	}
@@ -115,7 +125,11 @@ func (d *dockerOrc) CreateController(volumeName, controllerName string, replicas
 		},
 		Data: *data,
 	}
-	instance, err := d.scheduler.Schedule(schedule, nil)
+	// The controller is always on the current host, the policy only checks
+	// the host is allowed
+	policy := d.prepareCreateControllerPolicy(volume)
+
+	instance, err := d.scheduler.Schedule(schedule, policy)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Fail to create controller for %v", volumeName)
 	}
@@ -124,18 +138,17 @@ func (d *dockerOrc) CreateController(volumeName, controllerName string, replicas
 	}, nil
 }
 
-func (d *dockerOrc) prepareCreateController(volumeName, controllerName string, replicaNames []string) (*types.ScheduleData, error) {
-	volume, err := d.kv.GetVolume(volumeName)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to create controller")
-	}
-	if volume == nil {
-		return nil, errors.Wrapf(err, "unable to find volume %v", volumeName)
+func (d *dockerOrc) prepareCreateControllerPolicy(volume *types.VolumeInfo) *types.SchedulePolicy {
+	return &types.SchedulePolicy{
+		HostIDMap:    map[string]struct{}{},
+		HostSelector: volume.HostSelector,
 	}
+}
 
+func (d *dockerOrc) prepareCreateController(volume *types.VolumeInfo, controllerName string, replicaNames []string) (*types.ScheduleData, error) {
 	data := &dockerScheduleData{
 		InstanceName: controllerName,
-		VolumeName:   volumeName,
+		VolumeName:   volume.Name,
 		EngineImage:  volume.EngineImage,
 		ReplicaURLs:  []string{},
 	}
@@ -173,8 +186,9 @@ func (d *dockerOrc) createController(data *dockerScheduleData) (instance *types.
 
 	createBody, err := d.cli.ContainerCreate(context.Background(),
 		&dContainer.Config{
-			Image: data.EngineImage,
-			Cmd:   cmd,
+			Image:  data.EngineImage,
+			Cmd:    cmd,
+			Labels: instanceLabels(data.VolumeName, types.InstanceTypeController),
 		},
 		&dContainer.HostConfig{
 			Binds: []string{
@@ -249,7 +263,10 @@ func (d *dockerOrc) CreateReplica(volumeName, replicaName string) (*types.Replic
 		Data: *data,
 	}
 
-	policy := d.prepareCreateReplicaPolicy(volume)
+	policy, err := d.prepareCreateReplicaPolicy(volume)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
 
 	instance, err := d.scheduler.Schedule(schedule, policy)
 	if err != nil {
@@ -260,17 +277,53 @@ func (d *dockerOrc) CreateReplica(volumeName, replicaName string) (*types.Replic
 	}, nil
 }
 
-func (d *dockerOrc) prepareCreateReplicaPolicy(volume *types.VolumeInfo) *types.SchedulePolicy {
+func (d *dockerOrc) ExplainReplicaSchedule(volume *types.VolumeInfo) ([]*types.ScheduleCandidate, error) {
+	policy, err := d.prepareCreateReplicaPolicy(volume)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to explain replica schedule for %v", volume.Name)
+	}
+	item := &types.ScheduleItem{
+		Action: types.ScheduleActionCreateReplica,
+		Instance: types.ScheduleInstance{
+			Type:       types.InstanceTypeReplica,
+			VolumeName: volume.Name,
+		},
+	}
+	candidates, err := d.scheduler.Evaluate(item, policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to explain replica schedule for %v", volume.Name)
+	}
+	return candidates, nil
+}
+
+// prepareCreateReplicaPolicy spreads the replicas over the zones first, then
+// the hosts
+func (d *dockerOrc) prepareCreateReplicaPolicy(volume *types.VolumeInfo) (*types.SchedulePolicy, error) {
+	hosts, err := d.ListHosts()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list hosts for replica policy")
+	}
+	binding := volume.ReplicaBinding
+	if binding == "" {
+		binding = types.SchedulePolicyBindingSoftAntiAffinity
+	}
 	policy := &types.SchedulePolicy{
-		Binding:   types.SchedulePolicyBindingSoftAntiAffinity,
-		HostIDMap: map[string]struct{}{},
+		Binding:      binding,
+		HostIDMap:    map[string]struct{}{},
+		ZoneMap:      map[string]struct{}{},
+		HostSelector: volume.HostSelector,
+		DiskSelector: volume.DiskSelector,
+		Size:         volume.Size,
 	}
 	for _, replica := range volume.Replicas {
 		if replica.BadTimestamp == "" {
 			policy.HostIDMap[replica.HostID] = struct{}{}
+			if host := hosts[replica.HostID]; host != nil && host.Zone != "" {
+				policy.ZoneMap[host.Zone] = struct{}{}
+			}
 		}
 	}
-	return policy
+	return policy, nil
 }
 
 func (d *dockerOrc) prepareCreateReplica(volume *types.VolumeInfo, replicaName string) (*types.ScheduleData, error) {
@@ -293,25 +346,40 @@ func (d *dockerOrc) prepareCreateReplica(volume *types.VolumeInfo, replicaName s
 	}, nil
 }
 
-func (d *dockerOrc) createReplica(data *dockerScheduleData) (*types.InstanceInfo, error) {
+// createReplica keeps the data in the directory of the replica on the disk,
+// or in an anonymous docker volume if no disk is specified
+func (d *dockerOrc) createReplica(data *dockerScheduleData, diskID string) (*types.InstanceInfo, error) {
 	cmd := []string{
 		"launch", "replica",
 		"--listen", "0.0.0.0:9502",
 		"--size", data.VolumeSize,
 		"/volume",
 	}
-	createBody, err := d.cli.ContainerCreate(context.Background(),
-		&dContainer.Config{
-			Image: data.EngineImage,
-			Volumes: map[string]struct{}{
-				"/volume": {},
-			},
-			Cmd: cmd,
-		},
-		&dContainer.HostConfig{
-			Privileged:  true,
-			NetworkMode: dContainer.NetworkMode(d.Network),
-		}, nil, data.InstanceName)
+	config := &dContainer.Config{
+		Image:  data.EngineImage,
+		Cmd:    cmd,
+		Labels: instanceLabels(data.VolumeName, types.InstanceTypeReplica),
+	}
+	hostConfig := &dContainer.HostConfig{
+		Privileged:  true,
+		NetworkMode: dContainer.NetworkMode(d.Network),
+	}
+	dataPath := ""
+	if diskID == "" {
+		config.Volumes = map[string]struct{}{
+			"/volume": {},
+		}
+	} else {
+		var err error
+		dataPath, err = d.replicaDataPath(diskID, data.InstanceName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to create replica for %v", data.VolumeName)
+		}
+		hostConfig.Binds = []string{
+			dataPath + ":/volume",
+		}
+	}
+	createBody, err := d.cli.ContainerCreate(context.Background(), config, hostConfig, nil, data.InstanceName)
 	if err != nil {
 		return nil, errors.Wrapf(err, "fail to create replica for %v", data.VolumeName)
 	}
@@ -322,6 +390,16 @@ func (d *dockerOrc) createReplica(data *dockerScheduleData) (*types.InstanceInfo
 		Name:       data.InstanceName,
 		Type:       types.InstanceTypeReplica,
 		VolumeName: data.VolumeName,
+		DiskID:     diskID,
+	}
+	// The directory is only created once the name is known to be free,
+	// removeInstance removes it along the container on failure
+	if dataPath != "" {
+		if err := os.MkdirAll(dataPath, 0700); err != nil {
+			logrus.Errorf("fail to create replica %v of %v, cleaning up: %v", data.InstanceName, data.VolumeName, err)
+			d.removeInstance(input)
+			return nil, errors.Wrapf(err, "fail to create replica for %v", data.VolumeName)
+		}
 	}
 	instance, err := d.refreshInstanceInfo(input)
 	if err != nil {
@@ -347,6 +425,7 @@ func (d *dockerOrc) refreshInstanceInfo(instance *types.InstanceInfo) (*types.In
 		HostID:     d.GetCurrentHostID(),
 		Running:    inspectJSON.State.Running,
 		VolumeName: instance.VolumeName,
+		DiskID:     instance.DiskID,
 	}
 	if d.Network == "" {
 		info.Address = inspectJSON.NetworkSettings.IPAddress
@@ -354,9 +433,9 @@ func (d *dockerOrc) refreshInstanceInfo(instance *types.InstanceInfo) (*types.In
 		info.Address = inspectJSON.NetworkSettings.Networks[d.Network].IPAddress
 	}
 	if info.Running && info.Address == "" {
-		msg := fmt.Sprintf("BUG: Cannot find IP address of %v", instance.ID)
-		logrus.Errorf(msg)
-		return nil, errors.Errorf(msg)
+		err := errors.Errorf("BUG: Cannot find IP address of %v", instance.ID)
+		logrus.Error(err)
+		return nil, err
 	}
 	return info, nil
 }
@@ -375,6 +454,7 @@ func getScheduleInstanceFromInstance(instance *types.InstanceInfo) (*types.Sched
 		HostID:     instance.HostID,
 		VolumeName: instance.VolumeName,
 		Name:       instance.Name,
+		DiskID:     instance.DiskID,
 	}, nil
 }
 
@@ -430,6 +510,10 @@ func (d *dockerOrc) StopInstance(instance *types.InstanceInfo) (*types.InstanceI
 func (d *dockerOrc) stopInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
 	if err := d.cli.ContainerStop(context.Background(),
 		instance.ID, &ContainerStopTimeout); err != nil {
+		// The container has gone, e.g. found missing by ReconcileVolume
+		if dCli.IsErrContainerNotFound(err) {
+			return missingInstance(instance), nil
+		}
 		return nil, errors.Wrapf(err, "fail to start instance '%v'", instance.ID)
 	}
 	return d.refreshInstanceInfo(instance)
@@ -458,17 +542,34 @@ func (d *dockerOrc) RemoveInstance(instance *types.InstanceInfo) (*types.Instanc
 	return ret, nil
 }
 
+// removeInstance also removes the data of the replica on the disk. The
+// data is left behind if the disk is no longer registered.
 func (d *dockerOrc) removeInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
 	if err := d.removeContainer(instance.ID); err != nil {
 		return nil, errors.Wrapf(err, "Fail to remove instance %v", instance.ID)
 	}
+	if instance.Type != types.InstanceTypeReplica || instance.DiskID == "" || instance.Name == "" {
+		return instance, nil
+	}
+	dataPath, err := d.replicaDataPath(instance.DiskID, instance.Name)
+	if err != nil {
+		logrus.Warnf("Fail to remove the data of replica %v: %v", instance.Name, err)
+		return instance, nil
+	}
+	if err := os.RemoveAll(dataPath); err != nil {
+		return nil, errors.Wrapf(err, "Fail to remove the data of replica %v at %v", instance.Name, dataPath)
+	}
 	return instance, nil
 }
 
 func (d *dockerOrc) removeContainer(id string) error {
-	return d.cli.ContainerRemove(context.Background(), id, dTypes.ContainerRemoveOptions{
+	err := d.cli.ContainerRemove(context.Background(), id, dTypes.ContainerRemoveOptions{
 		RemoveVolumes: true,
 	})
+	if dCli.IsErrContainerNotFound(err) {
+		return nil
+	}
+	return err
 }
 
 func (d *dockerOrc) updateInstanceMetadata(instance *types.InstanceInfo) (err error) {
@@ -490,32 +591,40 @@ func (d *dockerOrc) updateInstanceMetadata(instance *types.InstanceInfo) (err er
 			return errors.Errorf("unable to update instance metadata: metadata conflict: %+v %+v",
 				controller, instance)
 		}
-		if err := d.kv.SetVolumeController(&types.ControllerInfo{*instance}); err != nil {
+		if err := d.kv.SetVolumeController(&types.ControllerInfo{InstanceInfo: *instance}); err != nil {
 			return errors.Wrapf(err, "fail to update controller metadata: %+v", controller)
 		}
 	} else if instance.Type == types.InstanceTypeReplica {
-		replica, err := d.kv.GetVolumeReplica(instance.VolumeName, instance.Name)
-		if err != nil {
-			return errors.Wrapf(err, "unable to update instance metadata: cannot get replica %v for volume %v",
-				instance.Name, instance.VolumeName)
-		}
-		if replica != nil {
-			if replica.ID != instance.ID || replica.HostID != instance.HostID {
-				return errors.Errorf("unable to update instance metadata: replica %v metadata conflict: %+v %+v",
-					instance.Name, replica, instance)
-			}
-			replica.InstanceInfo = *instance
-		} else {
-			replica = &types.ReplicaInfo{InstanceInfo: *instance}
-		}
-		if err := d.kv.SetVolumeReplica(replica); err != nil {
-			return errors.Wrapf(err, "fail to update replica metadata: %+v", replica)
-		}
+		// Don't overwrite e.g. the bad mark set concurrently by the monitor
+		return kvstore.RetryOnConflict(func() error {
+			return d.updateReplicaMetadata(instance)
+		})
 	}
 
 	return nil
 }
 
+func (d *dockerOrc) updateReplicaMetadata(instance *types.InstanceInfo) error {
+	replica, err := d.kv.GetVolumeReplica(instance.VolumeName, instance.Name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to update instance metadata: cannot get replica %v for volume %v",
+			instance.Name, instance.VolumeName)
+	}
+	if replica != nil {
+		if replica.ID != instance.ID || replica.HostID != instance.HostID {
+			return errors.Errorf("unable to update instance metadata: replica %v metadata conflict: %+v %+v",
+				instance.Name, replica, instance)
+		}
+		replica.InstanceInfo = *instance
+	} else {
+		replica = &types.ReplicaInfo{InstanceInfo: *instance}
+	}
+	if err := d.kv.UpdateVolumeReplica(replica); err != nil {
+		return errors.Wrapf(err, "fail to update replica metadata: %+v", replica)
+	}
+	return nil
+}
+
 func (d *dockerOrc) removeInstanceMetadata(instance *types.InstanceInfo) (err error) {
 	if instance.ID == "" ||
 		instance.Name == "" ||
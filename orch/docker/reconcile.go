@@ -0,0 +1,243 @@
+package docker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	dTypes "github.com/docker/docker/api/types"
+	dFilters "github.com/docker/docker/api/types/filters"
+	dCli "github.com/docker/docker/client"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	// The labels of the containers created for the instances. The
+	// containers created before the labels existed won't be found as
+	// orphans.
+	LabelVolume       = "io.rancher.longhorn.volume"
+	LabelInstanceType = "io.rancher.longhorn.instance-type"
+)
+
+func instanceLabels(volumeName string, instanceType types.InstanceType) map[string]string {
+	return map[string]string{
+		LabelVolume:       volumeName,
+		LabelInstanceType: string(instanceType),
+	}
+}
+
+func (d *dockerOrc) ReconcileVolume(volumeName string) (*types.ReconcileResult, error) {
+	volume, err := d.kv.GetVolume(volumeName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to reconcile volume %v", volumeName)
+	}
+	result := &types.ReconcileResult{
+		Updated: []*types.InstanceInfo{},
+		Missing: []*types.InstanceInfo{},
+	}
+	if volume == nil {
+		return result, nil
+	}
+
+	if volume.Controller != nil && volume.Controller.HostID == d.GetCurrentHostID() {
+		instance := &volume.Controller.InstanceInfo
+		info, err := d.inspectInstance(instance)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			// The monitor will find the controller failed, and detach
+			// the volume
+			info = missingInstance(instance)
+			result.Missing = append(result.Missing, instance)
+		}
+		if info.Running != instance.Running || info.Address != instance.Address {
+			if err := d.kv.SetVolumeController(&types.ControllerInfo{InstanceInfo: *info}); err != nil {
+				return nil, errors.Wrapf(err, "fail to update controller of volume %v", volumeName)
+			}
+			result.Updated = append(result.Updated, info)
+		}
+	}
+
+	for _, replica := range volume.Replicas {
+		if replica.HostID != d.GetCurrentHostID() {
+			continue
+		}
+		info, err := d.inspectInstance(&replica.InstanceInfo)
+		if err != nil {
+			return nil, err
+		}
+		missing := info == nil
+		if missing {
+			info = missingInstance(&replica.InstanceInfo)
+			result.Missing = append(result.Missing, &replica.InstanceInfo)
+		}
+		if info.Running == replica.Running && info.Address == replica.Address &&
+			(!missing || replica.BadTimestamp != "") {
+			continue
+		}
+		replica.InstanceInfo = *info
+		if missing && replica.BadTimestamp == "" {
+			replica.BadTimestamp = util.Now()
+		}
+		if err := d.kv.UpdateVolumeReplica(replica); err != nil {
+			return nil, errors.Wrapf(err, "fail to update replica %v of volume %v", replica.Name, volumeName)
+		}
+		result.Updated = append(result.Updated, info)
+	}
+	return result, nil
+}
+
+// inspectInstance returns nil if the container doesn't exist
+func (d *dockerOrc) inspectInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	info, err := d.refreshInstanceInfo(instance)
+	if err != nil {
+		if dCli.IsErrContainerNotFound(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+func missingInstance(instance *types.InstanceInfo) *types.InstanceInfo {
+	info := *instance
+	info.Running = false
+	info.Address = ""
+	return &info
+}
+
+func (d *dockerOrc) ListOrphanInstances(grace time.Duration) ([]*types.InstanceInfo, error) {
+	filters := dFilters.NewArgs()
+	filters.Add("label", LabelVolume)
+	containers, err := d.cli.ContainerList(context.Background(), dTypes.ContainerListOptions{
+		All:     true,
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to list containers")
+	}
+
+	volumes, err := d.kv.ListVolumes()
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to list volumes")
+	}
+	known := map[string]struct{}{}
+	for _, volume := range volumes {
+		if volume.Controller != nil {
+			known[volume.Controller.ID] = struct{}{}
+		}
+		for _, replica := range volume.Replicas {
+			known[replica.ID] = struct{}{}
+		}
+	}
+
+	// The container is created before its instance is recorded
+	createdBefore := time.Now().Add(-grace).Unix()
+	orphans := []*types.InstanceInfo{}
+	for _, container := range containers {
+		if _, ok := known[container.ID]; ok || container.Created > createdBefore {
+			continue
+		}
+		name := ""
+		if len(container.Names) != 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		orphans = append(orphans, &types.InstanceInfo{
+			ID:         container.ID,
+			Type:       types.InstanceType(container.Labels[LabelInstanceType]),
+			Name:       name,
+			HostID:     d.GetCurrentHostID(),
+			Running:    container.State == "running",
+			VolumeName: container.Labels[LabelVolume],
+		})
+	}
+	return orphans, nil
+}
+
+// RemoveOrphanInstance removes the container directly, since the orphan has
+// no metadata to be updated by the scheduler
+func (d *dockerOrc) RemoveOrphanInstance(instance *types.InstanceInfo) error {
+	if instance.HostID != d.GetCurrentHostID() {
+		return errors.Errorf("cannot remove orphan %v on another host %v", instance.ID, instance.HostID)
+	}
+	if instance.Running {
+		if err := d.stopContainer(instance.ID); err != nil {
+			return errors.Wrapf(err, "fail to stop orphan %v", instance.ID)
+		}
+	}
+	if err := d.removeContainer(instance.ID); err != nil {
+		return errors.Wrapf(err, "fail to remove orphan %v", instance.ID)
+	}
+	logrus.Infof("Removed orphan container %v(%v) of volume %v", instance.Name, instance.ID, instance.VolumeName)
+	return nil
+}
+
+// FenceInstances works on the key value store only, the containers on the
+// hosts which are down can't be reached. They're stopped by fenceControllers
+// if the host is still running, or found by ListOrphanInstances once it's
+// back.
+func (d *dockerOrc) FenceInstances(volumeName string) ([]*types.InstanceInfo, error) {
+	volume, err := d.kv.GetVolume(volumeName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fence volume %v", volumeName)
+	}
+	if volume == nil {
+		return nil, errors.Errorf("unable to fence volume %v, it doesn't exist", volumeName)
+	}
+	hosts, err := d.ListHosts()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fence volume %v, cannot list hosts", volumeName)
+	}
+	isDown := func(hostID string) bool {
+		host, ok := hosts[hostID]
+		return !ok || host.State == types.HostStateDown
+	}
+
+	fenced := []*types.InstanceInfo{}
+	if volume.Controller != nil && isDown(volume.Controller.HostID) {
+		if err := d.kv.DeleteVolumeController(volumeName); err != nil {
+			return nil, errors.Wrapf(err, "fail to fence controller of volume %v", volumeName)
+		}
+		fenced = append(fenced, &volume.Controller.InstanceInfo)
+	}
+	for _, replica := range volume.Replicas {
+		if !isDown(replica.HostID) || (!replica.Running && replica.BadTimestamp != "") {
+			continue
+		}
+		replica.InstanceInfo = *missingInstance(&replica.InstanceInfo)
+		if replica.BadTimestamp == "" {
+			replica.BadTimestamp = util.Now()
+		}
+		if err := d.kv.UpdateVolumeReplica(replica); err != nil {
+			return nil, errors.Wrapf(err, "fail to fence replica %v of volume %v", replica.Name, volumeName)
+		}
+		fenced = append(fenced, &replica.InstanceInfo)
+	}
+	return fenced, nil
+}
+
+// fenceControllers stops the controllers of the current host, once it has
+// lost the key value store long enough for their volumes to be failed over
+func (d *dockerOrc) fenceControllers() error {
+	filters := dFilters.NewArgs()
+	filters.Add("label", LabelInstanceType+"="+string(types.InstanceTypeController))
+	containers, err := d.cli.ContainerList(context.Background(), dTypes.ContainerListOptions{
+		Filters: filters,
+	})
+	if err != nil {
+		return errors.Wrap(err, "fail to list controllers")
+	}
+	for _, container := range containers {
+		if err := d.stopContainer(container.ID); err != nil {
+			return errors.Wrapf(err, "fail to stop controller %v of volume %v", container.ID, container.Labels[LabelVolume])
+		}
+		logrus.Warnf("Fenced controller %v of volume %v", container.ID, container.Labels[LabelVolume])
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+type diskFilter struct{}
+
+func (diskFilter) Name() string {
+	return "disk"
+}
+
+// Filter only checks the replicas. The hosts without disk keep the replicas
+// in anonymous docker volumes, so they're only rejected if the policy has a
+// disk selector.
+func (diskFilter) Filter(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) string {
+	if item.Instance.Type != types.InstanceTypeReplica {
+		return ""
+	}
+	if len(host.Disks) == 0 {
+		if policy != nil && len(policy.DiskSelector) != 0 {
+			return "host has no disk"
+		}
+		return ""
+	}
+	if ChooseDisk(policy, host) != nil {
+		return ""
+	}
+	if policy != nil && len(policy.DiskSelector) != 0 {
+		return fmt.Sprintf("host has no schedulable disk with tags %v", strings.Join(policy.DiskSelector, ","))
+	}
+	return "host has no schedulable disk"
+}
+
+// ChooseDisk returns the schedulable disk of the host matching the disk
+// selector with the most space not yet provisioned, or nil if there is none.
+// The space available is used for the disks which haven't reported their
+// capacity.
+func ChooseDisk(policy *types.SchedulePolicy, host *HostStatus) *types.DiskInfo {
+	var (
+		chosen *types.DiskInfo
+		free   int64
+	)
+	for _, disk := range host.Disks {
+		if !disk.Schedulable || !diskHasTags(disk, policy) {
+			continue
+		}
+		f := disk.StorageAvailable
+		if disk.StorageCapacity > 0 {
+			f = disk.StorageCapacity - host.Load.DiskProvisioned[disk.ID]
+		}
+		// Break the ties by ID, since the disks come in random order
+		if chosen == nil || f > free || (f == free && disk.ID < chosen.ID) {
+			chosen = disk
+			free = f
+		}
+	}
+	return chosen
+}
+
+func diskHasTags(disk *types.DiskInfo, policy *types.SchedulePolicy) bool {
+	if policy == nil {
+		return true
+	}
+	for _, selector := range policy.DiskSelector {
+		found := false
+		for _, tag := range disk.Tags {
+			if tag == selector {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package scheduler
+
+import (
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	// MaxLoadScore is below AntiAffinityScore, so the load only decides
+	// between the hosts equally good for the anti-affinity
+	MaxLoadScore = AntiAffinityScore / 2
+)
+
+// LoadScorer prefers the hosts with fewer replicas, fewer rebuilds in
+// progress, and more disk left once the instance is provisioned. The weights
+// are how much each of them counts, and the score is between 0 and
+// MaxLoadScore.
+type LoadScorer struct {
+	ReplicaWeight int
+	DiskWeight    int
+	RebuildWeight int
+}
+
+func NewLoadScorer() *LoadScorer {
+	return &LoadScorer{
+		ReplicaWeight: 1,
+		DiskWeight:    2,
+		RebuildWeight: 2,
+	}
+}
+
+func (s *LoadScorer) Name() string {
+	return "load"
+}
+
+func (s *LoadScorer) Score(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) int {
+	total := s.ReplicaWeight + s.DiskWeight + s.RebuildWeight
+	if total <= 0 {
+		return 0
+	}
+	var size int64
+	if policy != nil {
+		size = policy.Size
+	}
+	score := float64(s.ReplicaWeight)/float64(1+host.Load.Replicas) +
+		float64(s.DiskWeight)*diskFactor(host, size) +
+		float64(s.RebuildWeight)/float64(1+host.Load.Rebuilding)
+	return int(score * MaxLoadScore / float64(total))
+}
+
+// diskFactor is between 0 and 1, the average of the capacity not yet
+// provisioned and the capacity still available. It's 0.5 if the host
+// hasn't reported its capacity.
+func diskFactor(host *HostStatus, size int64) float64 {
+	if host.StorageCapacity <= 0 {
+		return 0.5
+	}
+	capacity := float64(host.StorageCapacity)
+	unprovisioned := 1 - float64(host.Load.Provisioned+size)/capacity
+	available := float64(host.StorageAvailable) / capacity
+	return (clamp(unprovisioned) + clamp(available)) / 2
+}
+
+func clamp(f float64) float64 {
+	if f < 0 {
+		return 0
+	}
+	if f > 1 {
+		return 1
+	}
+	return f
+}
@@ -0,0 +1,156 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	// AntiAffinityScore is given to the hosts without the other instances
+	// in the policy, so they're tried first. ZoneAntiAffinityScore is given
+	// to the hosts in the zones without them, and outweighs it to spread
+	// the instances over the zones first.
+	AntiAffinityScore     = 100
+	ZoneAntiAffinityScore = 1000
+)
+
+// HostStatus is what the plugins know about a host. Load is never nil.
+type HostStatus struct {
+	*types.HostInfo
+	Load *types.HostLoad
+}
+
+// FilterPlugin rejects the hosts the instance can't be scheduled to. Filter
+// returns why the host is rejected, or "" if it's accepted. policy can be
+// nil.
+type FilterPlugin interface {
+	Name() string
+	Filter(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) string
+}
+
+// ScorePlugin ranks the hosts accepted by the filters. The scores of all the
+// plugins are added up, and the instance is scheduled to the host with the
+// highest score first. policy can be nil.
+type ScorePlugin interface {
+	Name() string
+	Score(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) int
+}
+
+func DefaultFilters() []FilterPlugin {
+	return []FilterPlugin{
+		hostUpFilter{},
+		antiAffinityFilter{},
+		hostSelectorFilter{},
+		diskFilter{},
+	}
+}
+
+func DefaultScorers() []ScorePlugin {
+	return []ScorePlugin{
+		antiAffinityScorer{},
+		zoneAntiAffinityScorer{},
+		NewLoadScorer(),
+	}
+}
+
+type hostUpFilter struct{}
+
+func (hostUpFilter) Name() string {
+	return "host-up"
+}
+
+func (hostUpFilter) Filter(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) string {
+	if host.State == types.HostStateDown {
+		return fmt.Sprintf("host is down since %v", host.LastHeartbeat)
+	}
+	return ""
+}
+
+type antiAffinityFilter struct{}
+
+func (antiAffinityFilter) Name() string {
+	return "anti-affinity"
+}
+
+func (antiAffinityFilter) Filter(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) string {
+	if policy == nil || policy.Binding != types.SchedulePolicyBindingHardAntiAffinity {
+		return ""
+	}
+	if _, ok := policy.HostIDMap[host.UUID]; ok {
+		return fmt.Sprintf("host already has another %v of volume %v", item.Instance.Type, item.Instance.VolumeName)
+	}
+	return ""
+}
+
+type hostSelectorFilter struct{}
+
+func (hostSelectorFilter) Name() string {
+	return "host-selector"
+}
+
+func (hostSelectorFilter) Filter(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) string {
+	if policy == nil {
+		return ""
+	}
+	missing := []string{}
+	for _, selector := range policy.HostSelector {
+		if !hasTag(host, selector) {
+			missing = append(missing, selector)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Sprintf("host doesn't have tags %v", strings.Join(missing, ","))
+	}
+	return ""
+}
+
+// hasTag also matches "zone=<zone>" and "region=<region>" of the host
+func hasTag(host *HostStatus, tag string) bool {
+	if host.Zone != "" && tag == "zone="+host.Zone {
+		return true
+	}
+	if host.Region != "" && tag == "region="+host.Region {
+		return true
+	}
+	for _, t := range host.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type antiAffinityScorer struct{}
+
+func (antiAffinityScorer) Name() string {
+	return "anti-affinity"
+}
+
+func (antiAffinityScorer) Score(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) int {
+	if policy == nil {
+		return 0
+	}
+	if _, ok := policy.HostIDMap[host.UUID]; ok {
+		return 0
+	}
+	return AntiAffinityScore
+}
+
+type zoneAntiAffinityScorer struct{}
+
+func (zoneAntiAffinityScorer) Name() string {
+	return "zone-anti-affinity"
+}
+
+// Score ignores the hosts without zone
+func (zoneAntiAffinityScorer) Score(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) int {
+	if policy == nil || host.Zone == "" {
+		return 0
+	}
+	if _, ok := policy.ZoneMap[host.Zone]; ok {
+		return 0
+	}
+	return ZoneAntiAffinityScore
+}
@@ -1,6 +1,10 @@
 package scheduler
 
 import (
+	"sort"
+	"strings"
+	"sync"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
@@ -8,68 +12,173 @@ import (
 )
 
 type OrcScheduler struct {
-	ops types.ScheduleOps
+	ops     types.ScheduleOps
+	filters []FilterPlugin
+	scorers []ScorePlugin
+}
+
+var (
+	pluginsMutex sync.Mutex
+	filters      []FilterPlugin
+	scorers      []ScorePlugin
+)
+
+// RegisterFilterPlugin adds a filter to all the schedulers created
+// afterwards, after the default ones. It's meant to be called from the init()
+// of the package providing the plugin.
+func RegisterFilterPlugin(plugin FilterPlugin) {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	filters = append(filters, plugin)
 }
 
+// RegisterScorePlugin adds a scorer to all the schedulers created afterwards.
+// It's meant to be called from the init() of the package providing the
+// plugin.
+func RegisterScorePlugin(plugin ScorePlugin) {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	scorers = append(scorers, plugin)
+}
+
+// NewOrcScheduler creates a scheduler with the default plugins and the ones
+// registered by RegisterFilterPlugin and RegisterScorePlugin
 func NewOrcScheduler(ops types.ScheduleOps) *OrcScheduler {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
 	return &OrcScheduler{
-		ops: ops,
+		ops:     ops,
+		filters: append(DefaultFilters(), filters...),
+		scorers: append(DefaultScorers(), scorers...),
 	}
 }
 
-func randomHostID(m map[string]*types.HostInfo) string {
-	for k := range m {
-		return k
-	}
-	return ""
+// RegisterFilter adds a filter after the existing ones. The plugins should
+// be registered before anything is scheduled.
+func (s *OrcScheduler) RegisterFilter(plugin FilterPlugin) {
+	s.filters = append(s.filters, plugin)
+}
+
+// RegisterScorer adds a scorer to the existing ones. The plugins should be
+// registered before anything is scheduled.
+func (s *OrcScheduler) RegisterScorer(plugin ScorePlugin) {
+	s.scorers = append(s.scorers, plugin)
 }
 
 func (s *OrcScheduler) Schedule(item *types.ScheduleItem, policy *types.SchedulePolicy) (*types.InstanceInfo, error) {
 	if item.Instance.ID == "" || item.Instance.Type == types.InstanceTypeNone {
 		return nil, errors.Errorf("instance ID and type required for scheduling")
 	}
-	if item.Instance.HostID != "" {
+	// The existing instances go where they are
+	if item.Instance.HostID != "" && policy == nil {
 		return s.ScheduleProcess(&types.ScheduleSpec{
 			HostID: item.Instance.HostID,
 		}, item)
 	}
 
-	hosts, err := s.ops.ListHosts()
+	candidates, err := s.Evaluate(item, policy)
 	if err != nil {
 		return nil, errors.Wrap(err, "fail to schedule")
 	}
+	rejected := []string{}
+	for _, candidate := range candidates {
+		if candidate.Reason != "" {
+			logrus.Debugf("Skip host %v for scheduling %v: %v", candidate.HostID, item.Instance.ID, candidate.Reason)
+			rejected = append(rejected, candidate.HostID+": "+candidate.Reason)
+			continue
+		}
+		scheduled := item
+		if candidate.DiskID != "" {
+			copied := *item
+			copied.Instance.DiskID = candidate.DiskID
+			scheduled = &copied
+		}
+		ret, err := s.ScheduleProcess(&types.ScheduleSpec{HostID: candidate.HostID}, scheduled)
+		if err == nil {
+			return ret, nil
+		}
+		logrus.Warnf("Fail to schedule %+v on host %v, trying on another one: %v",
+			item.Instance, candidate.HostID, err)
+	}
+	if len(rejected) != 0 {
+		return nil, errors.Errorf("unable to find suitable host for scheduling, rejected %v", strings.Join(rejected, "; "))
+	}
+	return nil, errors.Errorf("unable to find suitable host for scheduling")
+}
 
-	normalPriorityList := []string{}
-	lowPriorityList := []string{}
+// Evaluate runs the filters and the scorers over the hosts, without
+// scheduling anything. Only the host of the instance is considered if it's
+// set. The hosts accepted come first, sorted by score from the highest,
+// followed by the hosts rejected. The disk is chosen for the replicas on the
+// hosts accepted.
+func (s *OrcScheduler) Evaluate(item *types.ScheduleItem, policy *types.SchedulePolicy) ([]*types.ScheduleCandidate, error) {
+	if policy != nil {
+		switch policy.Binding {
+		case "", types.SchedulePolicyBindingSoftAntiAffinity, types.SchedulePolicyBindingHardAntiAffinity:
+		default:
+			return nil, errors.Errorf("Unsupported schedule policy binding %v", policy.Binding)
+		}
+	}
 
-	for id := range hosts {
-		if policy != nil {
-			if policy.Binding == types.SchedulePolicyBindingSoftAntiAffinity {
-				if _, ok := policy.HostIDMap[id]; ok {
-					lowPriorityList = append(lowPriorityList, id)
-				} else {
-					normalPriorityList = append(normalPriorityList, id)
-				}
-			} else {
-				return nil, errors.Errorf("Unsupported schedule policy binding %v", policy.Binding)
-			}
-		} else {
-			normalPriorityList = append(normalPriorityList, id)
+	hosts := map[string]*types.HostInfo{}
+	if item.Instance.HostID != "" {
+		host, err := s.ops.GetHost(item.Instance.HostID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get host %v", item.Instance.HostID)
+		}
+		if host == nil {
+			return nil, errors.Errorf("cannot find host %v", item.Instance.HostID)
+		}
+		hosts[host.UUID] = host
+	} else {
+		var err error
+		if hosts, err = s.ops.ListHosts(); err != nil {
+			return nil, errors.Wrap(err, "cannot list hosts")
 		}
 	}
 
-	priorityList := append(normalPriorityList, lowPriorityList...)
+	loads, err := s.ops.ListHostLoads()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list host loads")
+	}
 
-	for _, id := range priorityList {
-		ret, err := s.ScheduleProcess(&types.ScheduleSpec{HostID: id}, item)
-		if err == nil {
-			return ret, nil
+	accepted := []*types.ScheduleCandidate{}
+	rejected := []*types.ScheduleCandidate{}
+	for id, info := range hosts {
+		host := &HostStatus{
+			HostInfo: info,
+			Load:     loads[id],
 		}
-
-		logrus.Warnf("Fail to schedule %+v on host %v, trying on another one: %v",
-			hosts[id], item.Instance, err)
+		if host.Load == nil {
+			host.Load = &types.HostLoad{}
+		}
+		candidate := &types.ScheduleCandidate{HostID: id}
+		for _, filter := range s.filters {
+			if reason := filter.Filter(item, policy, host); reason != "" {
+				candidate.Reason = filter.Name() + ": " + reason
+				break
+			}
+		}
+		if candidate.Reason != "" {
+			rejected = append(rejected, candidate)
+			continue
+		}
+		for _, scorer := range s.scorers {
+			candidate.Score += scorer.Score(item, policy, host)
+		}
+		if item.Instance.Type == types.InstanceTypeReplica {
+			if disk := ChooseDisk(policy, host); disk != nil {
+				candidate.DiskID = disk.ID
+			}
+		}
+		accepted = append(accepted, candidate)
 	}
-	return nil, errors.Errorf("unable to find suitable host for scheduling")
+	// The hosts come in random order from the map, so the hosts with the
+	// same score are tried in random order
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].Score > accepted[j].Score
+	})
+	return append(accepted, rejected...), nil
 }
 
 func (s *OrcScheduler) ScheduleProcess(spec *types.ScheduleSpec, item *types.ScheduleItem) (*types.InstanceInfo, error) {
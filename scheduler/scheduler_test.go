@@ -0,0 +1,383 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const GiB = int64(1024 * 1024 * 1024)
+
+type testScheduleOps struct {
+	hosts     map[string]*types.HostInfo
+	loads     map[string]*types.HostLoad
+	processed []*types.ScheduleItem
+}
+
+func (o *testScheduleOps) ListHosts() (map[string]*types.HostInfo, error) {
+	return o.hosts, nil
+}
+
+func (o *testScheduleOps) GetHost(id string) (*types.HostInfo, error) {
+	return o.hosts[id], nil
+}
+
+func (o *testScheduleOps) GetCurrentHostID() string {
+	return "host-1"
+}
+
+func (o *testScheduleOps) ProcessSchedule(item *types.ScheduleItem) (*types.InstanceInfo, error) {
+	o.processed = append(o.processed, item)
+	return &types.InstanceInfo{
+		ID:     item.Instance.ID,
+		Type:   item.Instance.Type,
+		HostID: "host-1",
+	}, nil
+}
+
+func (o *testScheduleOps) ListHostLoads() (map[string]*types.HostLoad, error) {
+	return o.loads, nil
+}
+
+func testHosts() map[string]*types.HostInfo {
+	return map[string]*types.HostInfo{
+		"host-1": {UUID: "host-1", State: types.HostStateUp, Tags: []string{"ssd", "rack=a"}},
+		"host-2": {UUID: "host-2", State: types.HostStateUp, Tags: []string{"rack=b"}},
+		"host-3": {UUID: "host-3", State: types.HostStateDown, Tags: []string{"ssd"}},
+	}
+}
+
+func testReplicaItem() *types.ScheduleItem {
+	return &types.ScheduleItem{
+		Action: types.ScheduleActionCreateReplica,
+		Instance: types.ScheduleInstance{
+			ID:         "vol-replica-1",
+			Type:       types.InstanceTypeReplica,
+			VolumeName: "vol",
+		},
+	}
+}
+
+func candidateMap(candidates []*types.ScheduleCandidate) map[string]*types.ScheduleCandidate {
+	m := map[string]*types.ScheduleCandidate{}
+	for _, c := range candidates {
+		m[c.HostID] = c
+	}
+	return m
+}
+
+func TestEvaluate(t *testing.T) {
+	assert := require.New(t)
+
+	s := NewOrcScheduler(&testScheduleOps{hosts: testHosts()})
+
+	// Soft anti-affinity prefers the hosts without the other replicas
+	policy := &types.SchedulePolicy{
+		Binding:   types.SchedulePolicyBindingSoftAntiAffinity,
+		HostIDMap: map[string]struct{}{"host-1": {}},
+	}
+	candidates, err := s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Len(candidates, 3)
+	assert.Equal("host-2", candidates[0].HostID)
+	assert.Equal("host-1", candidates[1].HostID)
+	assert.True(candidates[0].Score > candidates[1].Score)
+	assert.Equal("host-3", candidates[2].HostID)
+	assert.Contains(candidates[2].Reason, "host-up")
+
+	// Hard anti-affinity rejects them
+	policy.Binding = types.SchedulePolicyBindingHardAntiAffinity
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-2", candidates[0].HostID)
+	assert.Equal("", candidates[0].Reason)
+	assert.Contains(candidateMap(candidates)["host-1"].Reason, "anti-affinity")
+
+	// The hosts must carry all the tags
+	policy.HostIDMap = map[string]struct{}{}
+	policy.HostSelector = []string{"ssd", "rack=a"}
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-1", candidates[0].HostID)
+	assert.Equal("", candidates[0].Reason)
+	assert.Contains(candidateMap(candidates)["host-2"].Reason, "host-selector")
+
+	policy.Binding = "invalid"
+	_, err = s.Evaluate(testReplicaItem(), policy)
+	assert.NotNil(err)
+}
+
+type testFilter struct{}
+
+func (testFilter) Name() string {
+	return "test"
+}
+
+func (testFilter) Filter(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) string {
+	if host.UUID == "host-1" {
+		return "rejected by test"
+	}
+	return ""
+}
+
+type testScorer struct{}
+
+func (testScorer) Name() string {
+	return "test"
+}
+
+func (testScorer) Score(item *types.ScheduleItem, policy *types.SchedulePolicy, host *HostStatus) int {
+	if host.UUID == "host-1" {
+		return AntiAffinityScore * 2
+	}
+	return 0
+}
+
+func TestPlugins(t *testing.T) {
+	assert := require.New(t)
+
+	policy := &types.SchedulePolicy{
+		Binding:   types.SchedulePolicyBindingSoftAntiAffinity,
+		HostIDMap: map[string]struct{}{"host-1": {}},
+	}
+
+	s := NewOrcScheduler(&testScheduleOps{hosts: testHosts()})
+	s.RegisterScorer(testScorer{})
+	candidates, err := s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-1", candidates[0].HostID)
+
+	s.RegisterFilter(testFilter{})
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-2", candidates[0].HostID)
+	assert.Equal("test: rejected by test", candidateMap(candidates)["host-1"].Reason)
+}
+
+func TestRegisteredPlugins(t *testing.T) {
+	assert := require.New(t)
+
+	defer func() {
+		filters = nil
+		scorers = nil
+	}()
+	RegisterFilterPlugin(testFilter{})
+	RegisterScorePlugin(testScorer{})
+
+	s := NewOrcScheduler(&testScheduleOps{hosts: testHosts()})
+	assert.Len(s.filters, len(DefaultFilters())+1)
+	assert.Len(s.scorers, len(DefaultScorers())+1)
+
+	candidates, err := s.Evaluate(testReplicaItem(), nil)
+	assert.Nil(err)
+	assert.Equal("test: rejected by test", candidateMap(candidates)["host-1"].Reason)
+}
+
+func TestSchedule(t *testing.T) {
+	assert := require.New(t)
+
+	ops := &testScheduleOps{hosts: testHosts()}
+	s := NewOrcScheduler(ops)
+
+	policy := &types.SchedulePolicy{
+		Binding:      types.SchedulePolicyBindingHardAntiAffinity,
+		HostIDMap:    map[string]struct{}{},
+		HostSelector: []string{"ssd"},
+	}
+	instance, err := s.Schedule(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-1", instance.HostID)
+	assert.Len(ops.processed, 1)
+
+	// Fails rather than co-locates the replicas
+	policy.HostIDMap["host-1"] = struct{}{}
+	_, err = s.Schedule(testReplicaItem(), policy)
+	assert.NotNil(err)
+	assert.Contains(errors.Cause(err).Error(), "anti-affinity")
+	assert.Len(ops.processed, 1)
+
+	// The controller is checked against the policy on its host
+	item := &types.ScheduleItem{
+		Action: types.ScheduleActionCreateController,
+		Instance: types.ScheduleInstance{
+			ID:         "vol-controller",
+			Type:       types.InstanceTypeController,
+			HostID:     "host-1",
+			VolumeName: "vol",
+		},
+	}
+	_, err = s.Schedule(item, &types.SchedulePolicy{HostSelector: []string{"rack=b"}})
+	assert.NotNil(err)
+	_, err = s.Schedule(item, &types.SchedulePolicy{HostSelector: []string{"rack=a"}})
+	assert.Nil(err)
+	assert.Len(ops.processed, 2)
+}
+
+func TestZoneSpread(t *testing.T) {
+	assert := require.New(t)
+
+	hosts := map[string]*types.HostInfo{
+		"host-1": {UUID: "host-1", State: types.HostStateUp, Zone: "a", Region: "east"},
+		"host-2": {UUID: "host-2", State: types.HostStateUp, Zone: "a", Region: "east"},
+		"host-3": {UUID: "host-3", State: types.HostStateUp, Zone: "b", Region: "east"},
+	}
+	s := NewOrcScheduler(&testScheduleOps{hosts: hosts})
+
+	// The other zone comes first, then the other host in the same zone
+	policy := &types.SchedulePolicy{
+		Binding:   types.SchedulePolicyBindingSoftAntiAffinity,
+		HostIDMap: map[string]struct{}{"host-1": {}},
+		ZoneMap:   map[string]struct{}{"a": {}},
+	}
+	candidates, err := s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-3", candidates[0].HostID)
+	assert.Equal("host-2", candidates[1].HostID)
+	assert.Equal("host-1", candidates[2].HostID)
+
+	// The zone and the region are matched by the host selector
+	policy.HostSelector = []string{"zone=a", "region=east"}
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-2", candidates[0].HostID)
+	assert.Contains(candidateMap(candidates)["host-3"].Reason, "zone=a")
+}
+
+func TestDiskSchedule(t *testing.T) {
+	assert := require.New(t)
+
+	hosts := map[string]*types.HostInfo{
+		"host-1": {UUID: "host-1", State: types.HostStateUp, Disks: map[string]*types.DiskInfo{
+			"disk-1": {ID: "disk-1", Schedulable: true, Tags: []string{"ssd"},
+				StorageCapacity: 100 * GiB, StorageAvailable: 90 * GiB},
+			"disk-2": {ID: "disk-2", Schedulable: true,
+				StorageCapacity: 100 * GiB, StorageAvailable: 90 * GiB},
+			"disk-3": {ID: "disk-3", Schedulable: false, Tags: []string{"ssd", "nvme"},
+				StorageCapacity: 500 * GiB, StorageAvailable: 500 * GiB},
+		}},
+		// No disk, the replicas are in anonymous volumes
+		"host-2": {UUID: "host-2", State: types.HostStateUp},
+	}
+	loads := map[string]*types.HostLoad{
+		"host-1": {Replicas: 1, Provisioned: 20 * GiB, DiskProvisioned: map[string]int64{"disk-2": 20 * GiB}},
+	}
+	ops := &testScheduleOps{hosts: hosts, loads: loads}
+	s := NewOrcScheduler(ops)
+
+	// The disk with the most space not provisioned is chosen
+	policy := &types.SchedulePolicy{
+		Binding:   types.SchedulePolicyBindingSoftAntiAffinity,
+		HostIDMap: map[string]struct{}{"host-2": {}},
+	}
+	candidates, err := s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-1", candidates[0].HostID)
+	assert.Equal("disk-1", candidates[0].DiskID)
+	assert.Equal("", candidates[1].DiskID)
+
+	instance, err := s.Schedule(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-1", instance.HostID)
+	assert.Equal("disk-1", ops.processed[0].Instance.DiskID)
+
+	// The disk selector skips the disks without the tags, and the hosts
+	// without disk
+	policy.DiskSelector = []string{"ssd", "nvme"}
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Contains(candidateMap(candidates)["host-1"].Reason, "no schedulable disk with tags ssd,nvme")
+	assert.Contains(candidateMap(candidates)["host-2"].Reason, "host has no disk")
+
+	hosts["host-1"].Disks["disk-3"].Schedulable = true
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-1", candidates[0].HostID)
+	assert.Equal("disk-3", candidates[0].DiskID)
+}
+
+func TestLoadScorer(t *testing.T) {
+	assert := require.New(t)
+
+	hosts := map[string]*types.HostInfo{}
+	for _, id := range []string{"host-1", "host-2", "host-3"} {
+		hosts[id] = &types.HostInfo{
+			UUID:             id,
+			State:            types.HostStateUp,
+			StorageCapacity:  100 * GiB,
+			StorageAvailable: 80 * GiB,
+		}
+	}
+	ops := &testScheduleOps{
+		hosts: hosts,
+		loads: map[string]*types.HostLoad{
+			"host-1": {Replicas: 1, Provisioned: 10 * GiB},
+			"host-2": {Replicas: 5, Provisioned: 50 * GiB},
+		},
+	}
+	s := NewOrcScheduler(ops)
+	policy := &types.SchedulePolicy{
+		Binding: types.SchedulePolicyBindingSoftAntiAffinity,
+		Size:    10 * GiB,
+	}
+	hostIDs := func(candidates []*types.ScheduleCandidate) []string {
+		ids := []string{}
+		for _, c := range candidates {
+			ids = append(ids, c.HostID)
+		}
+		return ids
+	}
+
+	// The emptiest host first
+	candidates, err := s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal([]string{"host-3", "host-1", "host-2"}, hostIDs(candidates))
+	for _, c := range candidates {
+		assert.True(c.Score <= AntiAffinityScore+MaxLoadScore)
+	}
+
+	// The rebuilds in progress count against the host
+	ops.loads["host-3"] = &types.HostLoad{Replicas: 1, Provisioned: 10 * GiB, Rebuilding: 1}
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal([]string{"host-1", "host-2", "host-3"}, hostIDs(candidates))
+
+	// So does the disk
+	ops.loads["host-1"].Provisioned = 90 * GiB
+	hosts["host-1"].StorageAvailable = 5 * GiB
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal([]string{"host-2", "host-3", "host-1"}, hostIDs(candidates))
+
+	// The load doesn't outweigh the anti-affinity
+	policy.HostIDMap = map[string]struct{}{"host-3": {}, "host-1": {}}
+	candidates, err = s.Evaluate(testReplicaItem(), policy)
+	assert.Nil(err)
+	assert.Equal("host-2", candidates[0].HostID)
+}
+
+func TestLoadScorerWeights(t *testing.T) {
+	assert := require.New(t)
+
+	host := &HostStatus{
+		HostInfo: &types.HostInfo{UUID: "host-1"},
+		Load:     &types.HostLoad{Replicas: 3},
+	}
+	empty := &HostStatus{
+		HostInfo: &types.HostInfo{UUID: "host-2"},
+		Load:     &types.HostLoad{},
+	}
+
+	scorer := &LoadScorer{ReplicaWeight: 1}
+	assert.Equal(MaxLoadScore, scorer.Score(testReplicaItem(), nil, empty))
+	assert.Equal(MaxLoadScore/4, scorer.Score(testReplicaItem(), nil, host))
+
+	// The capacity is neutral if unknown
+	scorer = &LoadScorer{DiskWeight: 1}
+	assert.Equal(MaxLoadScore/2, scorer.Score(testReplicaItem(), nil, host))
+
+	scorer = &LoadScorer{}
+	assert.Equal(0, scorer.Score(testReplicaItem(), nil, host))
+}
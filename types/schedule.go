@@ -11,12 +11,19 @@ const (
 type SchedulePolicyBinding string
 
 const (
+	// SchedulePolicyBindingSoftAntiAffinity prefers the hosts without the
+	// instances in HostIDMap, SchedulePolicyBindingHardAntiAffinity fails
+	// rather than schedule onto them
 	SchedulePolicyBindingSoftAntiAffinity = "soft.anti-affinity"
+	SchedulePolicyBindingHardAntiAffinity = "hard.anti-affinity"
 )
 
+// Scheduler.Evaluate runs the filters and the scorers of Schedule without
+// scheduling anything
 type Scheduler interface {
 	Schedule(item *ScheduleItem, policy *SchedulePolicy) (*InstanceInfo, error)
 	Process(spec *ScheduleSpec, item *ScheduleItem) (*InstanceInfo, error)
+	Evaluate(item *ScheduleItem, policy *SchedulePolicy) ([]*ScheduleCandidate, error)
 }
 
 type ScheduleOps interface {
@@ -24,6 +31,19 @@ type ScheduleOps interface {
 	GetHost(id string) (*HostInfo, error)
 	GetCurrentHostID() string
 	ProcessSchedule(item *ScheduleItem) (*InstanceInfo, error)
+	// ListHostLoads only returns the hosts with replicas
+	ListHostLoads() (map[string]*HostLoad, error)
+}
+
+// HostLoad is what a host holds, counted from the good replicas. Provisioned
+// is the sum of the sizes of their volumes in bytes, and Rebuilding is the
+// number of replicas being rebuilt. DiskProvisioned is Provisioned by disk
+// ID, without the replicas in anonymous docker volumes.
+type HostLoad struct {
+	Replicas        int
+	Provisioned     int64
+	Rebuilding      int
+	DiskProvisioned map[string]int64
 }
 
 type ScheduleItem struct {
@@ -38,6 +58,9 @@ type ScheduleInstance struct {
 	HostID     string
 	VolumeName string
 	Name       string
+	// DiskID is the disk the replica is created on, chosen by the
+	// scheduler
+	DiskID string
 }
 
 type ScheduleSpec struct {
@@ -49,7 +72,27 @@ type ScheduleData struct {
 	Data         []byte
 }
 
+// SchedulePolicy constrains the hosts an instance can be scheduled to.
+// HostIDMap and ZoneMap are the hosts and the zones of the other instances
+// for the anti-affinity, which is always soft for the zones. The hosts must
+// carry all the tags in HostSelector, and the disks of the replicas all the
+// tags in DiskSelector.
 type SchedulePolicy struct {
-	Binding   SchedulePolicyBinding
-	HostIDMap map[string]struct{}
+	Binding      SchedulePolicyBinding
+	HostIDMap    map[string]struct{}
+	ZoneMap      map[string]struct{}
+	HostSelector []string
+	DiskSelector []string
+	// Size is the bytes to be provisioned on the host, 0 if none
+	Size int64
+}
+
+// ScheduleCandidate is a host considered by the scheduler. Reason is why the
+// host has been filtered out, and Score is only set if it hasn't. DiskID is
+// the disk chosen for a replica, empty if the host has no disk.
+type ScheduleCandidate struct {
+	HostID string
+	DiskID string
+	Score  int
+	Reason string
 }
@@ -14,6 +14,14 @@ const (
 	VolumeStateFaulted  = VolumeState("faulted")
 	VolumeStateHealthy  = VolumeState("healthy")
 	VolumeStateDegraded = VolumeState("degraded")
+
+	// The steady and transitional states of VolumeInfo.CurrentState
+	VolumeStateAttached  = VolumeState("attached")
+	VolumeStateCreating  = VolumeState("creating")
+	VolumeStateRestoring = VolumeState("restoring")
+	VolumeStateAttaching = VolumeState("attaching")
+	VolumeStateDetaching = VolumeState("detaching")
+	VolumeStateDeleting  = VolumeState("deleting")
 )
 
 type ReplicaMode string
@@ -24,6 +32,25 @@ const (
 	ReplicaModeERR = ReplicaMode("ERR")
 )
 
+// RestorePhase is the step a restore is at. A snapshot is cloned by copying
+// the snapshot chain of the source volume to the replicas first.
+type RestorePhase string
+
+const (
+	RestorePhaseCopying   = RestorePhase("copying")
+	RestorePhaseAttaching = RestorePhase("attaching")
+	RestorePhaseRestoring = RestorePhase("restoring")
+	RestorePhaseDetaching = RestorePhase("detaching")
+	RestorePhaseDone      = RestorePhase("done")
+)
+
+type HostState string
+
+const (
+	HostStateUp   = HostState("up")
+	HostStateDown = HostState("down")
+)
+
 type InstanceType string
 
 const (
@@ -34,17 +61,22 @@ const (
 
 type VolumeManager interface {
 	Start() error
+	Shutdown(timeout time.Duration) error
 	Create(volume *VolumeInfo) (*VolumeInfo, error)
 	Delete(name string) error
 	Get(name string) (*VolumeInfo, error)
 	List() ([]*VolumeInfo, error)
 	Attach(name string) error
 	Detach(name string) error
+	Expand(name string, size int64) error
+	UpdateReplicaCount(name string, count int) error
+	Salvage(name string) (*SalvageResult, error)
 	UpdateRecurring(name string, jobs []*RecurringJob) error
 	ReplicaRemove(volumeName, replicaName string) error
 
 	ListHosts() (map[string]*HostInfo, error)
 	GetHost(id string) (*HostInfo, error)
+	UpdateDisk(hostID, diskID string, tags []string, schedulable bool) (*HostInfo, error)
 
 	CheckController(ctrl Controller, volume *VolumeInfo) error
 	Cleanup(volume *VolumeInfo) error
@@ -53,9 +85,14 @@ type VolumeManager interface {
 	SnapshotOps(name string) (SnapshotOps, error)
 	VolumeBackupOps(name string) (VolumeBackupOps, error)
 	Settings() Settings
+	KVArchiver() KVArchiver
+	EventLog() EventLog
+	GetLeader() (string, error)
+	RegisterLeaderLoop(name string, loop func(stopCh <-chan struct{}))
 	ManagerBackupOps(backupTarget string) ManagerBackupOps
 
 	ProcessSchedule(spec *ScheduleSpec, item *ScheduleItem) (*InstanceInfo, error)
+	ExplainSchedule(name string, spec *VolumeInfo) ([]*ScheduleCandidate, error)
 }
 
 type Settings interface {
@@ -94,18 +131,32 @@ type Event interface{}
 type Monitor interface {
 	io.Closer
 	CronCh() chan<- Event
+	MonitorCh() chan<- Event
+	CleanupCh() chan<- Event
 }
 
 type BeginMonitoring func(volume *VolumeInfo, man VolumeManager) Monitor
 
 type GetController func(volume *VolumeInfo) Controller
 
+type GetReplicaStatus func(replica *ReplicaInfo) (*ReplicaStatus, error)
+
+// ConfirmControllerStopped returns nil only if the controller is known to
+// have stopped, without relying on the manager of its host. The cause of
+// the error is controller.ErrStillRunning if the controller still answers.
+type ConfirmControllerStopped func(controller *ControllerInfo) error
+
 type Controller interface {
 	Name() string
 	Endpoint() string
 	GetReplicaStates() ([]*ReplicaInfo, error)
 	AddReplica(replica *ReplicaInfo) error
 	RemoveReplica(replica *ReplicaInfo) error
+	// Size fails if the engine doesn't report the size, which means the
+	// engine cannot expand the volume
+	Size() (int64, error)
+	// Expand grows every replica to size, then refreshes the frontend
+	Expand(size int64) error
 
 	BgTaskQueue() TaskQueue
 	LatestBgTasks() []*BgTask
@@ -120,10 +171,15 @@ type Orchestrator interface {
 	GetVolume(volumeName string) (*VolumeInfo, error)     // For non-existing volume, return (nil, nil)
 	ListVolumes() ([]*VolumeInfo, error)
 	MarkBadReplica(volumeName string, replica *ReplicaInfo) error // find replica by Address
+	ClearBadReplica(volumeName string, replica *ReplicaInfo) error
+	SetReplicaRebuilding(volumeName string, replica *ReplicaInfo, rebuilding bool) error // find replica by name
 	UpdateVolume(volume *VolumeInfo) error
 
 	CreateController(volumeName, controllerName string, replicas map[string]*ReplicaInfo) (*ControllerInfo, error)
 	CreateReplica(volumeName, replicaName string) (*ReplicaInfo, error)
+	// ExplainReplicaSchedule evaluates the hosts for a new replica of the
+	// volume, which doesn't have to exist, without side effects
+	ExplainReplicaSchedule(volume *VolumeInfo) ([]*ScheduleCandidate, error)
 
 	StartInstance(instance *InstanceInfo) (*InstanceInfo, error)
 	StopInstance(instance *InstanceInfo) (*InstanceInfo, error)
@@ -131,11 +187,118 @@ type Orchestrator interface {
 
 	ListHosts() (map[string]*HostInfo, error)
 	GetHost(id string) (*HostInfo, error)
+	// ListHostLoads only returns the hosts with replicas
+	ListHostLoads() (map[string]*HostLoad, error)
+	// UpdateDisk updates the tags and the schedulable flag of a disk of
+	// the current host
+	UpdateDisk(diskID string, tags []string, schedulable bool) (*HostInfo, error)
 
 	Scheduler() Scheduler // return nil if not supported
 
 	ServiceLocator
+	Heartbeater
 	Settings
+	Watcher
+	KVMigrator
+	KVArchiver
+	Locker
+	LeaderElector
+	EventLog
+	InstanceReconciler
+}
+
+// InstanceReconciler compares the instances in the key value store with the
+// containers of the current host. ReconcileVolume refreshes Running and
+// Address of the instances of the volume on the current host, and marks the
+// replicas whose containers are missing bad. ListOrphanInstances returns the
+// containers of the current host unknown to the key value store, which have
+// been created longer than grace ago. FenceInstances takes the instances of
+// the volume on the hosts which are down out of the key value store: the
+// controller is removed, and the replicas are marked bad and stopped, so the
+// volume can be attached on another host. It returns the fenced instances.
+type InstanceReconciler interface {
+	ReconcileVolume(volumeName string) (*ReconcileResult, error)
+	ListOrphanInstances(grace time.Duration) ([]*InstanceInfo, error)
+	RemoveOrphanInstance(instance *InstanceInfo) error
+	FenceInstances(volumeName string) ([]*InstanceInfo, error)
+}
+
+type ReconcileResult struct {
+	Updated []*InstanceInfo
+	Missing []*InstanceInfo
+}
+
+type OrphanPolicy string
+
+const (
+	OrphanPolicyReport = OrphanPolicy("report")
+	OrphanPolicyRemove = OrphanPolicy("remove")
+)
+
+// FailoverPolicy is what to do with an attached volume once the host of its
+// controller is down, none if it's empty. The volume is only reattached once
+// its old controller is confirmed stopped, or once its host has been down
+// long enough to have stopped it.
+type FailoverPolicy string
+
+const (
+	FailoverPolicyNone     = FailoverPolicy("none")
+	FailoverPolicyReattach = FailoverPolicy("reattach")
+)
+
+// EventLog keeps the events of the cluster in the key value store.
+// ListEvents returns the events since the time in the order they happened,
+// and of all the volumes if volumeName is "". PruneEvents removes the
+// events before the time, and the oldest ones beyond max.
+type EventLog interface {
+	AddEvent(event *EventInfo) error
+	ListEvents(volumeName string, since time.Time) ([]*EventInfo, error)
+	PruneEvents(before time.Time, max int) (int, error)
+}
+
+// LeaderElector elects one manager of the cluster as the leader, for the
+// work which should only be done once per cluster. RunElection campaigns for
+// the current host until stopCh is closed, and calls onChange with true when
+// the current host becomes the leader, and false when it's no longer the
+// leader. GetLeader returns "" if there is no leader at the moment.
+type LeaderElector interface {
+	RunElection(stopCh <-chan struct{}, onChange func(leader bool))
+	GetLeader() (string, error)
+}
+
+// Locker provides leases shared by all the managers in the cluster. A lease
+// expires after ttl unless the holder renews it by TryLock again, so a
+// crashed holder won't block the others forever.
+type Locker interface {
+	TryLock(name, holder string, ttl time.Duration) error
+	Unlock(name, holder string) error
+}
+
+// KVMigrator upgrades the key value store to the schema of this manager.
+// It returns the changes made, or planned for dryRun.
+type KVMigrator interface {
+	MigrateKV(dryRun bool) ([]string, error)
+}
+
+// KVArchiver exports and imports the metadata of the whole cluster, e.g. to
+// recover from losing the key value store
+type KVArchiver interface {
+	ExportKV() (*KVArchive, error)
+	ImportKV(archive *KVArchive, overwrite bool) (*KVImportResult, error)
+}
+
+// Watcher reports changes made by any manager in the cluster. The channels
+// will be closed if the watch fails, and the caller should watch again.
+type Watcher interface {
+	WatchVolumes(stopCh <-chan struct{}) (<-chan string, error) // volume names
+	WatchHosts(stopCh <-chan struct{}) (<-chan string, error)   // host UUIDs
+	WatchSettings(stopCh <-chan struct{}) (<-chan struct{}, error)
+}
+
+// Heartbeater keeps the current host up in the cluster. RunHeartbeat
+// refreshes the heartbeat of the current host until stopCh is closed.
+type Heartbeater interface {
+	RunHeartbeat(stopCh <-chan struct{})
 }
 
 type ServiceLocator interface {
@@ -143,9 +306,77 @@ type ServiceLocator interface {
 	GetAddress(hostID string) (string, error) // Return <host>:<port>
 }
 
+type KVArchive struct {
+	ArchiveVersion int           `json:"archiveVersion"`
+	SchemaVersion  int           `json:"schemaVersion"`
+	Created        string        `json:"created"`
+	Hosts          []*HostInfo   `json:"hosts"`
+	Settings       *SettingsInfo `json:"settings,omitempty"`
+	Volumes        []*VolumeInfo `json:"volumes"`
+}
+
+// KVImportResult lists the entries in the archive by "host/<uuid>",
+// "settings" and "volume/<name>"
+type KVImportResult struct {
+	Imported  []string `json:"imported"`
+	Unchanged []string `json:"unchanged"`
+	Conflicts []string `json:"conflicts"`
+}
+
+type EventType string
+
+const (
+	EventTypeNormal  = EventType("normal")
+	EventTypeWarning = EventType("warning")
+)
+
+const (
+	EventReasonReplicaBad       = "ReplicaBad"
+	EventReasonReplicaAdded     = "ReplicaAdded"
+	EventReasonReplicaAddFailed = "ReplicaAddFailed"
+	EventReasonReplicaRemoved   = "ReplicaRemoved"
+	EventReasonControllerFailed = "ControllerFailed"
+	EventReasonAutoDetached     = "AutoDetached"
+	EventReasonJobSucceeded     = "RecurringJobSucceeded"
+	EventReasonJobFailed        = "RecurringJobFailed"
+	EventReasonBackupCompleted  = "BackupCompleted"
+	EventReasonBackupFailed     = "BackupFailed"
+	EventReasonExpanded         = "Expanded"
+	EventReasonSalvaged         = "Salvaged"
+	EventReasonSalvageFailed    = "SalvageFailed"
+	EventReasonExpandFailed     = "ExpandFailed"
+	EventReasonRestored         = "Restored"
+	EventReasonRestoreFailed    = "RestoreFailed"
+	EventReasonInstanceMissing  = "InstanceMissing"
+	EventReasonOrphanFound      = "OrphanFound"
+	EventReasonOrphanRemoved    = "OrphanRemoved"
+	EventReasonHostDown         = "ControllerHostDown"
+	EventReasonFailedOver       = "FailedOver"
+	EventReasonFailoverFailed   = "FailoverFailed"
+	EventReasonFenced           = "ControllerFenced"
+)
+
+type EventInfo struct {
+	ID      string    `json:"id"`
+	Time    string    `json:"time"`
+	Type    EventType `json:"type"`
+	Reason  string    `json:"reason"`
+	Volume  string    `json:"volume,omitempty"`
+	HostID  string    `json:"hostId,omitempty"`
+	Message string    `json:"message"`
+}
+
 type SettingsInfo struct {
 	BackupTarget string `json:"backupTarget" mapstructure:"backupTarget"`
 	EngineImage  string `json:"engineImage" mapstructure:"engineImage"`
+	// StaleReplicaTimeout in minutes applies to the volumes without their
+	// own StaleReplicaTimeout
+	StaleReplicaTimeout int `json:"staleReplicaTimeout" mapstructure:"staleReplicaTimeout"`
+	// AutoSalvage salvages a volume once all its replicas have failed
+	AutoSalvage bool `json:"autoSalvage" mapstructure:"autoSalvage"`
+	// OrphanPolicy is what to do with the containers unknown to the key
+	// value store, report if it's empty
+	OrphanPolicy OrphanPolicy `json:"orphanPolicy" mapstructure:"orphanPolicy"`
 }
 
 type VolumeInfo struct {
@@ -153,15 +384,63 @@ type VolumeInfo struct {
 	Size                int64
 	BaseImage           string
 	FromBackup          string
+	FromSnapshot        *SnapshotSource
 	NumberOfReplicas    int
 	StaleReplicaTimeout time.Duration
-	Controller          *ControllerInfo
-	Replicas            map[string]*ReplicaInfo //key is replicaName
-	State               VolumeState
-	EngineImage         string
-	Endpoint            string
-	Created             string
-	RecurringJobs       []*RecurringJob
+	FailoverPolicy      FailoverPolicy
+	// ReplicaBinding is the anti-affinity of the replicas, soft if it's
+	// empty. The replicas and the controller are only scheduled to the
+	// hosts carrying all the tags in HostSelector, and the replicas to the
+	// disks carrying all the tags in DiskSelector.
+	ReplicaBinding SchedulePolicyBinding
+	HostSelector   []string
+	DiskSelector   []string
+	Controller     *ControllerInfo
+	Replicas       map[string]*ReplicaInfo //key is replicaName
+	State          VolumeState
+	EngineImage    string
+	Endpoint       string
+	Created        string
+	RecurringJobs  []*RecurringJob
+
+	// DesiredState is attached or detached, as last requested by the
+	// user. CurrentState is persisted by the manager along the state
+	// transitions, and empty for the volumes created before it existed.
+	DesiredState VolumeState
+	CurrentState VolumeState
+
+	RestoreStatus *RestoreStatus
+
+	// SpreadWarning tells why the replicas aren't spread over as many
+	// zones and hosts as they could be, empty if they are. It's only
+	// filled in for the API responses.
+	SpreadWarning string `json:"-"`
+
+	// ResourceVersion is the kvstore revision the volume was read at,
+	// updates are rejected if the volume has been modified since
+	ResourceVersion int64 `json:"-"`
+}
+
+// SnapshotSource is a snapshot of another volume to seed a new volume from
+type SnapshotSource struct {
+	Volume   string
+	Snapshot string
+}
+
+// RestoreStatus is the progress of creating a volume from a backup or a
+// snapshot, which runs in the background. Error is set if the restore has
+// failed, Phase is where it failed then. Backup is empty when created from
+// a snapshot. Progress is the percentage of the data copied to the volume,
+// only set when known: the engine doesn't report the progress of restoring
+// a backup, so it's unknown until the restore is done, while a snapshot
+// being cloned reports the replicas copied so far.
+type RestoreStatus struct {
+	Backup   string
+	Phase    RestorePhase
+	Progress *int `json:",omitempty"`
+	Error    string
+	Started  string
+	Finished string
 }
 
 type InstanceInfo struct {
@@ -172,6 +451,9 @@ type InstanceInfo struct {
 	Address    string
 	Running    bool
 	VolumeName string
+	// DiskID is the disk of the host holding the data of the replica,
+	// empty if it's in an anonymous docker volume
+	DiskID string `json:",omitempty"`
 }
 
 type ControllerInfo struct {
@@ -183,6 +465,35 @@ type ReplicaInfo struct {
 
 	Mode         ReplicaMode
 	BadTimestamp string
+	// Rebuilding is set while the replica is being added to the controller
+	Rebuilding bool
+	// GCTimestamp is when a bad replica will be removed, filled in on read
+	GCTimestamp string `json:"-"`
+
+	ResourceVersion int64 `json:"-"`
+}
+
+// ReplicaStatus is the metadata reported by a replica itself
+type ReplicaStatus struct {
+	Chain           []string `json:"chain"`
+	RevisionCounter int64    `json:"revisionCounter"`
+}
+
+// SalvageCandidate is the evidence of a bad replica considered by salvage
+type SalvageCandidate struct {
+	Replica         string   `json:"replica"`
+	HostID          string   `json:"hostId"`
+	BadTimestamp    string   `json:"badTimestamp"`
+	RevisionCounter int64    `json:"revisionCounter"`
+	Chain           []string `json:"chain"`
+	Error           string   `json:"error,omitempty"`
+}
+
+type SalvageResult struct {
+	Volume     string              `json:"volume"`
+	Chosen     string              `json:"chosen"`
+	Reason     string              `json:"reason"`
+	Candidates []*SalvageCandidate `json:"candidates"`
 }
 
 type SnapshotInfo struct {
@@ -200,6 +511,41 @@ type HostInfo struct {
 	UUID    string `json:"uuid"`
 	Name    string `json:"name"`
 	Address string `json:"address"`
+	// Tags are matched by the host selectors of the volumes, e.g. "ssd"
+	// or "rack=a"
+	Tags []string `json:"tags,omitempty"`
+	// Zone and Region are the failure domains of the host, the replicas
+	// are spread over the zones first
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
+
+	// StorageCapacity and StorageAvailable in bytes are the sums of the
+	// schedulable disks, reported along the heartbeat
+	StorageCapacity  int64 `json:"storageCapacity,omitempty"`
+	StorageAvailable int64 `json:"storageAvailable,omitempty"`
+	// Disks are where the replicas are stored, by disk ID
+	Disks map[string]*DiskInfo `json:"disks,omitempty"`
+
+	// State is decided by the orchestrator from LastHeartbeat when read
+	State         HostState `json:"-"`
+	LastHeartbeat string    `json:"lastHeartbeat,omitempty"`
+}
+
+// DiskInfo is a directory of the host holding replicas. The ID is kept in
+// the directory, so the disk can be mounted elsewhere. Tags are matched by
+// the disk selectors of the volumes, and no replica is scheduled to the disk
+// unless it's Schedulable.
+type DiskInfo struct {
+	ID          string   `json:"id"`
+	Path        string   `json:"path"`
+	Tags        []string `json:"tags,omitempty"`
+	Schedulable bool     `json:"schedulable"`
+
+	StorageCapacity  int64 `json:"storageCapacity,omitempty"`
+	StorageAvailable int64 `json:"storageAvailable,omitempty"`
+	// StorageProvisioned is the sum of the sizes of the replicas on the
+	// disk, filled in on read by the manager
+	StorageProvisioned int64 `json:"storageProvisioned,omitempty"`
 }
 
 type BackupInfo struct {
@@ -235,6 +581,8 @@ type BackupBgTask struct {
 	BackupTarget string `json:"backupTarget"`
 
 	CleanupHook func() error `json:"-"`
+	// DoneHook is called with the result of the backup
+	DoneHook func(err error) `json:"-"`
 }
 
 type BackupVolumeInfo struct {
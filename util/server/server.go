@@ -1,49 +1,75 @@
 package server
 
 import (
-	"github.com/Sirupsen/logrus"
-	"github.com/docker/go-connections/sockets"
-	"github.com/pkg/errors"
+	"context"
 	"net/http"
 	"os"
 	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-connections/sockets"
+	"github.com/pkg/errors"
 )
 
 type UnixServer struct {
 	sockFile string
+	server   *http.Server
 }
 
 func NewUnixServer(sockFile string) *UnixServer {
-	return &UnixServer{sockFile}
+	return &UnixServer{
+		sockFile: sockFile,
+		server:   &http.Server{Addr: sockFile},
+	}
 }
 
 func (s *UnixServer) Serve(handler http.Handler) {
 	if err := os.MkdirAll(filepath.Dir(s.sockFile), 0755); err != nil {
 		logrus.Fatalf("%+v", errors.Wrapf(err, "error creating parent dir for '%s'", s.sockFile))
 	}
-	server := http.Server{
-		Addr:    s.sockFile,
-		Handler: handler,
-	}
+	s.server.Handler = handler
 	listener, err := sockets.NewUnixSocket(s.sockFile, 0)
 	if err != nil {
 		logrus.Fatalf("Failed opening unix socket '%s'", s.sockFile)
 	}
 	logrus.Infof("Unix socket server listening at %v", s.sockFile)
-	err = server.Serve(listener)
+	err = s.server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return
+	}
 	logrus.Fatalf("server.Serve returned error: %+v", errors.Wrap(err, "http server error"))
 }
 
+// Shutdown stops taking new requests, and waits for the ones in progress
+// until ctx is done
+func (s *UnixServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
 type TCPServer struct {
-	addr string
+	addr   string
+	server *http.Server
 }
 
 func NewTCPServer(addrPort string) *TCPServer {
-	return &TCPServer{addrPort}
+	return &TCPServer{
+		addr:   addrPort,
+		server: &http.Server{Addr: addrPort},
+	}
 }
 
 func (s *TCPServer) Serve(handler http.Handler) {
 	logrus.Infof("TCP server listening at %v", s.addr)
-	err := http.ListenAndServe(s.addr, handler)
+	s.server.Handler = handler
+	err := s.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return
+	}
 	logrus.Fatalf("http.ListenAndServe returned error: %+v", errors.Wrap(err, "http server error"))
 }
+
+// Shutdown stops taking new requests, and waits for the ones in progress
+// until ctx is done
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}